@@ -0,0 +1,194 @@
+// Package audit keeps an append-only log of security and job events, one JSON object per line
+// Uses a singleton design pattern like logger, call Init before recording anything
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/blgolden/igendec/logger"
+)
+
+// Type is the kind of event
+type Type string
+
+// Types of event
+const (
+	SignIn               Type = "signin"
+	SignInFailed         Type = "signin-failed"
+	Register             Type = "register"
+	PasswordChange       Type = "password-change"
+	PasswordChangeFailed Type = "password-change-failed"
+	PasswordResetRequest Type = "password-reset-request"
+	PasswordReset        Type = "password-reset"
+	PasswordResetFailed  Type = "password-reset-failed"
+	SessionRevoke        Type = "session-revoke"
+	EmailVerify          Type = "email-verify"
+	EmailVerifyFailed    Type = "email-verify-failed"
+	TwoFactorEnable      Type = "2fa-enable"
+	TwoFactorDisable     Type = "2fa-disable"
+	JobSubmit            Type = "job-submit"
+	JobDelete            Type = "job-delete"
+	JobRestore           Type = "job-restore"
+	JobPurge             Type = "job-purge"
+	JobDownload          Type = "job-download"
+	CompareDownload      Type = "compare-download"
+	QuotaChange          Type = "quota-change"
+	RoleChange           Type = "role-change"
+	AccessChange         Type = "access-change"
+	AccountDisable       Type = "account-disable"
+	AccountEnable        Type = "account-enable"
+	Unlock               Type = "unlock"
+	Backup               Type = "backup"
+	AuditExport          Type = "audit-export"
+)
+
+// Types lists every type of event
+var Types = []Type{
+	SignIn, SignInFailed, Register, PasswordChange, PasswordChangeFailed,
+	PasswordResetRequest, PasswordReset, PasswordResetFailed, SessionRevoke,
+	EmailVerify, EmailVerifyFailed, TwoFactorEnable, TwoFactorDisable,
+	JobSubmit, JobDelete, JobRestore, JobPurge, JobDownload, CompareDownload,
+	QuotaChange, RoleChange, AccessChange, AccountDisable, AccountEnable,
+	Unlock, Backup, AuditExport,
+}
+
+// Event is a line of the audit log
+type Event struct {
+	Time   time.Time
+	Type   Type
+	User   string // who did it, for failed sign ins this is the username they gave
+	IP     string `json:",omitempty"`
+	Target string `json:",omitempty"` // the job or user acted on
+	Detail string `json:",omitempty"`
+}
+
+var (
+	mu       sync.Mutex
+	file     *os.File
+	filename string
+)
+
+// Init opens the audit log at name, creating it if needed
+func Init(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Start on a new line if the last event was cut short, so the next isn't lost with it
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			_, err = f.Write([]byte{'\n'})
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	file, filename = f, name
+	return nil
+}
+
+// Close closes the audit log, nothing is recorded afterwards
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if file == nil {
+		return nil
+	}
+	err := file.Close()
+	file = nil
+	return err
+}
+
+// Record appends an event to the log, setting its time if it doesn't have one
+// Each event is synced to disk before Record returns. Failures are logged rather than
+// returned, as they shouldn't stop what is being recorded
+func Record(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		logger.Error("recording audit event: %s", err)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if file == nil {
+		return
+	}
+	if _, err = file.Write(append(data, '\n')); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		logger.Error("recording audit event %s: %s", data, err)
+	}
+}
+
+// Filter picks events from the log, empty fields match every event
+// From is inclusive and To exclusive
+type Filter struct {
+	User string
+	Type Type
+	From time.Time
+	To   time.Time
+}
+
+// Match returns true if the event passes the filter
+func (f Filter) Match(ev Event) bool {
+	switch {
+	case f.User != "" && ev.User != f.User && ev.Target != f.User:
+		return false
+	case f.Type != "" && ev.Type != f.Type:
+		return false
+	case !f.From.IsZero() && ev.Time.Before(f.From):
+		return false
+	case !f.To.IsZero() && !ev.Time.Before(f.To):
+		return false
+	}
+	return true
+}
+
+// Read calls fn with every event in the log that passes the filter, oldest first
+// Lines that can't be parsed, such as one cut short by a crash, are skipped
+func Read(filter Filter, fn func(Event) error) error {
+	mu.Lock()
+	name := filename
+	mu.Unlock()
+	if name == "" {
+		return errors.New("audit log is not open")
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			logger.Warn("reading audit log: skipping line %d: %s", line, err)
+			continue
+		}
+		if !filter.Match(ev) {
+			continue
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
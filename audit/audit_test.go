@@ -0,0 +1,52 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndRead(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := Init(name); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	Record(Event{Time: start, Type: SignIn, User: "bob"})
+	Record(Event{Time: start.Add(time.Hour), Type: JobDelete, User: "bob", Target: "weaning"})
+	Record(Event{Time: start.Add(2 * time.Hour), Type: QuotaChange, User: "alice", Target: "bob"})
+
+	// A line cut short by a crash is skipped
+	f, _ := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"Time":"2021-03-01T03:00:00Z","Type":"sig`)
+	f.Close()
+	Close()
+	if err := Init(name); err != nil {
+		t.Fatal(err)
+	}
+	Record(Event{Time: start.Add(3 * time.Hour), Type: SignIn, User: "carol"})
+
+	for _, tc := range []struct {
+		name   string
+		filter Filter
+		want   int
+	}{
+		{"everything", Filter{}, 4},
+		{"by or about bob", Filter{User: "bob"}, 3},
+		{"by alice", Filter{User: "alice"}, 1},
+		{"of a type", Filter{Type: JobDelete}, 1},
+		{"time range", Filter{From: start.Add(time.Hour), To: start.Add(2 * time.Hour)}, 1},
+	} {
+		var got []Event
+		err := Read(tc.filter, func(ev Event) error {
+			got = append(got, ev)
+			return nil
+		})
+		if err != nil || len(got) != tc.want {
+			t.Errorf("%s: got %d events, %v, want %d", tc.name, len(got), err, tc.want)
+		}
+	}
+}
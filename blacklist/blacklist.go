@@ -0,0 +1,181 @@
+// Package blacklist keeps the users who aren't allowed to sign in
+// The list is read from a file, which is read again whenever it changes so users can be
+// blacklisted without restarting the server
+package blacklist
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blgolden/igendec/logger"
+)
+
+// Entry is a blacklisted user
+type Entry struct {
+	Username string
+	Reason   string    // why they are blacklisted, for administrators
+	Expires  time.Time // when they can sign in again, zero if they can't
+}
+
+// Active returns true if the entry hasn't expired
+func (e Entry) Active(now time.Time) bool {
+	return e.Expires.IsZero() || now.Before(e.Expires)
+}
+
+// List is the blacklisted users read from a file
+type List struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]Entry
+	modTime time.Time
+	size    int64
+}
+
+// New returns an empty list that is read from path by Reload
+// An empty path is a list that is always empty
+func New(path string) *List {
+	return &List{path: path, entries: make(map[string]Entry)}
+}
+
+// Check returns the users entry if they are blacklisted at now
+func (l *List) Check(username string, now time.Time) (Entry, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	e, ok := l.entries[username]
+	if !ok || !e.Active(now) {
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// Entries returns every entry, including expired ones, sorted by username
+func (l *List) Entries() []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entries := make([]Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Username < entries[j].Username })
+	return entries
+}
+
+// Reload reads the file again if it has changed since it was last read, and returns true if it was
+// A file that doesn't exist is an empty list. If the file can't be read the list is left as it was
+func (l *List) Reload() (bool, error) {
+	if l.path == "" {
+		return false, nil
+	}
+	info, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		info, err = nil, nil
+	} else if err != nil {
+		return false, err
+	} else if info.IsDir() {
+		return false, fmt.Errorf("'%s' is a directory", l.path)
+	}
+
+	var modTime time.Time
+	var size int64 = -1
+	if info != nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	l.mu.RLock()
+	unchanged := modTime.Equal(l.modTime) && size == l.size
+	l.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	entries := make(map[string]Entry)
+	if info != nil {
+		file, err := os.Open(l.path)
+		if err != nil {
+			return false, err
+		}
+		entries, err = Parse(file)
+		file.Close()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	l.mu.Lock()
+	l.entries, l.modTime, l.size = entries, modTime, size
+	l.mu.Unlock()
+	return true, nil
+}
+
+// Watch reloads the list every interval until the context is cancelled
+func (l *List) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if changed, err := l.Reload(); err != nil {
+			logger.Warn("reading blacklist, keeping the old one: %s", err)
+		} else if changed {
+			logger.Info("read blacklist '%s' again, %d users", l.path, len(l.Entries()))
+		}
+	}
+}
+
+// Parse reads a blacklist, one user a line as
+//
+//	username | expires | reason
+//
+// where expires is a date, 2006-01-02, or an RFC 3339 time, and it and the reason can be left out
+// Blank lines and lines starting with # are ignored. A bad expiry is logged, and the user is
+// blacklisted for good rather than not at all
+func Parse(r io.Reader) (map[string]Entry, error) {
+	entries := make(map[string]Entry)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, "|", 3)
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		e := Entry{Username: fields[0]}
+		if e.Username == "" {
+			logger.Warn("blacklist line %d: no username", n)
+			continue
+		}
+		if len(fields) > 1 && fields[1] != "" {
+			expires, err := parseExpiry(fields[1])
+			if err != nil {
+				logger.Warn("blacklist line %d: bad expiry '%s', blacklisting '%s' with no expiry", n, fields[1], e.Username)
+			}
+			e.Expires = expires
+		}
+		if len(fields) > 2 {
+			e.Reason = fields[2]
+		}
+		entries[e.Username] = e
+	}
+	return entries, scanner.Err()
+}
+
+// parseExpiry reads a date, which is the start of the day in local time, or an RFC 3339 time
+func parseExpiry(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,80 @@
+package blacklist
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	entries, err := Parse(strings.NewReader(`# old style, a name a line
+username1
+userABC123
+
+bob | 2021-03-02 | sharing his account
+carol || asked to leave
+dave | 2021-03-01T12:00:00Z
+erin | soon | bad expiry
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]Entry{
+		"username1":  {Username: "username1"},
+		"userABC123": {Username: "userABC123"},
+		"bob":        {Username: "bob", Reason: "sharing his account", Expires: time.Date(2021, 3, 2, 0, 0, 0, 0, time.Local)},
+		"carol":      {Username: "carol", Reason: "asked to leave"},
+		"dave":       {Username: "dave", Expires: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)},
+		"erin":       {Username: "erin", Reason: "bad expiry"},
+	} {
+		got, ok := entries[name]
+		if !ok || got.Username != want.Username || got.Reason != want.Reason || !got.Expires.Equal(want.Expires) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+	if len(entries) != 6 {
+		t.Errorf("got %d entries, want 6", len(entries))
+	}
+}
+
+func TestReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "blacklist.txt")
+	list := New(name)
+	now := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	// No file is an empty list
+	if _, err := list.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := list.Check("bob", now); ok {
+		t.Error("bob is blacklisted without a file")
+	}
+
+	if err := os.WriteFile(name, []byte("bob | 2021-03-01T12:00:00Z | testing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := list.Reload(); err != nil || !changed {
+		t.Fatalf("reload after writing: got %t, %v", changed, err)
+	}
+	if e, ok := list.Check("bob", now); !ok || e.Reason != "testing" {
+		t.Errorf("bob before expiry: got %+v, %t", e, ok)
+	}
+	if _, ok := list.Check("bob", now.Add(12*time.Hour)); ok {
+		t.Error("bob is blacklisted after expiry")
+	}
+	if changed, err := list.Reload(); err != nil || changed {
+		t.Errorf("reload without changes: got %t, %v", changed, err)
+	}
+
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := list.Reload(); err != nil || !changed {
+		t.Fatalf("reload after removing: got %t, %v", changed, err)
+	}
+	if len(list.Entries()) != 0 {
+		t.Errorf("got %v after removing the file, want none", list.Entries())
+	}
+}
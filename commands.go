@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/users"
+)
+
+// backup writes a snapshot of the users database to filename
+// The snapshot is written next to filename and renamed into place once it is complete
+func backup(filename string) {
+	logger.Init()
+	users.UsersPath = *usersPath
+	users.DatabaseType = *databaseType
+	users.Init()
+	defer users.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		logger.Fatal("creating snapshot: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	manifest, err := users.Backup(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		logger.Fatal("writing snapshot: %s", err)
+	}
+	fmt.Printf("backed up %d users (%d files) to %s\n", manifest.Users, len(manifest.Files), filename)
+}
+
+// restore replaces the users database with the snapshot in filename
+func restore(filename string) {
+	logger.Init()
+	users.UsersPath = *usersPath
+	users.DatabaseType = *databaseType
+
+	manifest, err := users.Restore(filename)
+	if err != nil {
+		logger.Fatal("restoring %s: %s", filename, err)
+	}
+	fmt.Printf("restored %d users (%d files) from the snapshot taken %s\n", manifest.Users, len(manifest.Files), manifest.Created.Local().Format("2006-01-02 15:04:05"))
+}
+
+// migrate upgrades every document in the users database to the current version
+func migrate(dryRun bool) {
+	logger.Init()
+	users.UsersPath = *usersPath
+	users.DatabaseType = *databaseType
+	users.Init()
+	defer users.Close()
+
+	changes, err := users.Migrate(dryRun)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if err != nil {
+		logger.Fatal("migrating: %s", err)
+	}
+	switch {
+	case len(changes) == 0:
+		fmt.Println("everything is up to date")
+	case dryRun:
+		fmt.Printf("%d files would be changed, run again without --dry-run to change them\n", len(changes))
+	default:
+		fmt.Printf("changed %d files\n", len(changes))
+	}
+}
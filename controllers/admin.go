@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/blgolden/igendec/audit"
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/users"
+	"github.com/gofiber/fiber/v2"
+)
+
+// AdminBackup returns a snapshot of the whole users database
+// The snapshot is streamed as it is made, so an error part way through can only be logged,
+// leaving the download cut short. The snapshot can be restored with the restore command
+func (h *Handler) AdminBackup(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	// The request context is gone by the time the stream is written
+	username, ip := user.Username, c.IP()
+	filename := "igendec-backup-" + time.Now().UTC().Format("20060102-150405") + ".tar.gz"
+	c.Set(fiber.HeaderContentType, "application/gzip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		manifest, err := users.Backup(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			logger.Error("backing up users database for user '%s': %s", username, err)
+			return
+		}
+		logger.Info("user '%s' backed up %d users (%d files)", username, manifest.Users, len(manifest.Files))
+		audit.Record(audit.Event{Type: audit.Backup, User: username, IP: ip,
+			Detail: fmt.Sprintf("%d users, %d files", manifest.Users, len(manifest.Files))})
+	})
+	return nil
+}
+
+// AdminQuota returns the quota and usage of a user as JSON
+func (h *Handler) AdminQuota(c *fiber.Ctx) error {
+	user, err := users.NewUser(c.Query("user")).Get()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("bad username")
+	}
+	usage, err := user.Usage()
+	if err != nil {
+		logger.Warn("measuring usage of user '%s': %s", user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	return c.JSON(fiber.Map{"Quota": user.GetQuota(), "Default": user.Quota == nil, "Usage": usage})
+}
+
+// AdminQuotaUpdate gives a user their own quota
+// The jobs, bytes and runs form values are the limits, 0 for no limit. Setting default
+// puts the user back on the servers default quota
+func (h *Handler) AdminQuotaUpdate(c *fiber.Ctx) error {
+	admin, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	user := users.NewUser(c.FormValue("user"))
+	defer user.Lock()()
+	if _, err = user.Get(); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("bad username")
+	}
+
+	if c.FormValue("default") != "" {
+		user.Quota = nil
+	} else {
+		quota := &users.Quota{}
+		if quota.Jobs, err = strconv.Atoi(c.FormValue("jobs", "0")); err != nil || quota.Jobs < 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("jobs must be a whole number")
+		}
+		if quota.Bytes, err = strconv.ParseInt(c.FormValue("bytes", "0"), 10, 64); err != nil || quota.Bytes < 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("bytes must be a whole number")
+		}
+		if quota.Runs, err = strconv.Atoi(c.FormValue("runs", "0")); err != nil || quota.Runs < 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("runs must be a whole number")
+		}
+		user.Quota = quota
+	}
+
+	if err = user.Update(); err != nil {
+		logger.Warn("updating quota of user '%s': %s", user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	logger.Info("user '%s' set the quota of user '%s' to %+v", admin.Username, user.Username, user.GetQuota())
+	detail := "default"
+	if user.Quota != nil {
+		detail = fmt.Sprintf("jobs %d, bytes %d, runs %d", user.Quota.Jobs, user.Quota.Bytes, user.Quota.Runs)
+	}
+	record(c, audit.QuotaChange, admin.Username, user.Username, detail)
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// AdminLockouts renders the accounts and addresses with failed sign ins
+func (h *Handler) AdminLockouts(c *fiber.Ctx) error {
+	now := time.Now()
+	accounts, err := users.ListLockouts(now)
+	if err != nil {
+		logger.Warn("listing locked accounts: %s", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	return h.RenderPrimary("admin-lockouts", fiber.Map{
+		"Now":       now,
+		"Accounts":  accounts,
+		"Addresses": h.Addresses.List(now),
+	}, c)
+}
+
+// AdminLockoutsUnlock forgets the failed sign ins of the user or ip form value
+func (h *Handler) AdminLockoutsUnlock(c *fiber.Ctx) error {
+	admin, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	if ip := c.FormValue("ip"); ip != "" {
+		if !h.Addresses.Unlock(ip) {
+			return c.Status(fiber.StatusBadRequest).SendString("No failed sign ins from that address")
+		}
+		logger.Info("user '%s' unlocked address %s", admin.Username, ip)
+		record(c, audit.Unlock, admin.Username, ip, "address")
+		return c.SendStatus(fiber.StatusOK)
+	}
+
+	user, err := users.NewUser(c.FormValue("user")).Get()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("bad username")
+	}
+	if err = user.ClearLockout(); err != nil {
+		logger.Warn("unlocking user '%s': %s", user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	logger.Info("user '%s' unlocked user '%s'", admin.Username, user.Username)
+	record(c, audit.Unlock, admin.Username, user.Username, "account")
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blgolden/igendec/audit"
+	"github.com/blgolden/igendec/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+// auditPageEvents is the most events shown on the audit page, the export has all of them
+const auditPageEvents = 500
+
+// record adds an event for the request to the audit log
+func record(c *fiber.Ctx, typ audit.Type, user, target, detail string) {
+	audit.Record(audit.Event{Type: typ, User: user, IP: c.IP(), Target: target, Detail: detail})
+}
+
+// AdminAudit renders the most recent events in the audit log
+// The user, type, from and to query parameters filter the events, see auditFilter
+func (h *Handler) AdminAudit(c *fiber.Ctx) error {
+	m := fiber.Map{
+		"Types": audit.Types,
+		"User":  c.Query("user"),
+		"Type":  c.Query("type"),
+		"From":  c.Query("from"),
+		"To":    c.Query("to"),
+	}
+	filter, err := auditFilter(c)
+	if err != nil {
+		m["Error"] = err.Error()
+		return h.RenderPrimary("admin-audit", m, c)
+	}
+
+	// Keep the newest events, in a ring so the whole log isn't held at once
+	var (
+		ring  = make([]audit.Event, auditPageEvents)
+		total int
+	)
+	err = audit.Read(filter, func(ev audit.Event) error {
+		ring[total%auditPageEvents] = ev
+		total++
+		return nil
+	})
+	if err != nil {
+		logger.Warn("reading audit log: %s", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	shown := total
+	if shown > auditPageEvents {
+		shown = auditPageEvents
+	}
+	events := make([]audit.Event, shown)
+	for i := range events {
+		events[i] = ring[(total-1-i)%auditPageEvents]
+	}
+
+	m["Events"] = events
+	m["Total"] = total
+	return h.RenderPrimary("admin-audit", m, c)
+}
+
+// AdminAuditExport returns the events in the audit log as JSON lines, or CSV if format is csv
+// Takes the same filters as AdminAudit
+func (h *Handler) AdminAuditExport(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	filter, err := auditFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	record(c, audit.AuditExport, user.Username, "", c.Context().QueryArgs().String())
+
+	// Stream the events as they are read, an error part way through leaves the download cut short
+	filename := "audit-" + time.Now().Format("20060102-150405")
+	asCSV := c.Query("format") == "csv"
+	if asCSV {
+		c.Set(fiber.HeaderContentType, "text/csv")
+		filename += ".csv"
+	} else {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+		filename += ".jsonl"
+	}
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		var err error
+		if asCSV {
+			cw := csv.NewWriter(w)
+			cw.Write([]string{"Time", "Type", "User", "IP", "Target", "Detail"})
+			err = audit.Read(filter, func(ev audit.Event) error {
+				return cw.Write([]string{ev.Time.Format(time.RFC3339), string(ev.Type), ev.User, ev.IP, ev.Target, ev.Detail})
+			})
+			cw.Flush()
+			if err == nil {
+				err = cw.Error()
+			}
+		} else {
+			enc := json.NewEncoder(w)
+			err = audit.Read(filter, func(ev audit.Event) error { return enc.Encode(ev) })
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			logger.Warn("exporting audit log: %s", err)
+		}
+	})
+	return nil
+}
+
+// auditFilter reads the filter for the audit log from the query
+// from and to are dates, or RFC 3339 times. A date for to includes the whole day
+func auditFilter(c *fiber.Ctx) (audit.Filter, error) {
+	filter := audit.Filter{User: c.Query("user"), Type: audit.Type(c.Query("type"))}
+	var err error
+	if from := c.Query("from"); from != "" {
+		if filter.From, err = parseAuditTime(from, false); err != nil {
+			return filter, fmt.Errorf("bad from time: %w", err)
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if filter.To, err = parseAuditTime(to, true); err != nil {
+			return filter, fmt.Errorf("bad to time: %w", err)
+		}
+	}
+	return filter, nil
+}
+
+func parseAuditTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, errors.New("use a date like 2021-03-01, or a time like 2021-03-01T15:04:05Z")
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/params"
+	"github.com/blgolden/igendec/users"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SweepPaths are offered as suggestions on the batch page
+// Any path understood by params.ApplyPath can be used
+var SweepPaths = []string{
+	"eco.discountRate",
+	"eco.traitSexPricePerCwt[*][4]",
+	"eco.aumCost[*]",
+	"eco.backgroundAumCost[*]",
+	"eco.feedlotFeedCost",
+	"eco.daysOnFeed",
+	"eco.proportionInProgram",
+	"master.planningHorizon",
+	"master.calfAum",
+	"master.cowAum",
+}
+
+// Batches renders the batch page, where sweeps over a jobs parameters are set up
+func (h *Handler) Batches(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	batches := user.ListBatches()
+	var defaultBatch string
+	if len(batches) > 0 {
+		defaultBatch = batches[0]
+	}
+
+	return h.RenderPrimary("jobs-batch", fiber.Map{
+		"Jobs":       user.ListJobs(),
+		"Batches":    batches,
+		"Selected":   c.Query("batch", defaultBatch),
+		"SweepPaths": SweepPaths,
+		"MaxJobs":    users.MaxBatchJobs,
+	}, c)
+}
+
+// BatchesCreate creates a batch from a base job and queues every child job
+// Each path form value is paired with the values form value in the same position,
+// which is a comma separated list of values or start:stop:step ranges.
+// Jobs or a batch of the same names are only replaced if the overwrite form value is true
+func (h *Handler) BatchesCreate(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if !NameRegex.MatchString(name) {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid batch name, can only contain letters, numbers, and special characters '-', '_'")
+	}
+	base := c.FormValue("base")
+	if !NameRegex.MatchString(base) {
+		return c.Status(fiber.StatusBadRequest).SendString("bad job name")
+	}
+	if _, err := user.GetJob(base); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Base job not found")
+	}
+
+	args := c.Context().PostArgs()
+	paths, lists := args.PeekMulti("path"), args.PeekMulti("values")
+	if len(paths) != len(lists) {
+		return c.Status(fiber.StatusBadRequest).SendString("Every parameter needs a list of values")
+	}
+	var sweeps []users.Sweep
+	for i := range paths {
+		path := strings.TrimSpace(string(paths[i]))
+		if path == "" {
+			continue
+		}
+		values, err := params.ExpandValues(string(lists[i]))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Values for %s: %s", path, err))
+		}
+		sweeps = append(sweeps, users.Sweep{Path: path, Values: values})
+	}
+
+	defer user.Lock()()
+	_, jobs, err := user.CreateBatch(name, base, sweeps, c.FormValue("overwrite") == "true")
+	switch {
+	case errors.Is(err, users.ErrBadSweep), errors.Is(err, users.ErrBatchTooLarge):
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	case errors.Is(err, users.ErrBatchJobActive):
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	case errors.Is(err, users.ErrBatchExists):
+		return c.Status(fiber.StatusPreconditionFailed).SendString(err.Error())
+	case errors.Is(err, users.ErrQuotaJobs), errors.Is(err, users.ErrQuotaBytes), errors.Is(err, users.ErrQuotaRuns):
+		return quotaResponse(c, user, err)
+	case err != nil:
+		logger.Warn("creating batch '%s' for user '%s': %s", name, user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	if n, err := users.SubmitJobs(jobs, h.Queue.Submit); err != nil {
+		logger.Warn("queueing batch '%s' for user '%s': %s", name, user.Username, err)
+		return c.Status(fiber.StatusServiceUnavailable).SendString(
+			fmt.Sprintf("Only %d of the %d jobs could be queued, the rest are marked as failed and can be run from the create page later", n, len(jobs)))
+	}
+	return c.Status(fiber.StatusAccepted).SendString(name)
+}
+
+// BatchesInfo returns the html for a batch, with the merged results of its jobs
+func (h *Handler) BatchesInfo(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	batch, err := h.getBatch(user, c.Query("name"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("bad batch name")
+	}
+
+	return c.Render("jobs/batchdetails", fiber.Map{"Batch": batch, "Table": batch.Table()})
+}
+
+// BatchesDownload returns the merged results of a batch as CSV
+func (h *Handler) BatchesDownload(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	name := c.Query("name")
+	batch, err := h.getBatch(user, name)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("bad batch name")
+	}
+
+	buf := &bytes.Buffer{}
+	if err = batch.Table().WriteCSV(buf); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	c.Append(fiber.HeaderContentType, "text/csv")
+	c.Append(fiber.HeaderContentDisposition, `attachment; filename="`+name+`.csv"`)
+	return c.Send(buf.Bytes())
+}
+
+// getBatch checks the name before reading the batch, as it ends up in a file path
+func (h *Handler) getBatch(user *users.User, name string) (*users.Batch, error) {
+	if !NameRegex.MatchString(name) {
+		return nil, errors.New("invalid batch name")
+	}
+	return user.GetBatch(name)
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/blgolden/igendec/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MaxCompareJobs is the most jobs that can be compared at once
+const MaxCompareJobs = 10
+
+// JobsCompare renders the compare page
+// The jobs to compare are given by repeating the job query parameter, the first is compared against
+func (h *Handler) JobsCompare(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	m := fiber.Map{
+		"JobsList": user.ListJobs(),
+		"Max":      MaxCompareJobs,
+		"Measures": []string{"mev", "emphasis", "correlation"},
+	}
+	names, err := compareJobNames(c)
+	if err != nil {
+		m["Error"] = err.Error()
+	} else if len(names) > 0 {
+		m["Selected"] = names
+		if m["Comparison"], err = user.CompareJobs(names); err != nil {
+			logger.Debug("comparing jobs for user '%s': %s", user.Username, err)
+			m["Error"] = "Could not compare the jobs, check they all still exist"
+		}
+	}
+	return h.RenderPrimary("jobs-compare", m, c)
+}
+
+// JobsCompareData returns the comparison of the jobs as JSON
+// Takes the same query parameters as JobsCompare
+func (h *Handler) JobsCompareData(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	names, err := compareJobNames(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	if len(names) == 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("No jobs to compare")
+	}
+
+	cmp, err := user.CompareJobs(names)
+	if err != nil {
+		logger.Debug("comparing jobs for user '%s': %s", user.Username, err)
+		return c.Status(fiber.StatusBadRequest).SendString("Could not compare the jobs, check they all still exist")
+	}
+	return c.JSON(cmp)
+}
+
+// compareJobNames returns the names of the jobs to compare from the query, without repeats
+func compareJobNames(c *fiber.Ctx) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, arg := range c.Context().QueryArgs().PeekMulti("job") {
+		name := string(arg)
+		if !NameRegex.MatchString(name) {
+			return nil, fmt.Errorf("Invalid job name '%s'", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) > MaxCompareJobs {
+		return nil, fmt.Errorf("Only %d jobs can be compared at once", MaxCompareJobs)
+	}
+	return names, nil
+}
@@ -0,0 +1,266 @@
+package controllers
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blgolden/igendec/audit"
+	"github.com/blgolden/igendec/epds"
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/users"
+	"github.com/gofiber/fiber/v2"
+)
+
+// adminJobsShown is the most recent jobs the server wide jobs page shows
+const adminJobsShown = 100
+
+// Admin renders the administration console, with the entries of the user blacklist
+func (h *Handler) Admin(c *fiber.Ctx) error {
+	all, err := users.FindUsers("")
+	if err != nil {
+		logger.Warn("listing users: %s", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	var admins, disabled int
+	for _, user := range all {
+		if user.IsAdmin() {
+			admins++
+		}
+		if user.Disabled {
+			disabled++
+		}
+	}
+	return h.RenderPrimary("admin", fiber.Map{
+		"Users":     len(all),
+		"Admins":    admins,
+		"Disabled":  disabled,
+		"Activity":  h.Queue.Activity(),
+		"Blacklist": h.UserBlacklist.Entries(),
+		"Now":       time.Now(),
+	}, c)
+}
+
+// AdminUsers renders the users, those matching the q query parameter if it is set
+func (h *Handler) AdminUsers(c *fiber.Ctx) error {
+	found, err := users.FindUsers(c.Query("q"))
+	if err != nil {
+		logger.Warn("listing users: %s", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	return h.RenderPrimary("admin-users", fiber.Map{"Query": c.Query("q"), "Found": found}, c)
+}
+
+// AdminUser renders a user for administrators to change, and their jobs
+func (h *Handler) AdminUser(c *fiber.Ctx) error {
+	admin, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	user, err := users.NewUser(c.Query("user")).Get()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("bad username")
+	}
+
+	m := fiber.Map{
+		"User":      user,
+		"Self":      user.Username == admin.Username,
+		"Role":      user.GetRole(),
+		"Roles":     users.Roles,
+		"Access":    user.Access.Text(),
+		"Databases": epds.ListDatabases(user.Access),
+		"Quota":     user.GetQuota(),
+	}
+	if m["Usage"], err = user.Usage(); err != nil {
+		logger.Warn("measuring usage of user '%s': %s", user.Username, err)
+		delete(m, "Usage")
+	}
+	if m["Jobs"], err = user.GetAllJobs(); err != nil {
+		logger.Warn("listing jobs of user '%s': %s", user.Username, err)
+		delete(m, "Jobs")
+	}
+	return h.RenderPrimary("admin-user", m, c)
+}
+
+// AdminJob renders a job of the user query parameter, named by the name query parameter,
+// for administrators to look into
+func (h *Handler) AdminJob(c *fiber.Ctx) error {
+	job, err := adminGetJob(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	m := fiber.Map{"Job": job}
+	if log, err := job.RunLog(); err == nil {
+		m["Log"] = string(log)
+	}
+	return h.RenderPrimary("admin-job", m, c)
+}
+
+// AdminJobLog returns the run log of a job of another user as plain text, as JobsLog
+func (h *Handler) AdminJobLog(c *fiber.Ctx) error {
+	job, err := adminGetJob(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	data, err := job.RunLog()
+	if errors.Is(err, os.ErrNotExist) {
+		return c.Status(fiber.StatusNotFound).SendString("This job has not been run yet")
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.Send(data)
+}
+
+// AdminJobDownload returns the files of a job of another user as a zip, as JobsDownload
+func (h *Handler) AdminJobDownload(c *fiber.Ctx) error {
+	admin, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	job, err := adminGetJob(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	zippedData, err := job.Zip()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	record(c, audit.JobDownload, admin.Username, job.Username(), job.Name)
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+job.Username()+"-"+job.Name+`.zip"`)
+	return c.Send(zippedData)
+}
+
+// adminGetJob returns the job named by the name query parameter of the user query parameter
+func adminGetJob(c *fiber.Ctx) (*users.Job, error) {
+	name := c.Query("name")
+	if !NameRegex.MatchString(name) {
+		return nil, errors.New("bad job name")
+	}
+	user, err := users.NewUser(c.Query("user")).Get()
+	if err != nil {
+		return nil, errors.New("bad username")
+	}
+	job, err := user.GetJob(name)
+	if err != nil {
+		return nil, errors.New("bad job name")
+	}
+	return job, nil
+}
+
+// AdminUserRole changes the role of the user form value to the role form value
+// Administrators can't change their own role, so there is always one left
+func (h *Handler) AdminUserRole(c *fiber.Ctx) error {
+	admin, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	role, err := users.ParseRole(c.FormValue("role"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	user := users.NewUser(c.FormValue("user"))
+	if user.Username == admin.Username {
+		return c.Status(fiber.StatusBadRequest).SendString("You can't change your own role")
+	}
+	if err = user.SetRole(role); err != nil {
+		return adminUserResponse(c, user, err)
+	}
+	logger.Info("user '%s' made user '%s' %s", admin.Username, user.Username, role)
+	record(c, audit.RoleChange, admin.Username, user.Username, string(role))
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// AdminUserAccess replaces the Access of the user form value with the access form value,
+// one path a line with denied paths starting with '!'
+func (h *Handler) AdminUserAccess(c *fiber.Ctx) error {
+	admin, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	access, err := users.ParseAccess(c.FormValue("access"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	user := users.NewUser(c.FormValue("user"))
+	if err = user.SetAccess(access); err != nil {
+		return adminUserResponse(c, user, err)
+	}
+	logger.Info("user '%s' set the access of user '%s' to %v", admin.Username, user.Username, access)
+	record(c, audit.AccessChange, admin.Username, user.Username, strings.ReplaceAll(access.Text(), "\n", " "))
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// AdminUserDisable disables the user form value, or enables them if the disabled form value is false
+// Disabling a user signs them out
+func (h *Handler) AdminUserDisable(c *fiber.Ctx) error {
+	admin, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	disabled := c.FormValue("disabled") != "false"
+	user := users.NewUser(c.FormValue("user"))
+	if disabled && user.Username == admin.Username {
+		return c.Status(fiber.StatusBadRequest).SendString("You can't disable your own account")
+	}
+	if err = user.SetDisabled(disabled); err != nil {
+		return adminUserResponse(c, user, err)
+	}
+	typ, done := audit.AccountEnable, "enabled"
+	if disabled {
+		typ, done = audit.AccountDisable, "disabled"
+	}
+	logger.Info("user '%s' %s user '%s'", admin.Username, done, user.Username)
+	record(c, typ, admin.Username, user.Username, "")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// adminUserResponse responds to a change to a user that couldn't be made
+func adminUserResponse(c *fiber.Ctx, user *users.User, err error) error {
+	if errors.Is(err, users.ErrUserDoesntExist) {
+		return c.Status(fiber.StatusBadRequest).SendString("bad username")
+	}
+	logger.Warn("updating user '%s': %s", user.Username, err)
+	return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+}
+
+// AdminJobs renders the jobs running and waiting on the queue, and the most recent jobs of every user
+func (h *Handler) AdminJobs(c *fiber.Ctx) error {
+	all, err := users.FindUsers("")
+	if err != nil {
+		logger.Warn("listing users: %s", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	var jobs []*users.Job
+	for _, user := range all {
+		userJobs, err := user.GetAllJobs()
+		if err != nil {
+			logger.Warn("listing jobs of user '%s': %s", user.Username, err)
+			continue
+		}
+		jobs = append(jobs, userJobs...)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return lastActive(jobs[i]).After(lastActive(jobs[j])) })
+	if len(jobs) > adminJobsShown {
+		jobs = jobs[:adminJobsShown]
+	}
+	return h.RenderPrimary("admin-jobs", fiber.Map{"Activity": h.Queue.Activity(), "Jobs": jobs}, c)
+}
+
+// lastActive returns when the job was last queued, started or finished
+func lastActive(job *users.Job) time.Time {
+	t := job.State.Queued
+	for _, at := range []time.Time{job.State.Started, job.State.Finished} {
+		if at.After(t) {
+			t = at
+		}
+	}
+	return t
+}
@@ -1,11 +1,15 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/blgolden/igendec/audit"
 	"github.com/blgolden/igendec/epds"
 	"github.com/blgolden/igendec/params"
+	"github.com/blgolden/igendec/queue"
+	"github.com/blgolden/igendec/users"
 
 	"github.com/blgolden/igendec/logger"
 
@@ -77,14 +81,10 @@ func (h *Handler) CreateBuild(c *fiber.Ctx) error {
 		ecoParams.IndexTerminal = indextype == params.Terminal
 	}
 
-	// If a target database has been given, set the IndexComponents defaults to be the available keys
-	// in the selected database
-	if db, err := epds.NewDatabase(c.Query("target-database")); err == nil {
-		ecoParams.IndexComponents = db.TraitKeys(ecoParams.IndexComponents)
-		masterParams.TargetDatabase = db.Root
-	}
+	applyTargetDatabase(masterParams, ecoParams, c.Query("target-database"))
 
-	// Set these to the users values
+	// Set these to the users values, locked so a concurrent update can't save half of them
+	defer user.Lock()()
 	if err = user.SaveEcoParams(ecoParams); err != nil {
 		return fmt.Errorf("saving eco params: %w", err)
 	}
@@ -100,16 +100,22 @@ func (h *Handler) CreateBuild(c *fiber.Ctx) error {
 
 	// Need to change PlanningHorizon if the indextype is terminal
 	if indextype == params.Terminal {
-		if endpoint == params.Weaning {
-			m["PlanningHorizon"] = 1
-		} else {
-			m["PlanningHorizon"] = 2
-		}
+		m["PlanningHorizon"] = params.TerminalPlanningHorizon(endpoint)
 	}
 
 	return h.RenderPrimary("create-build", m, c)
 }
 
+// applyTargetDatabase sets the parameters up for running against the given database
+// If a target database has been given, set the IndexComponents defaults to be the available keys
+// in the selected database
+func applyTargetDatabase(mp *params.MasterParams, ep *params.EcoParams, database string) {
+	if db, err := epds.NewDatabase(database); err == nil {
+		ep.IndexComponents = db.TraitKeys(ep.IndexComponents)
+		mp.TargetDatabase = db.Root
+	}
+}
+
 // CreateUpdate updates a users parameters files via POST
 // The form key should match a value
 func (h *Handler) CreateUpdate(c *fiber.Ctx) error {
@@ -118,6 +124,9 @@ func (h *Handler) CreateUpdate(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
 	}
 
+	// Hold the lock until the parameters are saved so concurrent updates don't undo each other
+	defer user.Lock()()
+
 	// Get parameters for this user
 	ip, err := user.GetIndexParams()
 	if err != nil {
@@ -147,7 +156,7 @@ func (h *Handler) CreateUpdate(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusOK)
 }
 
-// CreateSubmit runs a job through iGenDecModel
+// CreateSubmit creates a job and queues it to run through iGenDecModel
 func (h *Handler) CreateSubmit(c *fiber.Ctx) error {
 	user, err := h.Session.User(c)
 	if err != nil {
@@ -171,18 +180,31 @@ func (h *Handler) CreateSubmit(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid job name, can only contain letters, numbers, and special characters '-', '_'")
 	}
 
+	defer user.Lock()()
+
+	// Don't overwrite the parameters of a job that is about to be run
+	existing, err := user.GetJob(jobname)
+	if err == nil && existing.InProgress() {
+		return c.Status(fiber.StatusConflict).SendString("A job with this name is already queued or running")
+	}
+
+	newJobs := 1
+	if existing != nil {
+		newJobs = 0
+	}
+	if err = user.CheckQuota(newJobs, 1); err != nil {
+		return quotaResponse(c, user, err)
+	}
+
 	job, err := user.CreateJob(jobname, ip, ep)
 	if err != nil {
 		logger.Debug("%s", err)
 		return ErrInternalServer
 	}
-	if err = job.Run(epds.DatabasePath); err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to run job. Please contact support")
-	}
-	return c.SendStatus(fiber.StatusOK)
+	return h.submitJob(c, job)
 }
 
-// CreateRun will run a given job
+// CreateRun will queue a given job to run again
 func (h *Handler) CreateRun(c *fiber.Ctx) error {
 	user, err := h.Session.User(c)
 	if err != nil {
@@ -191,14 +213,53 @@ func (h *Handler) CreateRun(c *fiber.Ctx) error {
 	}
 
 	jobname := c.FormValue("job")
+	if !NameRegex.MatchString(jobname) {
+		return c.Status(fiber.StatusBadRequest).SendString("bad job name")
+	}
 
+	// Read the job under the lock, so two requests can't both see it as not running
+	defer user.Lock()()
 	job, err := user.GetJob(jobname)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
 	}
 
-	if err = job.Run(epds.DatabasePath); err != nil {
+	if job.InProgress() {
+		return c.Status(fiber.StatusConflict).SendString("Job is already queued or running")
+	}
+
+	if err = user.CheckQuota(0, 1); err != nil {
+		return quotaResponse(c, user, err)
+	}
+
+	return h.submitJob(c, job)
+}
+
+// quotaResponse responds to a request the users quota doesn't allow
+// Running too many jobs at once is only for now, the other quotas need the user to make room
+func quotaResponse(c *fiber.Ctx, user *users.User, err error) error {
+	switch {
+	case errors.Is(err, users.ErrQuotaRuns):
+		return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+	case errors.Is(err, users.ErrQuotaJobs), errors.Is(err, users.ErrQuotaBytes), errors.Is(err, users.ErrUnverified):
+		return c.Status(fiber.StatusForbidden).SendString(err.Error())
+	}
+	logger.Warn("checking quota of user '%s': %s", user.Username, err)
+	return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+}
+
+// submitJob puts the job on the queue and responds with the jobs name so the client can follow it
+func (h *Handler) submitJob(c *fiber.Ctx, job *users.Job) error {
+	if err := h.Queue.Submit(job); err != nil {
+		logger.Warn("queueing job '%s' for user '%s': %s", job.Name, job.Username(), err)
+		switch {
+		case errors.Is(err, queue.ErrQueueFull):
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Too many jobs are waiting to run, please try again later")
+		case errors.Is(err, queue.ErrJobActive):
+			return c.Status(fiber.StatusConflict).SendString("Job is already queued or running")
+		}
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to run job. Please contact support")
 	}
-	return c.SendStatus(fiber.StatusOK)
+	record(c, audit.JobSubmit, job.Username(), job.Name, "")
+	return c.Status(fiber.StatusAccepted).SendString(job.Name)
 }
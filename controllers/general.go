@@ -2,12 +2,18 @@ package controllers
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
+	"time"
 
+	"github.com/blgolden/igendec/audit"
+	"github.com/blgolden/igendec/blacklist"
 	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/mail"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/blgolden/igendec/controllers/session"
+	"github.com/blgolden/igendec/queue"
 	"github.com/blgolden/igendec/users"
 )
 
@@ -23,15 +29,21 @@ var NameRegex = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
 // Handler has the endpoint methods on it to allow
 // better management of dependencies without global state
 type Handler struct {
-	UserBlacklist map[string]struct{}
+	UserBlacklist *blacklist.List
 	Session       *session.Sess
+	Queue         *queue.Queue
+	Addresses     *Throttle
+	Mailer        mail.Mailer
+	BaseURL       string // where users reach the server, for links in mail
 }
 
 // NewHandler returns a new handler object
 func NewHandler() *Handler {
 	return &Handler{
-		UserBlacklist: make(map[string]struct{}),
+		UserBlacklist: blacklist.New(""),
 		Session:       session.New(),
+		Addresses:     NewThrottle(0),
+		Mailer:        &mail.FileMailer{},
 	}
 }
 
@@ -47,6 +59,10 @@ func (h *Handler) RenderPrimary(htmlFile string, m fiber.Map, c *fiber.Ctx) erro
 		m = make(map[string]interface{})
 	}
 	m["Authorised"] = h.Session.Exists(c)
+	if user, err := h.Session.User(c); err == nil {
+		m["Admin"] = user.IsAdmin()
+	}
+	m["CSRFToken"] = h.Session.CSRFToken(c)
 
 	return c.Status(fiber.StatusOK).Render(htmlFile, m, "layout/primary")
 }
@@ -55,34 +71,129 @@ func (h *Handler) RenderPrimary(htmlFile string, m fiber.Map, c *fiber.Ctx) erro
 func (h *Handler) SignIn(c *fiber.Ctx) error {
 	switch c.Method() {
 	case fiber.MethodPost:
-		user, err := users.NewUser(c.FormValue("username")).Get()
+		now := time.Now()
+		username := c.FormValue("username")
+
+		// Lock out addresses that keep failing, whichever accounts they try
+		if err := h.Addresses.Check(c.IP(), now); err != nil {
+			record(c, audit.SignInFailed, username, "", "address "+err.Error())
+			return c.Status(fiber.StatusTooManyRequests).SendString("Sign in refused: " + err.Error())
+		}
+
+		user, err := users.NewUser(username).Get()
 
 		// Username doesn't exist
 		if err != nil {
+			h.signInFailed(c, nil, username, "unknown user", now)
 			return c.Status(fiber.StatusUnauthorized).SendString("Username or password incorrect")
 		}
 
+		// Slow down attempts on the account, the password isn't checked until they are allowed
+		if err = user.CheckSignIn(now); err != nil {
+			record(c, audit.SignInFailed, user.Username, "", "account "+err.Error())
+			return c.Status(fiber.StatusTooManyRequests).SendString("Sign in refused: " + err.Error())
+		}
+
 		// Password doesn't match
 		if err = user.ComparePassword(c.FormValue("password")); err != nil {
+			h.signInFailed(c, user, user.Username, "wrong password", now)
 			return c.Status(fiber.StatusUnauthorized).SendString("Username or password incorrect")
 		}
 
 		// Check if they are on the blacklist
-		if _, ok := h.UserBlacklist[user.Username]; ok {
+		if entry, ok := h.UserBlacklist.Check(user.Username, now); ok {
+			record(c, audit.SignInFailed, user.Username, "", blacklistedDetail(entry))
 			return c.Status(fiber.StatusUnauthorized).SendString("Not authenticated")
 		}
 
-		// Create h.Session for user
-		h.Session.New(c, user)
+		if user.Disabled {
+			record(c, audit.SignInFailed, user.Username, "", "disabled")
+			return c.Status(fiber.StatusUnauthorized).SendString("Sign in refused: " + users.ErrAccountDisabled.Error())
+		}
+
+		// Users with two-factor authentication give a code before they are signed in
+		if user.TwoFactorEnabled() {
+			if err = h.Session.StartTwoFactor(c, user, now); err != nil {
+				logger.Warn("saving session for user '%s': %s", user.Username, err)
+				return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+			}
+			return c.Status(fiber.StatusAccepted).SendString("Enter the code from your authenticator app")
+		}
 
-		// Go to home page
-		return h.Home(c)
+		return h.signedIn(c, user, "")
 
 	default:
 		return h.RenderPrimary("signin", nil, c)
 	}
 }
 
+// SignInTwoFactor takes the code from the authenticator app, or a recovery code, of a user who has
+// given their password to SignIn, and signs them in
+func (h *Handler) SignInTwoFactor(c *fiber.Ctx) error {
+	now := time.Now()
+	user, err := h.Session.TwoFactorUser(c, now)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString("Your sign in has timed out, please sign in again")
+	}
+
+	// Codes are throttled the same as passwords
+	if err = h.Addresses.Check(c.IP(), now); err != nil {
+		record(c, audit.SignInFailed, user.Username, "", "address "+err.Error())
+		return c.Status(fiber.StatusTooManyRequests).SendString("Sign in refused: " + err.Error())
+	}
+	if err = user.CheckSignIn(now); err != nil {
+		record(c, audit.SignInFailed, user.Username, "", "account "+err.Error())
+		return c.Status(fiber.StatusTooManyRequests).SendString("Sign in refused: " + err.Error())
+	}
+
+	recovery, err := user.CheckTwoFactor(c.FormValue("code"), now)
+	if errors.Is(err, users.ErrTwoFactorInvalid) {
+		h.signInFailed(c, user, user.Username, "wrong two-factor code", now)
+		return c.Status(fiber.StatusUnauthorized).SendString("Code incorrect")
+	} else if err != nil {
+		logger.Warn("checking two-factor code of user '%s': %s", user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	if recovery {
+		return h.signedIn(c, user, fmt.Sprintf("recovery code, %d left", len(user.TwoFactor.RecoveryCodes)))
+	}
+	return h.signedIn(c, user, "")
+}
+
+// signedIn starts a session for a user who has given everything asked of them
+func (h *Handler) signedIn(c *fiber.Ctx, user *users.User, detail string) error {
+	// A good sign in forgets the failed ones
+	if err := user.ClearLockout(); err != nil {
+		logger.Warn("clearing failed sign ins of user '%s': %s", user.Username, err)
+	}
+
+	// Create h.Session for user
+	h.Session.New(c, user)
+	record(c, audit.SignIn, user.Username, "", detail)
+
+	// Go to home page
+	return h.Home(c)
+}
+
+// signInFailed records a failed sign in against the address, and the account if there is one
+func (h *Handler) signInFailed(c *fiber.Ctx, user *users.User, username, reason string, now time.Time) {
+	if h.Addresses.Fail(c.IP(), now) {
+		logger.Warn("locked out address %s after too many failed sign ins", c.IP())
+		reason += ", address locked out"
+	}
+	if user != nil {
+		locked, err := user.FailedSignIn(now)
+		if err != nil {
+			logger.Warn("recording failed sign in of user '%s': %s", user.Username, err)
+		} else if locked {
+			logger.Warn("locked user '%s' after too many failed sign ins", user.Username)
+			reason += ", account locked"
+		}
+	}
+	record(c, audit.SignInFailed, username, "", reason)
+}
+
 // SignOut ends a h.Session for a user and redirects to home page
 func (h *Handler) SignOut(c *fiber.Ctx) error {
 	h.Session.Kill(c)
@@ -116,12 +227,28 @@ func (h *Handler) Register(c *fiber.Ctx) error {
 		user.Email = c.FormValue("email")
 		user.Location = c.FormValue("location")
 
+		// Hold the account unverified until the link mailed to the address is used
+		token, err := user.StartVerification(time.Now())
+		if errors.Is(err, users.ErrBadEmail) {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		} else if err != nil {
+			logger.Warn("starting email verification of user '%s': %s", user.Username, err)
+			return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+		}
+
 		// Save to server
 		if err := user.Save(); err != nil {
 			logger.Warn("Failed to save user with error:%s", err)
 			return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
 		}
 
+		record(c, audit.Register, user.Username, "", "")
+
+		// They can send another link from their profile if this fails
+		if err = h.sendVerification(user, token); err != nil {
+			logger.Warn("mailing email verification to user '%s': %s", user.Username, err)
+		}
+
 		// Create h.Session
 		h.Session.New(c, user)
 		return c.SendStatus(fiber.StatusOK)
@@ -1,10 +1,20 @@
 package controllers
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
+	"github.com/blgolden/igendec/audit"
 	"github.com/blgolden/igendec/epds"
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/queue"
+	"github.com/blgolden/igendec/users"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -42,6 +52,62 @@ func (h *Handler) JobsInfo(c *fiber.Ctx) error {
 	return err
 }
 
+// JobsEvents streams the status of the users jobs as Server-Sent Events
+// The current status of every job is sent first, followed by each change as it happens
+func (h *Handler) JobsEvents(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	events, unsubscribe := h.Queue.Subscribe(user.Username)
+
+	jobs, err := user.GetAllJobs()
+	if err != nil {
+		unsubscribe()
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		for _, job := range jobs {
+			writeEvent(w, queue.Event{Job: job.Name, Status: job.Status})
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		// Comments keep the connection open through proxies, and let us notice the client has gone
+		keepalive := time.NewTicker(eventsKeepalive)
+		defer keepalive.Stop()
+		for {
+			select {
+			case ev := <-events:
+				writeEvent(w, ev)
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// eventsKeepalive is how often a comment is sent down an idle event stream
+const eventsKeepalive = 15 * time.Second
+
+func writeEvent(w *bufio.Writer, ev queue.Event) {
+	data, _ := json.Marshal(ev)
+	fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+}
+
 // JobsDownload will return the zip compressed files for a job
 func (h *Handler) JobsDownload(c *fiber.Ctx) error {
 	user, err := h.Session.User(c)
@@ -64,12 +130,42 @@ func (h *Handler) JobsDownload(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
 	}
 
+	record(c, audit.JobDownload, user.Username, jobName, "")
 	c.Append(fiber.HeaderContentType, "application/zip")
 	c.Append(fiber.HeaderContentDisposition, `attachment; filename="`+jobName+`.zip"`)
 	return c.Send(zippedData)
 }
 
-// JobsDelete will delete the given job
+// JobsLog returns the run log from the last time a job was run as plain text
+// Administrators read the logs of other users jobs from AdminJobLog
+func (h *Handler) JobsLog(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	var jobName = c.Query("id")
+	if !NameRegex.MatchString(jobName) {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid job name")
+	}
+
+	job, err := user.GetJob(jobName)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("bad job name")
+	}
+
+	data, err := job.RunLog()
+	if errors.Is(err, os.ErrNotExist) {
+		return c.Status(fiber.StatusNotFound).SendString("This job has not been run yet")
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.Send(data)
+}
+
+// JobsDelete will move the given job to the trash
 func (h *Handler) JobsDelete(c *fiber.Ctx) error {
 	user, err := h.Session.User(c)
 	if err != nil {
@@ -82,11 +178,99 @@ func (h *Handler) JobsDelete(c *fiber.Ctx) error {
 	}
 
 	if err := user.DeleteJob(jobName); err != nil {
+		if errors.Is(err, users.ErrJobInFlight) {
+			return c.Status(fiber.StatusConflict).SendString("Cancel the job before deleting it")
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			return c.Status(fiber.StatusBadRequest).SendString("bad job name")
+		}
+		logger.Warn("deleting job '%s' for user '%s': %s", jobName, user.Username, err)
 		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
 	}
+	record(c, audit.JobDelete, user.Username, jobName, "")
 	return nil
 }
 
+// JobsTrash renders the page of the users deleted jobs
+func (h *Handler) JobsTrash(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	trash, err := user.ListTrash()
+	if err != nil {
+		logger.Warn("listing trash of user '%s': %s", user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	return h.RenderPrimary("jobs-trash", fiber.Map{"Trash": trash}, c)
+}
+
+// JobsTrashRestore moves a job out of the trash
+func (h *Handler) JobsTrashRestore(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	trashed, err := user.RestoreJob(c.Query("id"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c.Status(fiber.StatusBadRequest).SendString("bad job id")
+		}
+		if errors.Is(err, users.ErrJobExists) {
+			return c.Status(fiber.StatusConflict).SendString("There is already a job with this name, rename or delete it first")
+		}
+		logger.Warn("restoring job '%s' for user '%s': %s", c.Query("id"), user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	record(c, audit.JobRestore, user.Username, trashed.Job, trashed.ID)
+	return c.SendString(trashed.Job)
+}
+
+// JobsTrashPurge removes a job from the trash for good
+func (h *Handler) JobsTrashPurge(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	if err = user.PurgeJob(c.Query("id")); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c.Status(fiber.StatusBadRequest).SendString("bad job id")
+		}
+		logger.Warn("purging job '%s' for user '%s': %s", c.Query("id"), user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	record(c, audit.JobPurge, user.Username, c.Query("id"), "")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// JobsCancel stops the given job if it is waiting to run or running
+func (h *Handler) JobsCancel(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	name := c.Query("id")
+	if !NameRegex.MatchString(name) {
+		return c.Status(fiber.StatusBadRequest).SendString("bad job name")
+	}
+	job, err := user.GetJob(name)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("bad job name")
+	}
+
+	if err = h.Queue.Cancel(job); err != nil {
+		if errors.Is(err, queue.ErrNotRunning) {
+			return c.Status(fiber.StatusConflict).SendString("Job is not queued or running")
+		}
+		logger.Warn("cancelling job '%s' for user '%s': %s", job.Name, user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
 // JobsSelect renders the page showing the databases - allowing a user to compare
 func (h *Handler) JobsSelect(c *fiber.Ctx) error {
 	if c.Query("job") == "" {
@@ -169,6 +353,7 @@ func (h *Handler) JobsSelectDatabaseCompare(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
 	}
 
+	record(c, audit.CompareDownload, user.Username, job.Name, fmt.Sprintf("database %s, %d fields", c.FormValue("name"), len(values)))
 	c.Append(fiber.HeaderContentType, "application/text")
 	c.Append(fiber.HeaderContentDisposition, `attachment; filename="compare.csv"`)
 
@@ -1,16 +1,97 @@
 package controllers
 
 import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/blgolden/igendec/audit"
+	"github.com/blgolden/igendec/blacklist"
+	"github.com/blgolden/igendec/users"
 	"github.com/gofiber/fiber/v2"
 )
 
+// CSRFHeader is the header ajax requests carry the CSRF token in, forms use the _csrf field
+const CSRFHeader = "X-CSRF-Token"
+
 // Authorise Middleware:
 // Authorises a user before going to any page
 // Otherwise, renders the sign in page
+// Users who must set up two-factor authentication can only do that until they have
+// Sessions of blacklisted users are ended
 func (h *Handler) Authorise(c *fiber.Ctx) error {
-	if !isExceptionRoute(c.Path()) && !h.Session.Exists(c) {
+	if username := h.Session.Username(c); username != "" {
+		if entry, ok := h.UserBlacklist.Check(username, time.Now()); ok {
+			h.Session.Kill(c)
+			record(c, audit.SessionRevoke, username, "", blacklistedDetail(entry))
+		}
+	}
+	if isExceptionRoute(c.Path()) {
+		return c.Next()
+	}
+	if !h.Session.Exists(c) {
 		return c.Redirect("/signin")
 	}
+	if isTwoFactorSetupRoute(c.Path()) {
+		return c.Next()
+	}
+
+	// Checked every request, as Access and the required paths can change while signed in
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	if user.NeedsTwoFactor() && !user.TwoFactorEnabled() {
+		if c.Method() == fiber.MethodGet {
+			return c.Redirect("/profile")
+		}
+		return c.Status(fiber.StatusForbidden).SendString(users.ErrTwoFactorRequired.Error() + ", set it up on your profile")
+	}
+	return c.Next()
+}
+
+// blacklistedDetail describes a blacklist entry for the audit log
+func blacklistedDetail(entry blacklist.Entry) string {
+	detail := "blacklisted"
+	if entry.Reason != "" {
+		detail += ": " + entry.Reason
+	}
+	return detail
+}
+
+// AdminOnly Middleware:
+// Refuses requests from users who aren't server administrators
+func (h *Handler) AdminOnly(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	if !user.IsAdmin() {
+		return c.Status(fiber.StatusForbidden).SendString("Not authorised")
+	}
+	return c.Next()
+}
+
+// CheckCSRF Middleware:
+// Refuses requests that could change something unless they carry the sessions CSRF token,
+// from RenderPrimary, so other sites can't make them with the users cookie
+// Requests without a session have been refused by Authorise unless they are to an exception route
+func (h *Handler) CheckCSRF(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	}
+	if !h.Session.Exists(c) {
+		return c.Next()
+	}
+
+	token := c.Get(CSRFHeader)
+	if token == "" {
+		token = c.FormValue("_csrf")
+	}
+	expected := h.Session.CSRFToken(c)
+	if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return c.Status(fiber.StatusForbidden).SendString("Your session has changed, reload the page and try again")
+	}
 	return c.Next()
 }
 
@@ -18,5 +99,17 @@ func (h *Handler) Authorise(c *fiber.Ctx) error {
 func isExceptionRoute(route string) bool {
 	return route == "/signin" ||
 		route == "/" ||
-		route == "/register"
+		route == "/register" ||
+		route == "/forgot" ||
+		route == "/reset" ||
+		route == "/verify" ||
+		route == "/signin/2fa"
+}
+
+// isTwoFactorSetupRoute is true if this route is needed to set up two-factor authentication
+func isTwoFactorSetupRoute(route string) bool {
+	return route == "/profile" ||
+		route == "/profile/2fa/setup" ||
+		route == "/profile/2fa/enable" ||
+		route == "/signout"
 }
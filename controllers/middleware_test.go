@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blgolden/igendec/blacklist"
+	"github.com/blgolden/igendec/users"
+	"github.com/gofiber/fiber/v2"
+)
+
+// newTestHandler returns a handler on an empty database with the user bob in it,
+// and an app where GET /test/signin signs bob in and responds with the sessions CSRF token
+func newTestHandler(t *testing.T) (*Handler, *fiber.App) {
+	t.Helper()
+	path, typ := users.UsersPath, users.DatabaseType
+	users.UsersPath, users.DatabaseType = t.TempDir(), users.DatabaseLocal
+	users.Init()
+	t.Cleanup(func() {
+		users.Close()
+		users.UsersPath, users.DatabaseType = path, typ
+	})
+
+	bob := users.NewUser("bob")
+	if err := bob.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler()
+	app := fiber.New()
+	app.Get("/test/signin", func(c *fiber.Ctx) error {
+		h.Session.New(c, bob)
+		return c.SendString(h.Session.CSRFToken(c))
+	})
+	return h, app
+}
+
+// signIn signs bob in to app, and returns the session cookie and CSRF token
+func signIn(t *testing.T, app *fiber.App) (*http.Cookie, string) {
+	t.Helper()
+	resp := testRequest(t, app, httptest.NewRequest(fiber.MethodGet, "/test/signin", nil))
+	token, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "session_id" {
+			return cookie, string(token)
+		}
+	}
+	t.Fatal("signing in didn't set a session cookie")
+	return nil, ""
+}
+
+// testRequest runs req through app
+func testRequest(t *testing.T, app *fiber.App, req *http.Request) *http.Response {
+	t.Helper()
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestCheckCSRF(t *testing.T) {
+	h, app := newTestHandler(t)
+	app.All("/change", h.CheckCSRF, func(c *fiber.Ctx) error {
+		return c.SendString("changed")
+	})
+	cookie, token := signIn(t, app)
+	if token == "" {
+		t.Fatal("signed in session has no CSRF token")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		session bool
+		header  string
+		form    string
+		want    int
+	}{
+		{"no token", fiber.MethodPost, true, "", "", fiber.StatusForbidden},
+		{"wrong header", fiber.MethodPost, true, strings.Repeat("0", len(token)), "", fiber.StatusForbidden},
+		{"wrong form field", fiber.MethodPost, true, "", strings.Repeat("0", len(token)), fiber.StatusForbidden},
+		{"header", fiber.MethodPost, true, token, "", fiber.StatusOK},
+		{"form field", fiber.MethodPost, true, "", token, fiber.StatusOK},
+		{"header wins over the form field", fiber.MethodPost, true, "wrong", token, fiber.StatusForbidden},
+		{"delete", fiber.MethodDelete, true, "", "", fiber.StatusForbidden},
+		{"get", fiber.MethodGet, true, "", "", fiber.StatusOK},
+		{"head", fiber.MethodHead, true, "", "", fiber.StatusOK},
+		{"no session", fiber.MethodPost, false, "", "", fiber.StatusOK},
+	} {
+		var body io.Reader
+		if tc.form != "" {
+			body = strings.NewReader(url.Values{"_csrf": {tc.form}}.Encode())
+		}
+		req := httptest.NewRequest(tc.method, "/change", body)
+		if tc.form != "" {
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		}
+		if tc.header != "" {
+			req.Header.Set(CSRFHeader, tc.header)
+		}
+		if tc.session {
+			req.AddCookie(cookie)
+		}
+		if resp := testRequest(t, app, req); resp.StatusCode != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestAuthoriseEndsBlacklistedSessions(t *testing.T) {
+	h, app := newTestHandler(t)
+	name := filepath.Join(t.TempDir(), "blacklist.txt")
+	h.UserBlacklist = blacklist.New(name)
+	app.Get("/page", h.Authorise, func(c *fiber.Ctx) error {
+		return c.SendString("page")
+	})
+	cookie, _ := signIn(t, app)
+
+	get := func() *http.Response {
+		req := httptest.NewRequest(fiber.MethodGet, "/page", nil)
+		req.AddCookie(cookie)
+		return testRequest(t, app, req)
+	}
+	if resp := get(); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("before blacklisting: got status %d, want 200", resp.StatusCode)
+	}
+
+	if err := os.WriteFile(name, []byte("bob || testing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.UserBlacklist.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := get(); resp.StatusCode != fiber.StatusFound || resp.Header.Get(fiber.HeaderLocation) != "/signin" {
+		t.Errorf("after blacklisting: got status %d to %q, want a redirect to /signin", resp.StatusCode, resp.Header.Get(fiber.HeaderLocation))
+	}
+	if sessions, err := users.NewUser("bob").ListSessions(); err != nil || len(sessions) != 0 {
+		t.Errorf("got %d sessions, %v, want the session ended", len(sessions), err)
+	}
+
+	// The session stays ended when the user is taken off the blacklist
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.UserBlacklist.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := get(); resp.StatusCode != fiber.StatusFound {
+		t.Errorf("after removing from the blacklist: got status %d, want a redirect", resp.StatusCode)
+	}
+}
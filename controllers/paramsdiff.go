@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/params"
+	"github.com/blgolden/igendec/users"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// JobsDiff returns the html for the changes a job makes to the default parameters
+func (h *Handler) JobsDiff(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	changes, err := jobDiff(user, c.Query("id"))
+	if err != nil {
+		logger.Debug("diffing job '%s' for user '%s': %s", c.Query("id"), user.Username, err)
+		return c.Status(fiber.StatusBadRequest).SendString("Could not compare the job with the defaults")
+	}
+	return c.Render("jobs/paramsdiff", fiber.Map{"Changes": changes, "Name": c.Query("id")})
+}
+
+// JobsDiffData returns the changes a job makes to the default parameters as JSON
+func (h *Handler) JobsDiffData(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	changes, err := jobDiff(user, c.Query("id"))
+	if err != nil {
+		logger.Debug("diffing job '%s' for user '%s': %s", c.Query("id"), user.Username, err)
+		return c.Status(fiber.StatusBadRequest).SendString("Could not compare the job with the defaults")
+	}
+	if changes == nil {
+		changes = []params.Change{}
+	}
+	return c.JSON(changes)
+}
+
+// jobDiff compares the parameters of a job with the defaults it was built from
+func jobDiff(user *users.User, name string) ([]params.Change, error) {
+	if !NameRegex.MatchString(name) {
+		return nil, fmt.Errorf("invalid job name")
+	}
+	mp, ep, err := user.GetJobParams(name)
+	if err != nil {
+		return nil, err
+	}
+	dmp, dep, err := params.DefaultsFor(ep)
+	if err != nil {
+		return nil, err
+	}
+	if mp.TargetDatabase != "" {
+		applyTargetDatabase(dmp, dep, mp.TargetDatabase)
+	}
+
+	changes, err := params.DiffMaster(dmp, mp)
+	if err != nil {
+		return nil, fmt.Errorf("comparing master params: %w", err)
+	}
+	eco, err := params.DiffEco(dep, ep)
+	if err != nil {
+		return nil, fmt.Errorf("comparing eco params: %w", err)
+	}
+	return append(changes, eco...), nil
+}
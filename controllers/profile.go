@@ -1,6 +1,13 @@
 package controllers
 
 import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/blgolden/igendec/audit"
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/users"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -12,9 +19,45 @@ func (h *Handler) Profile(c *fiber.Ctx) error {
 	}
 	m := make(fiber.Map)
 	m = user.ToMap(m)
+
+	m["Quota"] = user.GetQuota()
+	if m["Usage"], err = user.Usage(); err != nil {
+		logger.Warn("measuring usage of user '%s': %s", user.Username, err)
+		delete(m, "Usage")
+	}
+	if m["Sessions"], err = user.ListSessions(); err != nil {
+		logger.Warn("listing sessions of user '%s': %s", user.Username, err)
+		delete(m, "Sessions")
+	}
+	m["CurrentSession"] = h.Session.Key(c)
+	m["Verified"] = user.Verified()
+	m["UnverifiedCanRun"] = users.UnverifiedCanRun
+	m["TwoFactorEnabled"] = user.TwoFactorEnabled()
+	m["TwoFactorRequired"] = user.NeedsTwoFactor()
+	if user.TwoFactorEnabled() {
+		m["RecoveryCodesLeft"] = len(user.TwoFactor.RecoveryCodes)
+	}
 	return h.RenderPrimary("profile", m, c)
 }
 
+// RevokeSession signs the user out of one of their sessions, given by key
+// Revoking the current session signs them out here too
+func (h *Handler) RevokeSession(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	key := c.FormValue("key")
+	if err = user.RevokeSession(key); errors.Is(err, os.ErrNotExist) {
+		return c.Status(fiber.StatusBadRequest).SendString("No such session, it may have already ended")
+	} else if err != nil {
+		logger.Warn("revoking session of user '%s': %s", user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	record(c, audit.SessionRevoke, user.Username, "", "")
+	return c.SendStatus(fiber.StatusOK)
+}
+
 // UpdateProfile updates a users profile
 func (h *Handler) UpdateProfile(c *fiber.Ctx) error {
 	// Get user struct
@@ -23,14 +66,38 @@ func (h *Handler) UpdateProfile(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
 	}
 
+	// Read the profile again once locked so a concurrent change isn't lost
+	defer user.Lock()()
+	if _, err = user.Get(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
 	user.Firstname = c.FormValue("firstname")
 	user.Surname = c.FormValue("surname")
-	user.Email = c.FormValue("email")
 	user.Location = c.FormValue("location")
 
+	// A new email address has to be verified again
+	var token string
+	if email := c.FormValue("email"); email != user.Email {
+		user.Email = email
+		token, err = user.StartVerification(time.Now())
+		if errors.Is(err, users.ErrBadEmail) {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		} else if err != nil && !errors.Is(err, users.ErrVerifyTooSoon) {
+			logger.Warn("starting email verification of user '%s': %s", user.Username, err)
+			return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+		}
+	}
+
 	if err = user.Update(); err != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
 	}
+	if token != "" {
+		if err = h.sendVerification(user, token); err != nil {
+			logger.Warn("mailing email verification to user '%s': %s", user.Username, err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Your profile was saved, but the email to verify your address couldn't be sent. Send another from your profile")
+		}
+	}
 	return c.SendStatus(fiber.StatusOK)
 }
 
@@ -42,8 +109,15 @@ func (h *Handler) UpdatePassword(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
 	}
 
+	// Read the profile again once locked so a concurrent change isn't lost
+	defer user.Lock()()
+	if _, err = user.Get(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
 	// Compare the old password with current to make sure they match
 	if err = user.ComparePassword(c.FormValue("oldpassword")); err != nil {
+		record(c, audit.PasswordChangeFailed, user.Username, "", "wrong old password")
 		return c.Status(fiber.StatusBadRequest).SendString("Old password does not match current password")
 	}
 
@@ -62,6 +136,7 @@ func (h *Handler) UpdatePassword(c *fiber.Ctx) error {
 	if err = user.Update(); err != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
 	}
+	record(c, audit.PasswordChange, user.Username, "", "")
 
 	return c.SendStatus(fiber.StatusOK)
 }
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/blgolden/igendec/audit"
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/mail"
+	"github.com/blgolden/igendec/users"
+	"github.com/gofiber/fiber/v2"
+)
+
+// forgotResponse is the answer to every reset request, so it can't be used to find accounts
+const forgotResponse = "If the account has an email address, a link to reset the password has been sent to it"
+
+// Forgot renders the forgotten password page, and mails a reset link to the username posted to it
+func (h *Handler) Forgot(c *fiber.Ctx) error {
+	if c.Method() != fiber.MethodPost {
+		return h.RenderPrimary("forgot", nil, c)
+	}
+
+	username := c.FormValue("username")
+	user, err := users.NewUser(username).Get()
+	if err != nil || user.Email == "" {
+		record(c, audit.PasswordResetRequest, username, "", "unknown user or no email")
+		return c.SendString(forgotResponse)
+	}
+
+	token, err := user.NewPasswordReset(time.Now())
+	if errors.Is(err, users.ErrResetTooSoon) {
+		record(c, audit.PasswordResetRequest, username, "", "too soon")
+		return c.SendString(forgotResponse)
+	} else if err != nil {
+		// Failures get the same response as everything else, or they would show the account exists
+		logger.Warn("making password reset for user '%s': %s", username, err)
+		record(c, audit.PasswordResetRequest, username, "", "failed to make the link")
+		return c.SendString(forgotResponse)
+	}
+
+	link := fmt.Sprintf("%s/reset?user=%s&token=%s", h.BaseURL, url.QueryEscape(user.Username), token)
+	err = h.Mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your iGenDec password",
+		Body: fmt.Sprintf("Someone, hopefully you, asked to reset the password of the iGenDec account '%s'.\n\n"+
+			"Use this link to choose a new password, it works once and for the next %s:\n\n%s\n\n"+
+			"If you didn't ask for this, you can ignore this email and your password won't change.\n",
+			user.Username, users.ResetPeriod, link),
+	})
+	if err != nil {
+		logger.Warn("mailing password reset to user '%s': %s", username, err)
+		record(c, audit.PasswordResetRequest, username, "", "failed to send")
+		return c.SendString(forgotResponse)
+	}
+	record(c, audit.PasswordResetRequest, username, "", "sent")
+	return c.SendString(forgotResponse)
+}
+
+// Reset renders the page to choose a new password from a reset link, and sets the password posted to it
+// Takes the user and token from the link, and newpassword and newpassword2
+func (h *Handler) Reset(c *fiber.Ctx) error {
+	if c.Method() != fiber.MethodPost {
+		return h.RenderPrimary("reset", fiber.Map{"User": c.Query("user"), "Token": c.Query("token")}, c)
+	}
+
+	password := c.FormValue("newpassword")
+	if password != c.FormValue("newpassword2") {
+		return c.Status(fiber.StatusBadRequest).SendString("Passwords don't match")
+	}
+
+	user := users.NewUser(c.FormValue("user"))
+	switch err := user.ResetPassword(c.FormValue("token"), password, time.Now()); {
+	case errors.Is(err, users.ErrResetInvalid):
+		record(c, audit.PasswordResetFailed, user.Username, "", "invalid link")
+		return c.Status(fiber.StatusBadRequest).SendString("This " + err.Error() + ". Ask for another from the sign in page")
+	case errors.Is(err, users.ErrInvalidPassword):
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	case err != nil:
+		logger.Warn("resetting password of user '%s': %s", user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	record(c, audit.PasswordReset, user.Username, "", "")
+	return c.SendStatus(fiber.StatusOK)
+}
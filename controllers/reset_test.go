@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/blgolden/igendec/mail"
+	"github.com/blgolden/igendec/users"
+	"github.com/gofiber/fiber/v2"
+)
+
+// failingMailer fails to send every message
+type failingMailer struct{}
+
+func (failingMailer) Send(msg mail.Message) error { return errors.New("mail server is down") }
+
+func TestForgotHidesAccounts(t *testing.T) {
+	h, app := newTestHandler(t)
+	h.Mailer = failingMailer{}
+	app.Post("/forgot", h.Forgot)
+
+	bob, err := users.NewUser("bob").Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Email = "bob@example.com"
+	if err = bob.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An account the link can't be sent to looks the same as no account
+	for _, username := range []string{"bob", "nobody"} {
+		req := httptest.NewRequest(fiber.MethodPost, "/forgot", strings.NewReader(url.Values{"username": {username}}.Encode()))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		resp := testRequest(t, app, req)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != fiber.StatusOK || string(body) != forgotResponse {
+			t.Errorf("%s: got %d %q, want %d %q", username, resp.StatusCode, body, fiber.StatusOK, forgotResponse)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/users"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// DefaultSensitivityPercent is how far inputs are moved if the user doesn't choose
+const DefaultSensitivityPercent = 10
+
+// JobsSensitivity returns the html for the sensitivity analysis of a job
+// If the job hasn't been analysed this is the form to start one
+func (h *Handler) JobsSensitivity(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	name := c.Query("id")
+	if !NameRegex.MatchString(name) {
+		return c.Status(fiber.StatusBadRequest).SendString("bad job name")
+	}
+	job, err := user.GetJob(name)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("bad job name")
+	}
+	mp, ep, err := user.GetJobParams(name)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	m := fiber.Map{
+		"Job":     job,
+		"Inputs":  users.SensitivityInputsFor(mp, ep),
+		"Percent": DefaultSensitivityPercent,
+	}
+	if batch, err := user.GetSensitivity(name); err == nil {
+		report, err := batch.Sensitivity()
+		if err != nil {
+			m["Error"] = err.Error()
+		}
+		m["Report"] = report
+	}
+	return c.Render("jobs/sensitivity", m)
+}
+
+// JobsSensitivityCreate starts a sensitivity analysis of a job
+// An earlier analysis, or jobs of the same names, are only replaced if the overwrite form value is true.
+// The inputs to change are given as paths in the input form value, and how far to move them in percent
+func (h *Handler) JobsSensitivityCreate(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	name := c.Query("id")
+	if !NameRegex.MatchString(name) {
+		return c.Status(fiber.StatusBadRequest).SendString("bad job name")
+	}
+	percent, err := strconv.ParseFloat(c.FormValue("percent"), 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("The change must be a number")
+	}
+
+	selected := make(map[string]bool)
+	for _, path := range c.Context().PostArgs().PeekMulti("input") {
+		selected[string(path)] = true
+	}
+	var inputs []users.SensitivityInput
+	for _, in := range users.SensitivityInputs {
+		if selected[in.Path] {
+			inputs = append(inputs, in)
+		}
+	}
+
+	defer user.Lock()()
+	_, jobs, err := user.CreateSensitivity(name, percent, inputs, c.FormValue("overwrite") == "true")
+	switch {
+	case errors.Is(err, users.ErrBadSweep), errors.Is(err, users.ErrBatchTooLarge), errors.Is(err, users.ErrBaseNotPassed):
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	case errors.Is(err, users.ErrBatchJobActive):
+		return c.Status(fiber.StatusConflict).SendString("The analysis of this job is still running")
+	case errors.Is(err, users.ErrBatchExists):
+		return c.Status(fiber.StatusPreconditionFailed).SendString(err.Error())
+	case errors.Is(err, users.ErrQuotaJobs), errors.Is(err, users.ErrQuotaBytes), errors.Is(err, users.ErrQuotaRuns):
+		return quotaResponse(c, user, err)
+	case err != nil:
+		logger.Warn("creating sensitivity analysis of job '%s' for user '%s': %s", name, user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	if n, err := users.SubmitJobs(jobs, h.Queue.Submit); err != nil {
+		logger.Warn("queueing sensitivity analysis of job '%s' for user '%s': %s", name, user.Username, err)
+		return c.Status(fiber.StatusServiceUnavailable).SendString(
+			fmt.Sprintf("Only %d of the %d jobs could be queued, please try again later", n, len(jobs)))
+	}
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// JobsSensitivityDownload returns the sensitivity analysis of a job as CSV
+func (h *Handler) JobsSensitivityDownload(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	name := c.Query("id")
+	if !NameRegex.MatchString(name) {
+		return c.Status(fiber.StatusBadRequest).SendString("bad job name")
+	}
+	batch, err := user.GetSensitivity(name)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("This job has not been analysed")
+	}
+	report, err := batch.Sensitivity()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if err = report.WriteCSV(buf); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	c.Append(fiber.HeaderContentType, "text/csv")
+	c.Append(fiber.HeaderContentDisposition, `attachment; filename="`+batch.Name+`.csv"`)
+	return c.Send(buf.Bytes())
+}
@@ -0,0 +1,142 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/users"
+)
+
+// Expiry settings for sessions, set them before calling New
+var (
+	// IdleTimeout signs a session out once it hasn't been used for this long, 0 for no limit
+	IdleTimeout = 2 * time.Hour
+	// MaxAge signs a session out this long after it was signed in, however much it is used
+	MaxAge = 7 * 24 * time.Hour
+)
+
+// touchInterval is how out of date the last seen time of a session can be before it is written
+// again, so a session isn't written on every request
+const touchInterval = time.Minute
+
+// provider keeps sessions in the users database so they survive restarts
+// It is a fasthttp session provider, which is what the fiber session library stores sessions with
+type provider struct {
+	now func() time.Time
+}
+
+// expired returns true if the session has been idle for too long, or is too old
+func (p *provider) expired(s *users.Session, now time.Time) bool {
+	return (IdleTimeout > 0 && now.Sub(s.LastSeen) > IdleTimeout) ||
+		(MaxAge > 0 && now.Sub(s.Created) > MaxAge)
+}
+
+// get returns the session with the id, nil if there isn't one or it has expired
+// A session that can't be read is treated as signed out, so the user can sign in again
+func (p *provider) get(id []byte) *users.Session {
+	key := users.SessionKey(id)
+	s, err := users.GetSession(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		logger.Warn("reading session: %s", err)
+		return nil
+	}
+	if p.expired(s, p.now()) {
+		if err = users.DeleteSession(key); err != nil {
+			logger.Warn("removing expired session: %s", err)
+		}
+		return nil
+	}
+	return s
+}
+
+// Get returns the values of a session, and records that it was used
+func (p *provider) Get(id []byte) ([]byte, error) {
+	s := p.get(id)
+	if s == nil {
+		return nil, nil
+	}
+	if now := p.now(); now.Sub(s.LastSeen) >= touchInterval {
+		s.LastSeen = now
+		if err := users.SetSession(s); err != nil {
+			logger.Warn("recording session was used: %s", err)
+		}
+	}
+	return s.Data, nil
+}
+
+// Save stores the values of a session, starting a new one if needed
+// The expiration is ignored, sessions expire by IdleTimeout and MaxAge
+func (p *provider) Save(id, data []byte, expiration time.Duration) error {
+	now := p.now()
+	s := p.get(id)
+	if s == nil {
+		s = &users.Session{Key: users.SessionKey(id), Created: now}
+	}
+	s.Data = data
+	s.LastSeen = now
+	return users.SetSession(s)
+}
+
+// Destroy removes a session
+func (p *provider) Destroy(id []byte) error {
+	return users.DeleteSession(users.SessionKey(id))
+}
+
+// Regenerate moves a session to a new id
+func (p *provider) Regenerate(id, newID []byte, expiration time.Duration) error {
+	s := p.get(id)
+	if s == nil {
+		return nil
+	}
+	if err := users.DeleteSession(s.Key); err != nil {
+		return err
+	}
+	s.Key = users.SessionKey(newID)
+	return users.SetSession(s)
+}
+
+// Count returns the number of sessions, including any that have expired but not been removed
+func (p *provider) Count() int {
+	sessions, _ := users.ListSessions()
+	return len(sessions)
+}
+
+// NeedGC is true as expired sessions are only removed when they are next used, or by GC
+func (p *provider) NeedGC() bool {
+	return true
+}
+
+// GC removes the expired sessions
+func (p *provider) GC() {
+	sessions, err := users.ListSessions()
+	if err != nil {
+		logger.Warn("removing expired sessions: %s", err)
+		return
+	}
+	now := p.now()
+	for _, s := range sessions {
+		if !p.expired(s, now) {
+			continue
+		}
+		if err = users.DeleteSession(s.Key); err != nil {
+			logger.Warn("removing expired session: %s", err)
+		}
+	}
+}
+
+// signIn records who a session belongs to, and restarts its MaxAge as it has been signed in again
+func (p *provider) signIn(id []byte, username, ip, userAgent string) error {
+	s := p.get(id)
+	if s == nil {
+		return errors.New("session was not saved")
+	}
+	s.Username = username
+	s.IP = ip
+	s.UserAgent = userAgent
+	s.Created = p.now()
+	return users.SetSession(s)
+}
@@ -0,0 +1,49 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blgolden/igendec/users"
+)
+
+func TestProviderExpiry(t *testing.T) {
+	path, idle, maxAge := users.UsersPath, IdleTimeout, MaxAge
+	users.UsersPath = t.TempDir()
+	users.Init()
+	t.Cleanup(func() {
+		users.Close()
+		users.UsersPath, IdleTimeout, MaxAge = path, idle, maxAge
+	})
+	IdleTimeout, MaxAge = time.Hour, 3*time.Hour
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	p := &provider{now: func() time.Time { return now }}
+
+	if err := p.Save([]byte("idle"), []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Save([]byte("busy"), []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Using a session keeps it from going idle, until it reaches its max age
+	for i := 0; i < 4; i++ {
+		now = now.Add(50 * time.Minute)
+		data, _ := p.Get([]byte("busy"))
+		if want := i < 3; (data != nil) != want {
+			t.Errorf("after %s: got session %q, want it kept %v", time.Duration(i+1)*50*time.Minute, data, want)
+		}
+	}
+	if data, _ := p.Get([]byte("idle")); data != nil {
+		t.Errorf("idle session: got %q, want it expired", data)
+	}
+
+	// Expired sessions that aren't used again are removed by GC
+	p.Save([]byte("gc"), []byte("c"), 0)
+	now = now.Add(2 * time.Hour)
+	p.GC()
+	if n := p.Count(); n != 0 {
+		t.Errorf("after GC: got %d sessions, want 0", n)
+	}
+}
@@ -4,10 +4,15 @@
 package session
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/session/v2"
+	"github.com/valyala/fasthttp"
+	"github.com/blgolden/igendec/logger"
 	"github.com/blgolden/igendec/users"
 )
 
@@ -20,11 +25,25 @@ var (
 // add some more specific methods to it
 type Sess struct {
 	*session.Session
+	provider *provider
 }
 
+// cookieName is the cookie the session ID is kept in
+const cookieName = "session_id"
+
 // New creates a new session
+// Sessions are kept in the users database, so users.Init must have been called
 func New() *Sess {
-	return &Sess{session.New()}
+	p := &provider{now: time.Now}
+	return &Sess{
+		Session: session.New(session.Config{
+			Lookup:     "cookie:" + cookieName,
+			Expiration: MaxAge,
+			Provider:   p,
+			Generator:  newSessionID,
+		}),
+		provider: p,
+	}
 }
 
 // Store returns the store for the given context
@@ -32,12 +51,115 @@ func (s *Sess) Store(c *fiber.Ctx) *session.Store {
 	return s.Get(c)
 }
 
+// TwoFactorTimeout is how long a user has to give their two-factor code after their password
+const TwoFactorTimeout = 5 * time.Minute
+
 // New starts a session for a user
 // A session contains the user struct for a user
 func (s *Sess) New(c *fiber.Ctx, user *users.User) {
-	store := s.Get(c)
+	store, err := s.regenerate(c)
+	if err != nil {
+		logger.Warn("regenerating session for user '%s': %s", user.Username, err)
+		return
+	}
+	id := store.ID()
+	store.Delete("twofactor")
+	store.Delete("twofactorAt")
 	store.Set("username", user.Username)
-	store.Save()
+	store.Set("csrf", newCSRFToken())
+	if err := store.Save(); err != nil {
+		logger.Warn("saving session for user '%s': %s", user.Username, err)
+		return
+	}
+	if err := s.provider.signIn([]byte(id), user.Username, c.IP(), c.Get(fiber.HeaderUserAgent)); err != nil {
+		logger.Warn("recording session for user '%s': %s", user.Username, err)
+	}
+}
+
+// StartTwoFactor records that the user has given their password, they are signed in by New
+// once they give their two-factor code
+func (s *Sess) StartTwoFactor(c *fiber.Ctx, user *users.User, now time.Time) error {
+	store, err := s.regenerate(c)
+	if err != nil {
+		return err
+	}
+	store.Set("twofactor", user.Username)
+	store.Set("twofactorAt", now.Unix())
+	return store.Save()
+}
+
+// regenerate moves the session to a new ID and returns its store, so an ID someone knew
+// before a sign in step can't be used after it
+func (s *Sess) regenerate(c *fiber.Ctx) (*session.Store, error) {
+	if err := s.Get(c).Regenerate(); err != nil {
+		return nil, err
+	}
+
+	// The new ID is only in the response cookie, the request is pointed at it so the store is read from it
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey(cookieName)
+	if !c.Response().Header.Cookie(cookie) {
+		return nil, errors.New("no session cookie was set")
+	}
+	c.Request().Header.SetCookieBytesKV(cookie.Key(), cookie.Value())
+	return s.Get(c), nil
+}
+
+// TwoFactorUser returns the user StartTwoFactor was called for, ErrNoSession if there isn't one
+// or it was more than TwoFactorTimeout ago
+func (s *Sess) TwoFactorUser(c *fiber.Ctx, now time.Time) (*users.User, error) {
+	store := s.Get(c)
+	username, ok := store.Get("twofactor").(string)
+	at, _ := store.Get("twofactorAt").(int64)
+	if !ok || now.Sub(time.Unix(at, 0)) > TwoFactorTimeout {
+		return nil, ErrNoSession
+	}
+	return users.NewUser(username).Get()
+}
+
+// Key returns the key the current session is kept by, see users.Session
+func (s *Sess) Key(c *fiber.Ctx) string {
+	return users.SessionKey([]byte(s.Get(c).ID()))
+}
+
+// CSRFToken returns the token requests that change anything must carry, empty if there is no session
+// Sessions from before tokens were kept are given one
+func (s *Sess) CSRFToken(c *fiber.Ctx) string {
+	store := s.Get(c)
+	if token, ok := store.Get("csrf").(string); ok {
+		return token
+	}
+	if store.Get("username") == nil {
+		return ""
+	}
+	token := newCSRFToken()
+	store.Set("csrf", token)
+	if err := store.Save(); err != nil {
+		logger.Warn("saving session: %s", err)
+		return ""
+	}
+	return token
+}
+
+// newCSRFToken returns a random token for a new session
+func newCSRFToken() string {
+	return randomHex("CSRF token")
+}
+
+// newSessionID returns a random session ID
+// The library's default is a counter, so the next IDs could be worked out from one
+func newSessionID() []byte {
+	return []byte(randomHex("session ID"))
+}
+
+// randomHex returns 32 random bytes as hex
+func randomHex(what string) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		logger.Fatal("generating %s: %s", what, err)
+	}
+	return hex.EncodeToString(b)
 }
 
 // Kill ends the session
@@ -51,6 +173,12 @@ func (s *Sess) Exists(c *fiber.Ctx) bool {
 	return store.Get("username") != nil
 }
 
+// Username returns the user signed in to the session, empty if there isn't one
+func (s *Sess) Username(c *fiber.Ctx) string {
+	username, _ := s.Get(c).Get("username").(string)
+	return username
+}
+
 // User returns the from the current session storage
 func (s *Sess) User(c *fiber.Ctx) (*users.User, error) {
 	store := s.Get(c)
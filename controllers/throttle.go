@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/blgolden/igendec/users"
+)
+
+// Throttle counts the failed sign ins from each address, locking out addresses that fail too
+// often, whichever accounts they try
+// It is kept in memory, so it starts again when the server restarts
+type Throttle struct {
+	// Attempts is how many failed sign ins in a row lock an address out, 0 never locks
+	Attempts int
+
+	mu        sync.Mutex
+	addresses map[string]*users.Lockout
+}
+
+// NewThrottle returns a throttle that locks out an address after attempts failed sign ins in a row
+func NewThrottle(attempts int) *Throttle {
+	return &Throttle{Attempts: attempts, addresses: make(map[string]*users.Lockout)}
+}
+
+// Check returns an error matching users.ErrSignInLocked if the address is locked out
+// Addresses aren't slowed down before then, as many users can share one
+func (t *Throttle) Check(ip string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l := t.addresses[ip]; l.Locked(now) {
+		return l.Check(now)
+	}
+	return nil
+}
+
+// Fail records a failed sign in from the address, returns true if this locked it out
+func (t *Throttle) Fail(ip string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.addresses[ip]
+	if !ok {
+		// Forget the expired addresses as new ones come in, so they don't build up
+		t.prune(now)
+		l = &users.Lockout{}
+		t.addresses[ip] = l
+	}
+	return l.Fail(now, t.Attempts)
+}
+
+// Unlock forgets the failed sign ins from the address, returns false if there weren't any
+func (t *Throttle) Unlock(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.addresses[ip]
+	delete(t.addresses, ip)
+	return ok
+}
+
+// List returns a copy of the failed sign ins of each address, forgetting those that have expired
+func (t *Throttle) List(now time.Time) map[string]*users.Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	list := make(map[string]*users.Lockout, len(t.addresses))
+	for ip, l := range t.addresses {
+		copied := *l
+		list[ip] = &copied
+	}
+	return list
+}
+
+// prune forgets the addresses whose failures have expired, t.mu must be held
+func (t *Throttle) prune(now time.Time) {
+	for ip, l := range t.addresses {
+		if l.Expired(now) {
+			delete(t.addresses, ip)
+		}
+	}
+}
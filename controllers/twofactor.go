@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/blgolden/igendec/audit"
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/users"
+	"github.com/gofiber/fiber/v2"
+)
+
+// TwoFactorSetup gives the user a new secret for their authenticator app, as the secret
+// and the otpauth URI. It is turned on by TwoFactorEnable
+func (h *Handler) TwoFactorSetup(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	tf, err := user.StartTwoFactor()
+	if err != nil {
+		return twoFactorResponse(c, user, err)
+	}
+	return c.JSON(fiber.Map{"Secret": tf.Secret, "URI": tf.URI(user.Username)})
+}
+
+// TwoFactorEnable turns two-factor authentication on once the user gives a code from their
+// authenticator app, and responds with their recovery codes
+func (h *Handler) TwoFactorEnable(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	codes, err := user.EnableTwoFactor(c.FormValue("code"), time.Now())
+	if err != nil {
+		return twoFactorResponse(c, user, err)
+	}
+	record(c, audit.TwoFactorEnable, user.Username, "", "")
+	return c.JSON(codes)
+}
+
+// TwoFactorRecovery replaces the users recovery codes, given a code from their authenticator app
+func (h *Handler) TwoFactorRecovery(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	codes, err := user.NewRecoveryCodes(c.FormValue("code"), time.Now())
+	if err != nil {
+		return twoFactorResponse(c, user, err)
+	}
+	record(c, audit.TwoFactorEnable, user.Username, "", "new recovery codes")
+	return c.JSON(codes)
+}
+
+// TwoFactorDisable turns two-factor authentication off, given the users password and a code from
+// their authenticator app or a recovery code
+func (h *Handler) TwoFactorDisable(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	if err = user.ComparePassword(c.FormValue("password")); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Password incorrect")
+	}
+	if err = user.DisableTwoFactor(c.FormValue("code"), time.Now()); err != nil {
+		return twoFactorResponse(c, user, err)
+	}
+	record(c, audit.TwoFactorDisable, user.Username, "", "")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// twoFactorResponse responds to a two-factor change that couldn't be made
+func twoFactorResponse(c *fiber.Ctx, user *users.User, err error) error {
+	switch {
+	case errors.Is(err, users.ErrTwoFactorInvalid):
+		return c.Status(fiber.StatusBadRequest).SendString("Code incorrect, check the time on your device is right")
+	case errors.Is(err, users.ErrTwoFactorEnabled), errors.Is(err, users.ErrTwoFactorNotEnabled),
+		errors.Is(err, users.ErrTwoFactorNotStarted):
+		return c.Status(fiber.StatusConflict).SendString(err.Error())
+	case errors.Is(err, users.ErrTwoFactorRequired):
+		return c.Status(fiber.StatusForbidden).SendString(err.Error())
+	}
+	logger.Warn("changing two-factor authentication of user '%s': %s", user.Username, err)
+	return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+}
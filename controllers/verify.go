@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/blgolden/igendec/audit"
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/mail"
+	"github.com/blgolden/igendec/users"
+	"github.com/gofiber/fiber/v2"
+)
+
+// sendVerification mails the link to verify the users email address with token
+func (h *Handler) sendVerification(user *users.User, token string) error {
+	link := fmt.Sprintf("%s/verify?user=%s&token=%s", h.BaseURL, url.QueryEscape(user.Username), token)
+	return h.Mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your iGenDec email address",
+		Body: fmt.Sprintf("This address was given for the iGenDec account '%s'.\n\n"+
+			"Use this link to verify it, it works for the next %s:\n\n%s\n\n"+
+			"If you didn't sign up for iGenDec, you can ignore this email.\n",
+			user.Username, users.VerifyPeriod, link),
+	})
+}
+
+// Verify marks a users email address as verified from the link mailed to it
+// Takes the user and token from the link
+func (h *Handler) Verify(c *fiber.Ctx) error {
+	m := make(fiber.Map)
+	user := users.NewUser(c.Query("user"))
+	switch err := user.Verify(c.Query("token"), time.Now()); {
+	case err == nil:
+		record(c, audit.EmailVerify, user.Username, "", user.Email)
+		m["Message"] = "Your email address is verified, thank you"
+	case errors.Is(err, users.ErrAlreadyVerified):
+		m["Message"] = "Your email address is already verified"
+	case errors.Is(err, users.ErrVerifyInvalid):
+		record(c, audit.EmailVerifyFailed, user.Username, "", "invalid link")
+		m["Error"] = "This " + err.Error() + ". You can send another from your profile"
+	default:
+		logger.Warn("verifying email of user '%s': %s", user.Username, err)
+		m["Error"] = InternalServerErrorString
+	}
+	return h.RenderPrimary("verify", m, c)
+}
+
+// ResendVerification mails another verification link to the users email address
+func (h *Handler) ResendVerification(c *fiber.Ctx) error {
+	user, err := h.Session.User(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	defer user.Lock()()
+	if _, err = user.Get(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	if user.Verified() {
+		return c.Status(fiber.StatusBadRequest).SendString("Your email address is already verified")
+	}
+	token, err := user.StartVerification(time.Now())
+	if err == nil {
+		err = user.Update()
+	}
+
+	switch {
+	case errors.Is(err, users.ErrVerifyTooSoon):
+		return c.Status(fiber.StatusTooManyRequests).SendString(err.Error() + ", check your inbox")
+	case errors.Is(err, users.ErrBadEmail):
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	case err != nil:
+		logger.Warn("starting email verification of user '%s': %s", user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+
+	if err = h.sendVerification(user, token); err != nil {
+		logger.Warn("mailing email verification to user '%s': %s", user.Username, err)
+		return c.Status(fiber.StatusInternalServerError).SendString(InternalServerErrorString)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
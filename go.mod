@@ -11,6 +11,8 @@ require (
 	github.com/klauspost/compress v1.11.1
 	github.com/rs/zerolog v1.20.0
 	github.com/stretchr/testify v1.7.0 // indirect
+	github.com/valyala/fasthttp v1.16.0
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
 	golang.org/x/sys v0.0.0-20210309074719-68d13333faf2 // indirect
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
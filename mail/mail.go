@@ -0,0 +1,112 @@
+// Package mail sends email to users, such as password reset links
+// Mailer is implemented by SMTPMailer for real mail, and FileMailer for development
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blgolden/igendec/logger"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// ErrBadAddress is returned for an address that can't be sent to
+var ErrBadAddress = errors.New("bad email address")
+
+// checkAddress returns ErrBadAddress for an address that could inject headers or isn't an address
+func checkAddress(addr string) error {
+	if addr == "" || strings.ContainsAny(addr, "\r\n<>,;") || !strings.Contains(addr, "@") {
+		return fmt.Errorf("%w: '%s'", ErrBadAddress, addr)
+	}
+	return nil
+}
+
+// Bytes returns the message as sent, with the headers
+func (m Message) Bytes(from string, date time.Time) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", strings.NewReplacer("\r", "", "\n", " ").Replace(m.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// SMTPMailer sends messages through an SMTP server
+// Addr is host:port. If Username is set the server is signed in to, which needs TLS
+// unless the server is on localhost
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send sends the message
+func (s *SMTPMailer) Send(msg Message) error {
+	if err := checkAddress(msg.To); err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return fmt.Errorf("smtp address: %w", err)
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, msg.Bytes(s.From, time.Now()))
+}
+
+// FileMailer appends messages to a file instead of sending them, or logs them if Path is empty
+// It is for development and testing, where there is no mail server
+type FileMailer struct {
+	Path string
+	From string
+
+	mu sync.Mutex
+}
+
+// Send writes the message
+func (f *FileMailer) Send(msg Message) error {
+	if err := checkAddress(msg.To); err != nil {
+		return err
+	}
+	data := msg.Bytes(f.From, time.Now())
+	if f.Path == "" {
+		logger.Info("mail not sent, no mailer is set up:\n%s", data)
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, "\r\n\r\n"...)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,109 @@
+package params
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Difference is a parameter that isn't the same in every document compared
+// Path is in the form understood by ApplyPath, and Values has the value from each document,
+// empty where the document doesn't have the parameter
+type Difference struct {
+	Path   string   `json:"path"`
+	Values []string `json:"values"`
+}
+
+// Flatten returns every value in doc by its path, along with the paths in order
+// doc should be MasterParams or EcoParams, and prefix is put in front of every path
+func Flatten(doc interface{}, prefix string) (map[string]string, []string, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tree interface{}
+	if err = json.Unmarshal(data, &tree); err != nil {
+		return nil, nil, err
+	}
+
+	values := make(map[string]string)
+	var paths []string
+	var walk func(node interface{}, path string)
+	walk = func(node interface{}, path string) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(n))
+			for key := range n {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if path == prefix {
+					walk(n[key], path+key)
+				} else {
+					walk(n[key], path+"."+key)
+				}
+			}
+		case []interface{}:
+			for i, v := range n {
+				walk(v, fmt.Sprintf("%s[%d]", path, i))
+			}
+		default:
+			values[path] = leafString(n)
+			paths = append(paths, path)
+		}
+	}
+	walk(tree, prefix)
+	return values, paths, nil
+}
+
+// Diff returns the parameters that differ between the documents, which should all be the same type
+func Diff(prefix string, docs ...interface{}) ([]Difference, error) {
+	flat := make([]map[string]string, len(docs))
+	var order []string
+	seen := make(map[string]bool)
+	for i, doc := range docs {
+		values, paths, err := Flatten(doc, prefix)
+		if err != nil {
+			return nil, err
+		}
+		flat[i] = values
+		for _, p := range paths {
+			if !seen[p] {
+				seen[p] = true
+				order = append(order, p)
+			}
+		}
+	}
+
+	var diffs []Difference
+	for _, p := range order {
+		d := Difference{Path: p, Values: make([]string, len(docs))}
+		same := true
+		for i := range docs {
+			d.Values[i] = flat[i][p]
+			if d.Values[i] != d.Values[0] {
+				same = false
+			}
+		}
+		if !same {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+func leafString(v interface{}) string {
+	switch l := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return l
+	case float64:
+		return strconv.FormatFloat(l, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(l)
+	}
+	return fmt.Sprint(v)
+}
@@ -9,13 +9,14 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/hjson/hjson-go"
+	"github.com/blgolden/igendec/schema"
 )
 
 // Defines structure modeling the ecoIndex.hjson file
 
 // EcoParams should mock the economical optional input file for iGenDec
 type EcoParams struct {
+	SchemaVersion       int         `json:"schemaVersion,omitempty"` // Custom field - left out of the files given to iGenDec
 	SaleEndpoint        string      `json:"saleEndpoint"`
 	IndexTerminal       bool        `json:"indexTerminal"`
 	IndexComponents     []string    `json:"indexComponents"`
@@ -33,9 +34,18 @@ type EcoParams struct {
 // Bytes returns the marshalled index params
 // If need to change the way we process the params, can easily do here
 func (params *EcoParams) Bytes() ([]byte, error) {
+	params.SchemaVersion = schema.Current(schema.EcoParams)
 	return json.MarshalIndent(params, "", "    ")
 }
 
+// ModelBytes returns the marshalled params as they are given to the iGenDec model,
+// without the schema version it doesn't know about
+func (params *EcoParams) ModelBytes() ([]byte, error) {
+	p := *params
+	p.SchemaVersion = 0
+	return json.MarshalIndent(&p, "", "    ")
+}
+
 // ToMap returns the values we need from the struct in a fiber compatible map
 func (params *EcoParams) ToMap(m map[string]interface{}) map[string]interface{} {
 
@@ -159,31 +169,33 @@ func EcoParamsFromFile(filename string) (*EcoParams, error) {
 	}
 	data, err := ioutil.ReadAll(file)
 
-	ep := &EcoParams{}
-
 	if filepath.Ext(filename) == ".hjson" {
-		m := make(map[string]interface{})
-		if err = hjson.Unmarshal(data, &m); err != nil {
-			return nil, err
-		}
-		data, err = json.Marshal(m)
-		if err != nil {
-			return nil, err
-		}
-		if err = json.Unmarshal(data, ep); err != nil {
-			return nil, err
-		}
+		return EcoParamsFromBytes(data)
 	} else if filepath.Ext(filename) == ".json" {
+		ep := &EcoParams{}
 		if err = json.Unmarshal(data, ep); err != nil {
 			return nil, err
 		}
-	} else {
-		return nil, fmt.Errorf("expecting either json or hjson file, have %s", filename)
+		ep.tidyIndexComponents()
+		return ep, nil
+	}
+	return nil, fmt.Errorf("expecting either json or hjson file, have %s", filename)
+}
+
+// EcoParamsFromBytes parses eco parameters in hjson
+// Parameters from older versions are upgraded
+func EcoParamsFromBytes(data []byte) (*EcoParams, error) {
+	ep := &EcoParams{}
+	if err := schema.Decode(schema.EcoParams, data, ep); err != nil {
+		return nil, err
 	}
+	ep.tidyIndexComponents()
+	return ep, nil
+}
 
+// tidyIndexComponents strips the whitespace from the index components
+func (ep *EcoParams) tidyIndexComponents() {
 	for idx, v := range ep.IndexComponents {
 		ep.IndexComponents[idx] = strings.ReplaceAll(v, " ", "")
 	}
-
-	return ep, nil
 }
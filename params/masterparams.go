@@ -11,13 +11,15 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/hjson/hjson-go"
+	"github.com/blgolden/igendec/schema"
 )
 
 // Defines structure modeling the index.hjson file
 
 // MasterParams should mock main file for iGenDec
 type MasterParams struct {
+	SchemaVersion int `json:"schemaVersion,omitempty"` // Custom field - left out of the files given to iGenDec
+
 	Comment        string `json:"comment"`
 	TargetDatabase string `json:"target-database,omitempty"`
 
@@ -47,9 +49,18 @@ type MasterParams struct {
 // Bytes returns the marshalled index params
 // If need to change the way we process the params, can easily do here
 func (params *MasterParams) Bytes() ([]byte, error) {
+	params.SchemaVersion = schema.Current(schema.MasterParams)
 	return json.MarshalIndent(params, "", "    ")
 }
 
+// ModelBytes returns the marshalled params as they are given to the iGenDec model,
+// without the schema version it doesn't know about
+func (params *MasterParams) ModelBytes() ([]byte, error) {
+	p := *params
+	p.SchemaVersion = 0
+	return json.MarshalIndent(&p, "", "    ")
+}
+
 // ToMap returns the values we need from the struct in a fiber compatible map
 // Has to set up some fields to work with the front end
 func (params *MasterParams) ToMap(m map[string]interface{}) map[string]interface{} {
@@ -132,31 +143,34 @@ func MasterParamsFromFile(filename string) (*MasterParams, error) {
 		return nil, fmt.Errorf("reading file: %w", err)
 	}
 
-	ip := &MasterParams{}
-
 	// Switch on the filetype. If its hjson need to do some marshalling and unmarshalling magic
 	// and if its just JSON do a simple unmarshall
 	if filepath.Ext(filename) == ".hjson" {
-		m := make(map[string]interface{})
-		if err = hjson.Unmarshal(data, &m); err != nil {
-			return nil, fmt.Errorf("parsing hjson: %w", err)
-		}
-		data, err = json.Marshal(m)
-		if err != nil {
-			return nil, fmt.Errorf("parsing hjson: %w", err)
-		}
-		if err = json.Unmarshal(data, ip); err != nil {
-			return nil, fmt.Errorf("parsing hjson: %w", err)
-		}
+		return MasterParamsFromBytes(data)
 	} else if filepath.Ext(DefaultMasterPath) == ".json" {
+		ip := &MasterParams{}
 		if err = json.Unmarshal(data, ip); err != nil {
 			return nil, fmt.Errorf("parsing json: %w", err)
 		}
-	} else {
-		return nil, fmt.Errorf("expecting either .json or .hjson file, have %s", DefaultMasterPath)
+		ip.mineBreedCompositions()
+		return ip, nil
 	}
+	return nil, fmt.Errorf("expecting either .json or .hjson file, have %s", DefaultMasterPath)
+}
 
-	// Mine the breed compositions and build some generic names
+// MasterParamsFromBytes parses master parameters in hjson and validifies the fields
+// Parameters from older versions are upgraded
+func MasterParamsFromBytes(data []byte) (*MasterParams, error) {
+	ip := &MasterParams{}
+	if err := schema.Decode(schema.MasterParams, data, ip); err != nil {
+		return nil, fmt.Errorf("parsing hjson: %w", err)
+	}
+	ip.mineBreedCompositions()
+	return ip, nil
+}
+
+// mineBreedCompositions builds the breed compositions and some generic names for them from the herds
+func (ip *MasterParams) mineBreedCompositions() {
 	breedcomps := make(map[string]BreedComposition)
 	allcomps := append(ip.CowHerdBreedComposition, ip.BullBatteryBreedComposition...)
 	for idx := 1; idx < len(allcomps); idx += 2 {
@@ -178,8 +192,6 @@ func MasterParamsFromFile(filename string) (*MasterParams, error) {
 		ip.BreedCompositions = append(ip.BreedCompositions, bc)
 	}
 	sort.Slice(ip.BreedCompositions, func(i, j int) bool { return ip.BreedCompositions[i].Name < ip.BreedCompositions[j].Name })
-
-	return ip, err
 }
 
 func parseComp(compsIn []interface{}) []HerdComposition {
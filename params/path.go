@@ -0,0 +1,309 @@
+package params
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Parameter paths address a single value, or with wildcards a set of values, in the
+// master or eco parameters. They are made of the JSON field names separated by '.',
+// prefixed with 'master.' or 'eco.', where each field can be followed by indexes in
+// square brackets. An index into a comma-encoded row picks out a field of that row,
+// and '*' selects every element. For example:
+//
+//	eco.discountRate
+//	eco.aumCost[*]
+//	eco.traitSexPricePerCwt[*][4]
+//	master.planningHorizon
+//
+// Values are either absolute, or a percentage change from the current value such as '+10%'
+
+// Prefixes for parameter paths
+const (
+	PathPrefixMaster = "master."
+	PathPrefixEco    = "eco."
+)
+
+// maxRangeValues is the most values a single range can expand to
+const maxRangeValues = 1000
+
+// ApplyPath sets the values addressed by path in whichever of the parameters the path is for
+func ApplyPath(mp *MasterParams, ep *EcoParams, path, value string) error {
+	switch {
+	case strings.HasPrefix(path, PathPrefixMaster):
+		return setPath(mp, strings.TrimPrefix(path, PathPrefixMaster), value, path)
+	case strings.HasPrefix(path, PathPrefixEco):
+		return setPath(ep, strings.TrimPrefix(path, PathPrefixEco), value, path)
+	}
+	return fmt.Errorf("path %s must start with '%s' or '%s'", path, PathPrefixMaster, PathPrefixEco)
+}
+
+// SetPath sets the values addressed by path in target, which should be a pointer to
+// MasterParams or EcoParams. The path should not have the master/eco prefix
+func SetPath(target interface{}, path, value string) error {
+	return setPath(target, path, value, path)
+}
+
+// setPath is SetPath with the path to report in errors, which may include the prefix
+func setPath(target interface{}, path, value, name string) error {
+	steps, err := parsePath(path, name)
+	if err != nil {
+		return err
+	}
+
+	// Work on the JSON representation so paths match the field names in the files
+	data, err := json.Marshal(target)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc, err = setStep(doc, steps, value, name); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	// Decode into a fresh value so nothing from the old one is merged into the result
+	fresh := reflect.New(reflect.TypeOf(target).Elem())
+	if err = json.Unmarshal(data, fresh.Interface()); err != nil {
+		return fmt.Errorf("setting %s to %s: %w", name, value, err)
+	}
+	reflect.ValueOf(target).Elem().Set(fresh.Elem())
+	return nil
+}
+
+// ExpandValues turns a comma separated list of values into a slice
+// Each item is either a single value, or a range in the form start:stop:step which includes stop
+func ExpandValues(list string) ([]string, error) {
+	var values []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) == 1 {
+			values = append(values, item)
+			continue
+		}
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("range %s should be start:stop:step", item)
+		}
+		var nums [3]float64
+		for idx, p := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, fmt.Errorf("range %s: %s is not a number", item, p)
+			}
+			nums[idx] = v
+		}
+		start, stop, step := nums[0], nums[1], nums[2]
+		if step == 0 || (stop-start)/step < 0 {
+			return nil, fmt.Errorf("range %s never reaches its end", item)
+		}
+		if (stop-start)/step >= maxRangeValues {
+			return nil, fmt.Errorf("range %s has too many values", item)
+		}
+		// Count the steps rather than adding them up so rounding doesn't drop the last value
+		n := int(math.Floor((stop-start)/step + 1e-9))
+		for i := 0; i <= n; i++ {
+			values = append(values, formatNumber(start+float64(i)*step))
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no values given")
+	}
+	return values, nil
+}
+
+// pathStep is a single field or index in a path
+type pathStep struct {
+	field    string
+	index    int
+	wildcard bool
+}
+
+func parsePath(path, name string) ([]pathStep, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path %s has no field", name)
+	}
+	var steps []pathStep
+	for _, segment := range strings.Split(path, ".") {
+		field := segment
+		if i := strings.IndexByte(segment, '['); i >= 0 {
+			field = segment[:i]
+		}
+		if field == "" {
+			return nil, fmt.Errorf("path %s has an empty field name", name)
+		}
+		steps = append(steps, pathStep{field: field})
+
+		rest := segment[len(field):]
+		for rest != "" {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("path %s has a bad index", name)
+			}
+			idx := rest[1:end]
+			rest = rest[end+1:]
+			if idx == "*" {
+				steps = append(steps, pathStep{wildcard: true})
+				continue
+			}
+			i, err := strconv.Atoi(idx)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("path %s has a bad index %s", name, idx)
+			}
+			steps = append(steps, pathStep{index: i})
+		}
+	}
+	return steps, nil
+}
+
+// setStep walks down the decoded JSON, returning the node with the value set
+func setStep(node interface{}, steps []pathStep, value, path string) (interface{}, error) {
+	if len(steps) == 0 {
+		return setValue(node, value, path)
+	}
+	step := steps[0]
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if step.field == "" {
+			return nil, fmt.Errorf("path %s indexes something that isn't a list", path)
+		}
+		key, ok := findKey(n, step.field)
+		if !ok {
+			return nil, fmt.Errorf("path %s: no field %s", path, step.field)
+		}
+		v, err := setStep(n[key], steps[1:], value, path)
+		if err != nil {
+			return nil, err
+		}
+		n[key] = v
+		return n, nil
+
+	case []interface{}:
+		if step.field != "" {
+			return nil, fmt.Errorf("path %s: %s is a list and needs an index", path, step.field)
+		}
+		for _, i := range indexes(step, len(n)) {
+			v, err := setStep(n[i], steps[1:], value, path)
+			if err != nil {
+				return nil, err
+			}
+			n[i] = v
+		}
+		if !step.wildcard && step.index >= len(n) {
+			return nil, fmt.Errorf("path %s: index %d out of range", path, step.index)
+		}
+		return n, nil
+
+	case string:
+		// Comma-encoded row, index into its fields
+		if step.field != "" || len(steps) > 1 {
+			return nil, fmt.Errorf("path %s goes past the end of a value", path)
+		}
+		fields := strings.Split(n, ",")
+		if !step.wildcard && step.index >= len(fields) {
+			return nil, fmt.Errorf("path %s: index %d out of range", path, step.index)
+		}
+		for _, i := range indexes(step, len(fields)) {
+			v, err := setValue(strings.TrimSpace(fields[i]), value, path)
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = v.(string)
+		}
+		return strings.Join(fields, ","), nil
+	}
+	return nil, fmt.Errorf("path %s goes past the end of a value", path)
+}
+
+// indexes returns the indexes a step selects in a list of length n
+func indexes(step pathStep, n int) []int {
+	if !step.wildcard {
+		if step.index < n {
+			return []int{step.index}
+		}
+		return nil
+	}
+	all := make([]int, n)
+	for i := range all {
+		all[i] = i
+	}
+	return all
+}
+
+// findKey matches a field name, falling back to a case insensitive match
+func findKey(m map[string]interface{}, field string) (string, bool) {
+	if _, ok := m[field]; ok {
+		return field, true
+	}
+	for key := range m {
+		if strings.EqualFold(key, field) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// setValue returns the new value for a leaf, keeping the type of the current value
+func setValue(current interface{}, value, path string) (interface{}, error) {
+	switch c := current.(type) {
+	case float64:
+		return newNumber(c, value, path)
+	case string:
+		old, err := strconv.ParseFloat(strings.TrimSpace(c), 64)
+		if err != nil {
+			if isRelative(value) {
+				return nil, fmt.Errorf("path %s: can't change %s by a percentage", path, c)
+			}
+			return value, nil
+		}
+		v, err := newNumber(old, value, path)
+		if err != nil {
+			return nil, err
+		}
+		return formatNumber(v), nil
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("path %s: %s is not true or false", path, value)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("path %s does not address a single value", path)
+}
+
+func isRelative(value string) bool {
+	return strings.HasSuffix(strings.TrimSpace(value), "%")
+}
+
+// newNumber applies value to old, either replacing it or changing it by a percentage
+func newNumber(old float64, value, path string) (float64, error) {
+	value = strings.TrimSpace(value)
+	if isRelative(value) {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("path %s: %s is not a percentage", path, value)
+		}
+		return old * (1 + pct/100), nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("path %s: %s is not a number", path, value)
+	}
+	return v, nil
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(math.Round(v*1e9)/1e9, 'f', -1, 64)
+}
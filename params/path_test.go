@@ -0,0 +1,80 @@
+package params
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetPath(t *testing.T) {
+	ep := &EcoParams{
+		DiscountRate:        "0.05",
+		TraitSexPricePerCwt: []string{"WW,M,400,500,150.0", "WW,F,400,500,140.0"},
+		AumCost:             [12]float64{10, 20},
+	}
+	if err := SetPath(ep, "discountRate", "0.07"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetPath(ep, "traitSexPricePerCwt[*][4]", "+10%"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetPath(ep, "aumCost[1]", "-50%"); err != nil {
+		t.Fatal(err)
+	}
+	if ep.DiscountRate != "0.07" {
+		t.Errorf("discountRate: got %s", ep.DiscountRate)
+	}
+	if want := []string{"WW,M,400,500,165", "WW,F,400,500,154"}; !reflect.DeepEqual(ep.TraitSexPricePerCwt, want) {
+		t.Errorf("traitSexPricePerCwt: got %v want %v", ep.TraitSexPricePerCwt, want)
+	}
+	if ep.AumCost[0] != 10 || ep.AumCost[1] != 10 {
+		t.Errorf("aumCost: got %v", ep.AumCost[:2])
+	}
+
+	mp := &MasterParams{PlanningHorizon: 20}
+	if err := ApplyPath(mp, ep, "master.planningHorizon", "25"); err != nil || mp.PlanningHorizon != 25 {
+		t.Errorf("planningHorizon: got %d, %v", mp.PlanningHorizon, err)
+	}
+
+	for _, bad := range []string{"master.nothing", "eco.aumCost", "eco.aumCost[12]", "eco.discountRate.rate", "planningHorizon"} {
+		if err := ApplyPath(mp, ep, bad, "1"); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+	if err := ApplyPath(mp, ep, "master.planningHorizon", "20.5"); err == nil {
+		t.Errorf("expected an error setting an int to a fraction")
+	}
+
+	// Errors name the whole path as it was given
+	for _, bad := range []string{"eco..discountRate", "eco.aumCost[1", "eco.aumCost[x]"} {
+		if err := ApplyPath(mp, ep, bad, "1"); err == nil || !strings.Contains(err.Error(), "path "+bad+" ") {
+			t.Errorf("%s: got error %v", bad, err)
+		}
+	}
+}
+
+func TestExpandValues(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		ok   bool
+	}{
+		{"1, 2,3", []string{"1", "2", "3"}, true},
+		{"0.03:0.05:0.01", []string{"0.03", "0.04", "0.05"}, true},
+		{"10:0:-5,+10%", []string{"10", "5", "0", "+10%"}, true},
+		{"1:2", nil, false},
+		{"1:2:0", nil, false},
+		{"1:2:-1", nil, false},
+		{"", nil, false},
+	}
+	for _, test := range tests {
+		got, err := ExpandValues(test.list)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: unexpected error %v", test.list, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v want %v", test.list, got, test.want)
+		}
+	}
+}
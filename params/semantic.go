@@ -0,0 +1,319 @@
+package params
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/blgolden/igendec/schema"
+)
+
+// ChangeKind is how a parameter differs from the one it is compared with
+type ChangeKind string
+
+// Kinds of change
+const (
+	Changed ChangeKind = "changed"
+	Added   ChangeKind = "added"
+	Removed ChangeKind = "removed"
+)
+
+// Change is a single difference in a parameter file
+// For the comma-encoded tables, Item is the key of the row and Field the column that changed.
+// For the covariance matrices Item is the pair of traits. Otherwise both are empty and Path
+// is the full path to the value
+type Change struct {
+	Path  string     `json:"path"`
+	Item  string     `json:"item,omitempty"`
+	Field string     `json:"field,omitempty"`
+	Kind  ChangeKind `json:"kind"`
+	Old   string     `json:"old"`
+	New   string     `json:"new"`
+}
+
+// table describes a parameter made of comma-encoded rows
+// Rows are matched on their first keys fields rather than their position. If header is
+// set the first row names the columns, otherwise fields names the columns after the keys
+type table struct {
+	keys   int
+	header bool
+	fields []string
+}
+
+// Tables in the master parameters
+var masterTables = map[string]table{
+	"Traits":           {keys: 1, fields: []string{"mean"}},
+	"Components":       {keys: 2},
+	"BreedEffects":     {keys: 3, header: true},
+	"HeterosisCodes":   {keys: 1, fields: []string{"code"}},
+	"HeterosisValues":  {keys: 2, header: true},
+	"BreedTraitSexAod": {keys: 3, fields: []string{"age 2", "age 3", "age 4", "age 5-10", "age 11+"}},
+	"TraitAgeEffects":  {keys: 1, fields: []string{"slope", "days at mean"}},
+	"herds":            {keys: 1, fields: []string{"target cows", "breeding start", "season length", "conception rate", "calving death loss"}},
+}
+
+// Tables in the eco parameters
+var ecoTables = map[string]table{
+	"indexComponents":     {keys: 1},
+	"traitSexPricePerCwt": {keys: 4, fields: []string{"price"}},
+	"gridPremiums":        {keys: 1, fields: []string{"YG1", "YG2", "YG3", "YG4", "YG5"}},
+}
+
+// Fields left out of the diff, as they describe the job rather than the model
+var ignoredFields = map[string]bool{
+	PathPrefixMaster + "comment":           true,
+	PathPrefixMaster + "target-database":   true,
+	PathPrefixMaster + "BreedCompositions": true,
+	PathPrefixMaster + schema.Key:          true,
+	PathPrefixEco + schema.Key:             true,
+}
+
+// DefaultsFor returns the default parameters that a job with the given eco params was built from
+func DefaultsFor(ep *EcoParams) (*MasterParams, *EcoParams, error) {
+	endpoint, ok := EndpointMap[ep.SaleEndpoint]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown sale endpoint '%s'", ep.SaleEndpoint)
+	}
+	indextype := OwnReplacements
+	if ep.IndexTerminal {
+		indextype = Terminal
+	}
+
+	mp, err := DefaultMasterParams()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading default master params: %w", err)
+	}
+	def, err := DefaultEcoParams(endpoint, indextype)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading default eco params: %w", err)
+	}
+	def.IndexTerminal = ep.IndexTerminal
+	if ep.IndexTerminal {
+		mp.PlanningHorizon = TerminalPlanningHorizon(endpoint)
+	}
+	return mp, def, nil
+}
+
+// TerminalPlanningHorizon is the planning horizon offered for a terminal index,
+// which doesn't need to look much past the sale of the calves
+func TerminalPlanningHorizon(endpoint Endpoint) int {
+	if endpoint == Weaning {
+		return 1
+	}
+	return 2
+}
+
+// DiffMaster returns how other differs from base
+func DiffMaster(base, other *MasterParams) ([]Change, error) {
+	changes, err := diffDocs(base, other, PathPrefixMaster, masterTables)
+	if err != nil {
+		return nil, err
+	}
+	// Covariance matrices are labelled by the traits they are for
+	changes = append(changes, diffMatrix(PathPrefixMaster+"genetic", base.Genetic[:], other.Genetic[:], labels(other.Components, 2))...)
+	changes = append(changes, diffMatrix(PathPrefixMaster+"residual", base.Residual[:], other.Residual[:], labels(other.Traits, 1))...)
+	return changes, nil
+}
+
+// DiffEco returns how other differs from base
+func DiffEco(base, other *EcoParams) ([]Change, error) {
+	return diffDocs(base, other, PathPrefixEco, ecoTables)
+}
+
+// diffDocs compares two parameter documents, tables row by row and everything else value by value
+func diffDocs(base, other interface{}, prefix string, tables map[string]table) ([]Change, error) {
+	bFlat, bPaths, err := Flatten(base, prefix)
+	if err != nil {
+		return nil, err
+	}
+	oFlat, oPaths, err := Flatten(other, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the values of each field, so tables can be handled as a whole
+	field := func(path string) string {
+		name := strings.TrimPrefix(path, prefix)
+		if i := strings.IndexAny(name, ".["); i >= 0 {
+			name = name[:i]
+		}
+		return name
+	}
+	rows := func(flat map[string]string, paths []string, name string) []string {
+		var out []string
+		for _, p := range paths {
+			if field(p) == name {
+				out = append(out, flat[p])
+			}
+		}
+		return out
+	}
+
+	var changes []Change
+	done := make(map[string]bool)
+	for _, p := range append(oPaths, bPaths...) {
+		name := field(p)
+		if ignoredFields[prefix+name] || strings.HasPrefix(name, "genetic") || strings.HasPrefix(name, "residual") {
+			continue
+		}
+		if t, ok := tables[name]; ok {
+			if !done[name] {
+				done[name] = true
+				changes = append(changes, diffTable(prefix+name, rows(bFlat, bPaths, name), rows(oFlat, oPaths, name), t)...)
+			}
+			continue
+		}
+		if done[p] {
+			continue
+		}
+		done[p] = true
+
+		b, inBase := bFlat[p]
+		o, inOther := oFlat[p]
+		switch {
+		case !inBase:
+			changes = append(changes, Change{Path: p, Kind: Added, New: o})
+		case !inOther:
+			changes = append(changes, Change{Path: p, Kind: Removed, Old: b})
+		case !sameValue(b, o):
+			changes = append(changes, Change{Path: p, Kind: Changed, Old: b, New: o})
+		}
+	}
+	return changes, nil
+}
+
+// diffTable compares the rows of a comma-encoded table by their keys
+func diffTable(path string, base, other []string, t table) []Change {
+	bRows, bKeys, names := splitRows(base, t)
+	oRows, oKeys, oNames := splitRows(other, t)
+	if oNames != nil {
+		names = oNames
+	}
+
+	var changes []Change
+	for _, key := range oKeys {
+		o := oRows[key]
+		b, ok := bRows[key]
+		if !ok {
+			changes = append(changes, Change{Path: path, Item: key, Kind: Added, New: strings.Join(o, ",")})
+			continue
+		}
+		for i := t.keys; i < len(o) || i < len(b); i++ {
+			var bv, ov string
+			if i < len(b) {
+				bv = b[i]
+			}
+			if i < len(o) {
+				ov = o[i]
+			}
+			if !sameValue(bv, ov) {
+				changes = append(changes, Change{Path: path, Item: key, Field: columnName(names, t, i), Kind: Changed, Old: bv, New: ov})
+			}
+		}
+	}
+	for _, key := range bKeys {
+		if _, ok := oRows[key]; !ok {
+			changes = append(changes, Change{Path: path, Item: key, Kind: Removed, Old: strings.Join(bRows[key], ",")})
+		}
+	}
+	return changes
+}
+
+// splitRows splits the rows of a table into their fields and indexes them by key
+// Repeated keys are numbered so each row can still be matched
+func splitRows(rows []string, t table) (map[string][]string, []string, []string) {
+	var header []string
+	if t.header && len(rows) > 0 {
+		header, rows = splitRow(rows[0]), rows[1:]
+	}
+	byKey := make(map[string][]string)
+	var keys []string
+	for _, row := range rows {
+		fields := splitRow(row)
+		n := t.keys
+		if n > len(fields) {
+			n = len(fields)
+		}
+		key := strings.Join(fields[:n], ",")
+		for i := 2; byKey[key] != nil; i++ {
+			key = fmt.Sprintf("%s #%d", strings.Join(fields[:n], ","), i)
+		}
+		byKey[key] = fields
+		keys = append(keys, key)
+	}
+	return byKey, keys, header
+}
+
+func splitRow(row string) []string {
+	fields := strings.Split(row, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
+
+// columnName names column i of a table
+func columnName(header []string, t table, i int) string {
+	if i < len(header) {
+		return header[i]
+	}
+	if j := i - t.keys; j >= 0 && j < len(t.fields) {
+		return t.fields[j]
+	}
+	return "column " + strconv.Itoa(i+1)
+}
+
+// diffMatrix compares two symmetric matrices stored by row, only looking at the upper triangle
+// names labels the rows and columns, falling back to their numbers if it doesn't fit the matrix
+func diffMatrix(path string, base, other []float64, names []string) []Change {
+	n := len(names)
+	if n*n != len(other) {
+		names = nil
+		for n = 0; n*n < len(other); n++ {
+			names = append(names, strconv.Itoa(n+1))
+		}
+		if n*n != len(other) {
+			return nil
+		}
+	}
+
+	var changes []Change
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			b, o := base[i*n+j], other[i*n+j]
+			if b != o {
+				changes = append(changes, Change{
+					Path: path,
+					Item: names[i] + " / " + names[j],
+					Kind: Changed,
+					Old:  strconv.FormatFloat(b, 'g', -1, 64),
+					New:  strconv.FormatFloat(o, 'g', -1, 64),
+				})
+			}
+		}
+	}
+	return changes
+}
+
+// labels returns the first keys fields of each row, joined by spaces
+func labels(rows []string, keys int) []string {
+	out := make([]string, len(rows))
+	for i, row := range rows {
+		fields := splitRow(row)
+		if keys < len(fields) {
+			fields = fields[:keys]
+		}
+		out[i] = strings.Join(fields, " ")
+	}
+	return out
+}
+
+// sameValue compares two values, numerically if they are both numbers so '.90' is the same as '0.9'
+func sameValue(a, b string) bool {
+	if a == b {
+		return true
+	}
+	x, errA := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	y, errB := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	return errA == nil && errB == nil && x == y
+}
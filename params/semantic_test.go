@@ -0,0 +1,56 @@
+package params
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffEcoTables(t *testing.T) {
+	base := &EcoParams{
+		DiscountRate:        ".00",
+		TraitSexPricePerCwt: []string{"WW,S,0,400,203", "WW,S,400,500,185", "WW,F,0,400,180"},
+		GridPremiums:        []string{"Prime,8.00,7.00,6.00,-9.00,-14.00"},
+	}
+	other := &EcoParams{
+		DiscountRate: "0",
+		// Reordered, one price changed, one row removed and one added
+		TraitSexPricePerCwt: []string{"WW,S,400,500,190", "WW,S,0,400,203.0", "WW,F,400,500,170"},
+		GridPremiums:        []string{"Prime, 8, 7, 6, -9, -15"},
+	}
+
+	changes, err := DiffEco(base, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Path: "eco.gridPremiums", Item: "Prime", Field: "YG5", Kind: Changed, Old: "-14.00", New: "-15"},
+		{Path: "eco.traitSexPricePerCwt", Item: "WW,S,400,500", Field: "price", Kind: Changed, Old: "185", New: "190"},
+		{Path: "eco.traitSexPricePerCwt", Item: "WW,F,400,500", Kind: Added, New: "WW,F,400,500,170"},
+		{Path: "eco.traitSexPricePerCwt", Item: "WW,F,0,400", Kind: Removed, Old: "WW,F,0,400,180"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %+v\nwant %+v", changes, want)
+	}
+}
+
+func TestDiffMasterMatrix(t *testing.T) {
+	base := &MasterParams{Traits: []string{"WW, 545", "YW, 850"}}
+	other := &MasterParams{Traits: []string{"WW, 545", "YW, 850"}}
+	base.BreedEffects = []string{"Trait,Effect,Type,Angus,Hereford", "WW,D,Calf,0,1.5"}
+	other.BreedEffects = []string{"Trait,Effect,Type,Angus,Hereford", "WW,D,Calf,0,2"}
+	// Residual is 15x15, so the two traits don't label it and it falls back to numbers
+	other.Residual[1] = 0.3
+	other.Residual[15] = 0.3
+
+	changes, err := DiffMaster(base, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Path: "master.BreedEffects", Item: "WW,D,Calf", Field: "Hereford", Kind: Changed, Old: "1.5", New: "2"},
+		{Path: "master.residual", Item: "1 / 2", Kind: Changed, Old: "0", New: "0.3"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %+v\nwant %+v", changes, want)
+	}
+}
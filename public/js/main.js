@@ -1,3 +1,18 @@
+// Requests that change anything carry the CSRF token of the session
+// Ajax requests send it as a header, forms posted without ajax as a field
+function CSRFToken(){
+    return $('meta[name="csrf-token"]').attr('content')
+}
+
+$.ajaxSetup({
+    headers: { 'X-CSRF-Token': CSRFToken() }
+});
+
+$(document).on('submit', 'form', function() {
+    if ($(this).attr('method') && $(this).attr('method').toUpperCase() == 'POST' && !$(this).find('input[name="_csrf"]').length)
+        $('<input type="hidden" name="_csrf">').val(CSRFToken()).appendTo(this)
+});
+
 // A common pattern used for submitting data/forms on this website
 // It requires the html elements to be set up in a certain way
 // returns the request so custom handlers can be added
@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"sync"
+
+	"github.com/blgolden/igendec/users"
+)
+
+// eventBuffer is how many events a slow subscriber can fall behind before events are dropped
+const eventBuffer = 16
+
+// Event is sent to subscribers when one of their jobs changes status
+type Event struct {
+	Job    string          `json:"job"`
+	Status users.JobStatus `json:"status"`
+}
+
+// broker fans out job events to the subscribers of each user
+type broker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Event]struct{}
+}
+
+// Subscribe returns a channel that receives an event every time one of the users jobs changes status
+// The returned function must be called once the subscriber is finished with the channel
+func (q *Queue) Subscribe(username string) (<-chan Event, func()) {
+	b := &q.events
+	ch := make(chan Event, eventBuffer)
+
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[string]map[chan Event]struct{})
+	}
+	if b.subs[username] == nil {
+		b.subs[username] = make(map[chan Event]struct{})
+	}
+	b.subs[username][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[username], ch)
+		if len(b.subs[username]) == 0 {
+			delete(b.subs, username)
+		}
+	}
+}
+
+// publish sends the event to everyone subscribed to the jobs user
+// Never blocks, subscribers that have fallen behind miss the event
+func (q *Queue) publish(job *users.Job, status users.JobStatus) {
+	b := &q.events
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ev := Event{Job: job.Name, Status: status}
+	for ch := range b.subs[job.Username()] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blgolden/igendec/users"
+)
+
+func TestSubscribe(t *testing.T) {
+	r := newStubRunner()
+	close(r.release)
+	jobs := newTestJobs(t, r, "a")
+	q := newTestQueue(t, Config{Workers: 1, Size: 1})
+
+	events, unsubscribe := q.Subscribe("bob")
+	defer unsubscribe()
+	others, unsubscribeOthers := q.Subscribe("alice")
+	defer unsubscribeOthers()
+
+	if err := q.Submit(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []users.JobStatus{users.Queued, users.Processing, users.Passed} {
+		select {
+		case ev := <-events:
+			if ev.Job != "a" || ev.Status != want {
+				t.Errorf("got event %+v, want a %s", ev, want)
+			}
+		case <-time.After(waitTime):
+			t.Fatalf("no %s event", want)
+		}
+	}
+	if len(others) != 0 {
+		t.Errorf("another user got %d events", len(others))
+	}
+}
+
+func TestPublishDropsEvents(t *testing.T) {
+	q := &Queue{}
+	job := newTestJobs(t, newStubRunner(), "a")[0]
+	events, unsubscribe := q.Subscribe("bob")
+	defer unsubscribe()
+
+	// Nothing reads events, so once the buffer is full the rest are dropped
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*eventBuffer; i++ {
+			q.publish(job, users.Queued)
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(waitTime):
+		t.Fatal("publish blocked on a full subscriber")
+	}
+	if len(events) != eventBuffer {
+		t.Errorf("got %d buffered events, want %d", len(events), eventBuffer)
+	}
+
+	// Unsubscribed channels get nothing
+	unsubscribe()
+	for len(events) > 0 {
+		<-events
+	}
+	q.publish(job, users.Passed)
+	if len(events) != 0 {
+		t.Error("got an event after unsubscribing")
+	}
+}
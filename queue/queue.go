@@ -0,0 +1,298 @@
+// Package queue runs submitted jobs in the background on a bounded pool of workers
+// so that requests can return as soon as a job has been accepted
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/users"
+)
+
+// Queue errors
+var (
+	ErrQueueFull   = errors.New("job queue is full")
+	ErrQueueClosed = errors.New("job queue is closed")
+	ErrNotRunning  = errors.New("job is not queued or running")
+	ErrJobActive   = errors.New("job is already queued or running")
+)
+
+// Config holds the settings for a queue
+type Config struct {
+	// Workers is the number of jobs that can run at the same time
+	Workers int
+
+	// Size is the number of jobs that can be waiting before Submit starts refusing jobs, at least 1
+	Size int
+
+	// Timeout is the longest a job can run for before it is killed
+	// Zero means jobs can run forever
+	Timeout time.Duration
+
+	// DatabasePath is passed to every job run
+	DatabasePath string
+
+	// Requeue records jobs stopped by Close as queued, so they run again on the next start
+	// Otherwise they are marked as failed
+	Requeue bool
+}
+
+// Queue holds jobs waiting to be run and the workers that run them
+type Queue struct {
+	jobs chan *users.Job
+	cfg  Config
+
+	mu        sync.Mutex
+	closed    bool
+	pending   map[string]int                // number of times a job is waiting on the queue
+	cancelled map[string]int                // number of waiting entries to skip for a job
+	running   map[string]context.CancelFunc // cancels a running job
+	stopped   map[string]bool               // running jobs stopped by Close
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	events broker
+}
+
+// New returns a queue with its workers running
+func New(cfg Config) *Queue {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	// Submit needs room in the channel, so one job can always wait
+	if cfg.Size < 1 {
+		cfg.Size = 1
+	}
+	q := &Queue{
+		jobs:      make(chan *users.Job, cfg.Size),
+		cfg:       cfg,
+		pending:   make(map[string]int),
+		cancelled: make(map[string]int),
+		running:   make(map[string]context.CancelFunc),
+		stopped:   make(map[string]bool),
+		done:      make(chan struct{}),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// key identifies a job across users
+func key(job *users.Job) string {
+	return job.Username() + "/" + job.Name
+}
+
+// Submit marks the job as queued and hands it to the workers
+// Returns straight away, the job is run when a worker becomes free.
+// A job can only be on the queue once, ErrJobActive is returned if it is waiting or running
+func (q *Queue) Submit(job *users.Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	k := key(job)
+	if _, ok := q.running[k]; ok || q.pending[k] > q.cancelled[k] {
+		return ErrJobActive
+	}
+	// Only Submit sends on the channel and it holds the lock, so there will still be room below
+	if len(q.jobs) == cap(q.jobs) {
+		return ErrQueueFull
+	}
+	if err := job.MarkQueued(); err != nil {
+		return fmt.Errorf("marking job as queued: %w", err)
+	}
+
+	q.jobs <- job
+	q.pending[k]++
+	q.publish(job, users.Queued)
+	return nil
+}
+
+// Cancel stops a job. A running job has its process killed, and a waiting job
+// is taken off the queue. Either way the job is recorded as cancelled
+func (q *Queue) Cancel(job *users.Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	k := key(job)
+	if cancel, ok := q.running[k]; ok {
+		cancel()
+		return nil
+	}
+
+	// Jobs can be flagged as queued without being on this queue, so only
+	// skip the entries we know about
+	if q.pending[k] == 0 && job.Status != users.Queued {
+		return ErrNotRunning
+	}
+	q.cancelled[k] = q.pending[k]
+	if err := job.MarkCancelled(); err != nil {
+		return err
+	}
+	q.publish(job, users.Cancelled)
+	return nil
+}
+
+// Activity is a snapshot of the queue, the jobs are user/job
+type Activity struct {
+	Workers int
+	Size    int
+	Running []string
+	Waiting []string
+}
+
+// Activity returns the jobs running and waiting to run, for every user
+func (q *Queue) Activity() Activity {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	a := Activity{Workers: q.cfg.Workers, Size: q.cfg.Size}
+	for k := range q.running {
+		a.Running = append(a.Running, k)
+	}
+	for k, n := range q.pending {
+		if n > q.cancelled[k] {
+			a.Waiting = append(a.Waiting, k)
+		}
+	}
+	sort.Strings(a.Running)
+	sort.Strings(a.Waiting)
+	return a
+}
+
+// Close stops the queue accepting jobs, stops the running jobs and waits for them to finish
+// Jobs that were still waiting are left recorded as queued, to be recovered on the next start.
+// Running jobs are recorded as queued or failed, depending on Config.Requeue
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.done)
+	for k, cancel := range q.running {
+		q.stopped[k] = true
+		cancel()
+	}
+	q.mu.Unlock()
+
+	q.wg.Wait()
+
+	if waiting := len(q.Activity().Waiting); waiting > 0 {
+		logger.Warn("%d jobs were not run before shutting down", waiting)
+	}
+}
+
+// work runs jobs off the queue until it is closed
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for {
+		var job *users.Job
+		select {
+		case <-q.done:
+			return
+		case job = <-q.jobs:
+		}
+
+		ctx, ok := q.start(job)
+		if !ok {
+			continue
+		}
+
+		logger.Info("running job '%s' for user '%s'", job.Name, job.Username())
+		err := job.Run(ctx, q.cfg.DatabasePath)
+		stopped := q.finish(job)
+		if stopped && errors.Is(err, users.ErrJobCancelled) {
+			q.interrupted(job)
+			continue
+		}
+		q.publish(job, job.CurrentStatus())
+
+		switch {
+		case errors.Is(err, users.ErrJobCancelled):
+			logger.Info("job '%s' for user '%s' was cancelled", job.Name, job.Username())
+		case errors.Is(err, users.ErrJobTimedOut):
+			logger.Warn("job '%s' for user '%s' timed out after %s", job.Name, job.Username(), q.cfg.Timeout)
+		case err != nil:
+			logger.Warn("job '%s' for user '%s' failed: %s", job.Name, job.Username(), err)
+		default:
+			logger.Info("job '%s' for user '%s' finished", job.Name, job.Username())
+		}
+	}
+}
+
+// start takes a job off the waiting list and registers it as running
+// Returns false if the job was cancelled while it was waiting, or the queue has been closed.
+// A worker can still be handed a job after Close, as select picks between ready channels at random
+func (q *Queue) start(job *users.Job) (context.Context, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	k := key(job)
+	if q.pending[k]--; q.pending[k] <= 0 {
+		delete(q.pending, k)
+	}
+	if q.cancelled[k] > 0 {
+		if q.cancelled[k]--; q.cancelled[k] == 0 {
+			delete(q.cancelled, k)
+		}
+		return nil, false
+	}
+	if q.closed {
+		return nil, false
+	}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if q.cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), q.cfg.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	q.running[k] = cancel
+	q.publish(job, users.Processing)
+	return ctx, true
+}
+
+// finish removes a job from the running jobs, and returns true if it was stopped by Close
+func (q *Queue) finish(job *users.Job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	k := key(job)
+	if cancel, ok := q.running[k]; ok {
+		cancel()
+		delete(q.running, k)
+	}
+	stopped := q.stopped[k]
+	delete(q.stopped, k)
+	return stopped
+}
+
+// interrupted records a job that was stopped by Close the way RecoverJobs would have
+// if the server had died, rather than as cancelled by the user
+func (q *Queue) interrupted(job *users.Job) {
+	if q.cfg.Requeue {
+		logger.Info("job '%s' for user '%s' was stopped by the shutdown and will run again on the next start", job.Name, job.Username())
+		if err := job.MarkQueued(); err != nil {
+			logger.Warn("marking job '%s' for user '%s' as queued: %s", job.Name, job.Username(), err)
+		}
+		return
+	}
+	logger.Info("job '%s' for user '%s' was stopped by the shutdown", job.Name, job.Username())
+	if err := job.MarkFailed(users.ErrJobOrphaned); err != nil {
+		logger.Warn("marking job '%s' for user '%s' as failed: %s", job.Name, job.Username(), err)
+	}
+}
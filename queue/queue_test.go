@@ -0,0 +1,278 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blgolden/igendec/params"
+	"github.com/blgolden/igendec/users"
+)
+
+// waitTime is the longest a test waits for the queue to do something
+const waitTime = 5 * time.Second
+
+// stubRunner is a runner that holds each run until it is released or its context ends,
+// released runs write simulated output
+type stubRunner struct {
+	started chan string   // the output file of each run, as it starts
+	release chan struct{} // each receive lets one run finish, closing it lets every run finish
+}
+
+func newStubRunner() *stubRunner {
+	return &stubRunner{started: make(chan string, 16), release: make(chan struct{})}
+}
+
+func (r *stubRunner) Run(ctx context.Context, spec users.RunSpec) error {
+	r.started <- spec.OutputFile
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.release:
+		return (&users.SimulatedRunner{}).Run(ctx, spec)
+	}
+}
+
+func (r *stubRunner) CommandLine(spec users.RunSpec) string { return "stub" }
+
+// waitStarted waits for the runner to start a run
+func (r *stubRunner) waitStarted(t *testing.T) {
+	t.Helper()
+	select {
+	case <-r.started:
+	case <-time.After(waitTime):
+		t.Fatal("no run started")
+	}
+}
+
+// newTestJobs points users at an empty database with r as the runner, and creates
+// jobs of the given names for the user bob
+func newTestJobs(t *testing.T, r users.Runner, names ...string) []*users.Job {
+	t.Helper()
+	path, typ, runner := users.UsersPath, users.DatabaseType, users.JobRunner
+	users.UsersPath, users.DatabaseType, users.JobRunner = t.TempDir(), users.DatabaseLocal, r
+	users.Init()
+	t.Cleanup(func() {
+		users.Close()
+		users.UsersPath, users.DatabaseType, users.JobRunner = path, typ, runner
+	})
+
+	mp, err := params.MasterParamsFromFile("../defaultMaster.hjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := params.EcoParamsFromFile("../defaultEcoWeaning.hjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := users.NewUser("bob")
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+	var jobs []*users.Job
+	for _, name := range names {
+		job, err := user.CreateJob(name, mp, ep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// newTestQueue returns a queue that is closed when the test ends
+func newTestQueue(t *testing.T, cfg Config) *Queue {
+	t.Helper()
+	q := New(cfg)
+	t.Cleanup(q.Close)
+	return q
+}
+
+// waitStatus waits for the job to be recorded with the status, and returns its state
+func waitStatus(t *testing.T, job *users.Job, want users.JobStatus) *users.JobState {
+	t.Helper()
+	deadline := time.Now().Add(waitTime)
+	for {
+		state, err := job.ReadState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Status == want {
+			return state
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s: got status %s, want %s", job.Name, state.Status, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	r := newStubRunner()
+	close(r.release)
+	jobs := newTestJobs(t, r, "a")
+	q := newTestQueue(t, Config{Workers: 1, Size: 1})
+
+	if err := q.Submit(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	state := waitStatus(t, jobs[0], users.Passed)
+	if state.Queued.IsZero() || state.Started.IsZero() || state.Finished.IsZero() || state.Error != "" {
+		t.Errorf("got state %+v", state)
+	}
+	if status := jobs[0].CurrentStatus(); status != users.Passed {
+		t.Errorf("got status %s, want passed", status)
+	}
+}
+
+func TestSubmitRefused(t *testing.T) {
+	r := newStubRunner()
+	jobs := newTestJobs(t, r, "a", "b", "c")
+	q := newTestQueue(t, Config{Workers: 1, Size: 1})
+
+	// a runs and b waits, which fills the queue
+	if err := q.Submit(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	r.waitStarted(t)
+	if err := q.Submit(jobs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Submit(jobs[2]); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("full queue: got %v, want ErrQueueFull", err)
+	}
+
+	// A job can't be queued again while it is running or waiting
+	for _, job := range jobs[:2] {
+		if err := q.Submit(job); !errors.Is(err, ErrJobActive) {
+			t.Errorf("job %s again: got %v, want ErrJobActive", job.Name, err)
+		}
+	}
+
+	close(r.release)
+	waitStatus(t, jobs[1], users.Passed)
+	q.Close()
+	if err := q.Submit(jobs[2]); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("closed queue: got %v, want ErrQueueClosed", err)
+	}
+}
+
+func TestCloseStopsRunningJobs(t *testing.T) {
+	for _, tc := range []struct {
+		requeue bool
+		status  users.JobStatus
+		err     string
+	}{
+		{true, users.Queued, ""},
+		{false, users.Failed, users.ErrJobOrphaned.Error()},
+	} {
+		r := newStubRunner()
+		jobs := newTestJobs(t, r, "running", "waiting")
+		q := New(Config{Workers: 1, Size: 1, Requeue: tc.requeue})
+
+		if err := q.Submit(jobs[0]); err != nil {
+			t.Fatal(err)
+		}
+		r.waitStarted(t)
+		if err := q.Submit(jobs[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		// The runner is never released, Close has to stop it
+		closed := make(chan struct{})
+		go func() {
+			q.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(waitTime):
+			t.Fatal("Close didn't stop the running job")
+		}
+
+		state, err := jobs[0].ReadState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Status != tc.status || state.Error != tc.err {
+			t.Errorf("requeue %t: got running job %s %q, want %s %q", tc.requeue, state.Status, state.Error, tc.status, tc.err)
+		}
+		// Waiting jobs are left for RecoverJobs either way
+		if status := jobs[1].CurrentStatus(); status != users.Queued {
+			t.Errorf("requeue %t: got waiting job %s, want queued", tc.requeue, status)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	r := newStubRunner()
+	jobs := newTestJobs(t, r, "running", "waiting", "next")
+	q := newTestQueue(t, Config{Workers: 1, Size: 2})
+
+	for _, job := range jobs[:2] {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.waitStarted(t)
+
+	// A waiting job is cancelled straight away, and taken off the queue
+	if err := q.Cancel(jobs[1]); err != nil {
+		t.Fatal(err)
+	}
+	state := waitStatus(t, jobs[1], users.Cancelled)
+	if state.Error != users.ErrJobCancelled.Error() || !state.Started.IsZero() {
+		t.Errorf("cancelled waiting job: got state %+v", state)
+	}
+
+	// A running job is stopped
+	if err := q.Cancel(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	state = waitStatus(t, jobs[0], users.Cancelled)
+	if state.Error != users.ErrJobCancelled.Error() || state.Finished.IsZero() {
+		t.Errorf("cancelled running job: got state %+v", state)
+	}
+
+	// The worker moves on to the next job, without running the cancelled one
+	if err := q.Submit(jobs[2]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case output := <-r.started:
+		// A local database runs the job in its own directory
+		if job := filepath.Base(filepath.Dir(output)); job != jobs[2].Name {
+			t.Errorf("got a run of job %s, want %s", job, jobs[2].Name)
+		}
+	case <-time.After(waitTime):
+		t.Fatal("the next job didn't start")
+	}
+	close(r.release)
+	waitStatus(t, jobs[2], users.Passed)
+	if status := jobs[1].CurrentStatus(); status != users.Cancelled {
+		t.Errorf("got cancelled waiting job %s after the queue moved on", status)
+	}
+
+	if err := q.Cancel(jobs[2]); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("cancelling a finished job: got %v, want ErrNotRunning", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	r := newStubRunner()
+	jobs := newTestJobs(t, r, "slow")
+	q := newTestQueue(t, Config{Workers: 1, Timeout: 50 * time.Millisecond})
+
+	if err := q.Submit(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	state := waitStatus(t, jobs[0], users.TimedOut)
+	if state.Error != users.ErrJobTimedOut.Error() || state.Finished.IsZero() {
+		t.Errorf("got state %+v", state)
+	}
+	if status := jobs[0].CurrentStatus(); status != users.TimedOut {
+		t.Errorf("got status %s, want timed-out", status)
+	}
+}
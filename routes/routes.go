@@ -12,6 +12,7 @@ func RegisterRoutes(app *fiber.App, h *controllers.Handler) {
 	Create(app, h)
 	Jobs(app, h)
 	Profile(app, h)
+	Admin(app, h)
 }
 
 // Main has all the default routes
@@ -20,11 +21,18 @@ func Main(app *fiber.App, h *controllers.Handler) {
 
 	app.Get("/signin", h.SignIn)
 	app.Post("/signin", h.SignIn)
+	app.Post("/signin/2fa", h.SignInTwoFactor)
 
 	app.Get("/signout", h.SignOut)
 
 	app.Get("/register", h.Register)
 	app.Post("/register", h.Register)
+
+	app.Get("/forgot", h.Forgot)
+	app.Post("/forgot", h.Forgot)
+	app.Get("/reset", h.Reset)
+	app.Post("/reset", h.Reset)
+	app.Get("/verify", h.Verify)
 }
 
 // Create routes
@@ -45,6 +53,15 @@ func Profile(app *fiber.App, h *controllers.Handler) {
 	app.Post("/updateprofile", h.UpdateProfile)
 
 	app.Post("/updatepassword", h.UpdatePassword)
+
+	app.Post("/profile/sessions/revoke", h.RevokeSession)
+
+	app.Post("/profile/verify", h.ResendVerification)
+
+	app.Post("/profile/2fa/setup", h.TwoFactorSetup)
+	app.Post("/profile/2fa/enable", h.TwoFactorEnable)
+	app.Post("/profile/2fa/recovery", h.TwoFactorRecovery)
+	app.Post("/profile/2fa/disable", h.TwoFactorDisable)
 }
 
 // Jobs routes
@@ -52,11 +69,54 @@ func Jobs(app *fiber.App, h *controllers.Handler) {
 	jobs := app.Group("/jobs")
 	jobs.Get("/", h.Jobs)
 	jobs.Get("/info", h.JobsInfo)
+	jobs.Get("/events", h.JobsEvents)
 	jobs.Get("/download", h.JobsDownload)
+	jobs.Get("/log", h.JobsLog)
 	jobs.Delete("/delete", h.JobsDelete)
+	jobs.Get("/trash", h.JobsTrash)
+	jobs.Post("/trash/restore", h.JobsTrashRestore)
+	jobs.Delete("/trash/purge", h.JobsTrashPurge)
+	jobs.Post("/cancel", h.JobsCancel)
+
+	jobs.Get("/batch", h.Batches)
+	jobs.Post("/batch", h.BatchesCreate)
+	jobs.Get("/batch/info", h.BatchesInfo)
+	jobs.Get("/batch/download", h.BatchesDownload)
+
+	jobs.Get("/diff", h.JobsDiff)
+	jobs.Get("/diff/data", h.JobsDiffData)
+
+	jobs.Get("/compare", h.JobsCompare)
+	jobs.Get("/compare/data", h.JobsCompareData)
+
+	jobs.Get("/sensitivity", h.JobsSensitivity)
+	jobs.Post("/sensitivity", h.JobsSensitivityCreate)
+	jobs.Get("/sensitivity/download", h.JobsSensitivityDownload)
 
 	jobs.Get("/select", h.JobsSelect)
 	jobs.Get("/select/database", h.JobsSelectDatabase)
 	jobs.Get("/select/database/icon", h.GetIconForDatabase)
 	jobs.Post("/select/database/compare", h.JobsSelectDatabaseCompare)
 }
+
+// Admin routes
+func Admin(app *fiber.App, h *controllers.Handler) {
+	admin := app.Group("/admin", h.AdminOnly)
+	admin.Get("/", h.Admin)
+	admin.Get("/users", h.AdminUsers)
+	admin.Get("/user", h.AdminUser)
+	admin.Post("/user/role", h.AdminUserRole)
+	admin.Post("/user/access", h.AdminUserAccess)
+	admin.Post("/user/disable", h.AdminUserDisable)
+	admin.Get("/jobs", h.AdminJobs)
+	admin.Get("/job", h.AdminJob)
+	admin.Get("/job/log", h.AdminJobLog)
+	admin.Get("/job/download", h.AdminJobDownload)
+	admin.Get("/backup", h.AdminBackup)
+	admin.Get("/quota", h.AdminQuota)
+	admin.Post("/quota", h.AdminQuotaUpdate)
+	admin.Get("/audit", h.AdminAudit)
+	admin.Get("/audit/export", h.AdminAuditExport)
+	admin.Get("/lockouts", h.AdminLockouts)
+	admin.Post("/lockouts/unlock", h.AdminLockoutsUnlock)
+}
@@ -0,0 +1,41 @@
+package schema
+
+// migrations of every kind of document, in order
+// Add new migrations to the end of a list, the version of the kind goes up by one for each
+var migrations = map[Kind][]Migration{
+	Profile: {
+		{Kind: Profile, From: 0, Description: "users without an access list can use every database", Upgrade: defaultAccess},
+	},
+	MasterParams: {
+		{Kind: MasterParams, From: 0, Description: "first versioned master parameters"},
+	},
+	EcoParams: {
+		{Kind: EcoParams, From: 0, Description: "first versioned eco parameters"},
+	},
+	JobOutput: {
+		{Kind: JobOutput, From: 0, Description: "first versioned job output"},
+	},
+	JobState: {
+		{Kind: JobState, From: 0, Description: "first versioned job state"},
+	},
+	Batch: {
+		{Kind: Batch, From: 0, Description: "batches from before there were kinds are sweeps", Upgrade: sweepKind},
+	},
+}
+
+// defaultAccess gives a profile without an access list access to everything, which used to be
+// assumed when it was read
+func defaultAccess(doc map[string]interface{}) error {
+	if access, ok := doc["Access"].([]interface{}); !ok || len(access) == 0 {
+		doc["Access"] = []interface{}{map[string]interface{}{"Path": "*", "Deny": false}}
+	}
+	return nil
+}
+
+// sweepKind sets the kind of batches that were made before sensitivity analyses
+func sweepKind(doc map[string]interface{}) error {
+	if kind, _ := doc["Kind"].(string); kind == "" {
+		doc["Kind"] = "sweep"
+	}
+	return nil
+}
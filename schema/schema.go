@@ -0,0 +1,103 @@
+// Package schema versions the documents iGenDec keeps and upgrades old ones as they are read
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hjson/hjson-go"
+)
+
+// Kind is a type of document that is versioned
+type Kind string
+
+// Kinds of document
+const (
+	Profile      Kind = "profile"
+	MasterParams Kind = "master params"
+	EcoParams    Kind = "eco params"
+	JobOutput    Kind = "job output"
+	JobState     Kind = "job state"
+	Batch        Kind = "batch"
+)
+
+// Key is the field holding the version of a document
+// Documents from before there were versions don't have it and are version 0
+const Key = "schemaVersion"
+
+// ErrTooNew is returned for documents written by a newer version of iGenDec
+var ErrTooNew = errors.New("document is from a newer version")
+
+// Migration upgrades a document of Kind from version From to From+1
+// Upgrade changes the parsed document in place, and can be nil if only the version changes
+type Migration struct {
+	Kind        Kind
+	From        int
+	Description string
+	Upgrade     func(doc map[string]interface{}) error
+}
+
+// Current returns the version documents of kind are written with
+func Current(kind Kind) int {
+	return len(migrations[kind])
+}
+
+// Migrations returns the migrations for kind, oldest first
+func Migrations(kind Kind) []Migration {
+	return migrations[kind]
+}
+
+// Version returns the version of a parsed document
+func Version(doc map[string]interface{}) int {
+	for k, v := range doc {
+		if strings.EqualFold(k, Key) {
+			if n, ok := v.(float64); ok {
+				return int(n)
+			}
+		}
+	}
+	return 0
+}
+
+// Upgrade brings a parsed document up to the current version, returning the version it was
+func Upgrade(kind Kind, doc map[string]interface{}) (int, error) {
+	from := Version(doc)
+	if from > Current(kind) {
+		return from, fmt.Errorf("%w: %s version %d, this server reads up to %d", ErrTooNew, kind, from, Current(kind))
+	}
+	for _, m := range migrations[kind][from:] {
+		if m.Upgrade == nil {
+			continue
+		}
+		if err := m.Upgrade(doc); err != nil {
+			return from, fmt.Errorf("upgrading %s from version %d: %w", kind, m.From, err)
+		}
+	}
+
+	// The structs decode field names without caring for case, so only keep one spelling
+	for k := range doc {
+		if strings.EqualFold(k, Key) {
+			delete(doc, k)
+		}
+	}
+	doc[Key] = Current(kind)
+	return from, nil
+}
+
+// Decode parses a hjson document into v, upgrading it on the way
+func Decode(kind Kind, data []byte, v interface{}) error {
+	doc := make(map[string]interface{})
+	if err := hjson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if _, err := Upgrade(kind, doc); err != nil {
+		return err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,71 @@
+package schema
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	for kind, list := range migrations {
+		for i, m := range list {
+			if m.Kind != kind || m.From != i {
+				t.Errorf("%s migration %d is for %s version %d", kind, i, m.Kind, m.From)
+			}
+		}
+	}
+}
+
+func TestUpgradeVersion0(t *testing.T) {
+	doc := map[string]interface{}{"Username": "bob"}
+	from, err := Upgrade(Profile, doc)
+	if err != nil || from != 0 {
+		t.Fatalf("got version %d, %v", from, err)
+	}
+	want := map[string]interface{}{
+		"Username": "bob",
+		"Access":   []interface{}{map[string]interface{}{"Path": "*", "Deny": false}},
+		Key:        Current(Profile),
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("got %v, want %v", doc, want)
+	}
+
+	// An access list that was set is kept
+	access := []interface{}{map[string]interface{}{"Path": "angus/*", "Deny": false}}
+	doc = map[string]interface{}{"Access": access}
+	if _, err = Upgrade(Profile, doc); err != nil || !reflect.DeepEqual(doc["Access"], access) {
+		t.Errorf("got %v, %v, want access %v", doc["Access"], err, access)
+	}
+}
+
+func TestUpgradeCurrent(t *testing.T) {
+	// Structs are written with the field name, it is still read as the version
+	doc := map[string]interface{}{"SchemaVersion": float64(Current(Batch)), "Kind": "sensitivity"}
+	if from, err := Upgrade(Batch, doc); err != nil || from != Current(Batch) {
+		t.Fatalf("got version %d, %v", from, err)
+	}
+	want := map[string]interface{}{"Kind": "sensitivity", Key: Current(Batch)}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("got %v, want %v", doc, want)
+	}
+
+	doc = map[string]interface{}{Key: float64(Current(Batch) + 1)}
+	if _, err := Upgrade(Batch, doc); !errors.Is(err, ErrTooNew) {
+		t.Errorf("newer document: got %v, want ErrTooNew", err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var batch struct {
+		Kind          string
+		Name          string
+		SchemaVersion int
+	}
+	if err := Decode(Batch, []byte("{\n  Name: old\n}"), &batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Kind != "sweep" || batch.Name != "old" || batch.SchemaVersion != Current(Batch) {
+		t.Errorf("got %+v", batch)
+	}
+}
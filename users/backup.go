@@ -0,0 +1,282 @@
+package users
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blgolden/igendec/logger"
+)
+
+// SnapshotVersion is the version of the snapshot format written by Backup
+// Restore refuses snapshots from a newer version than it knows
+const SnapshotVersion = 1
+
+// SnapshotManifest is the last entry of a snapshot, describing everything before it
+// Files maps each file to the hex sha256 of its contents
+type SnapshotManifest struct {
+	Version      int
+	Created      time.Time
+	DatabaseType string
+	Users        int
+	Files        map[string]string
+}
+
+// Name of the manifest in a snapshot
+const snapshotManifest = "manifest.json"
+
+// Snapshot errors
+var (
+	ErrSnapshotCorrupt = errors.New("snapshot is corrupt")
+	ErrSnapshotVersion = errors.New("snapshot is from a newer version")
+)
+
+// Backup writes a gzipped tar snapshot of the whole database to w
+// Files are named by where they are in the local database, so snapshots can be restored to either type.
+// The files of each user are read from a consistent view, so it is safe to run while the server is running
+func Backup(w io.Writer) (*SnapshotManifest, error) {
+	manifest := &SnapshotManifest{
+		Version:      SnapshotVersion,
+		Created:      time.Now().UTC(),
+		DatabaseType: DatabaseType,
+		Files:        make(map[string]string),
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	users := make(map[string]bool)
+	err := database.Snapshot(func(name string, data []byte) error {
+		user, _, err := splitSnapshotName(name)
+		if err != nil {
+			logger.Warn("backing up: leaving out unexpected file '%s'", name)
+			return nil
+		}
+		users[user] = true
+		sum := sha256.Sum256(data)
+		manifest.Files[name] = hex.EncodeToString(sum[:])
+		return writeTarFile(tw, name, data, manifest.Created)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading database: %w", err)
+	}
+	manifest.Users = len(users)
+
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	if err = writeTarFile(tw, snapshotManifest, data, manifest.Created); err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, gz.Close()
+}
+
+// VerifySnapshot reads through a snapshot checking every file against the manifest
+func VerifySnapshot(filename string) (*SnapshotManifest, error) {
+	sums := make(map[string]string)
+	manifest, err := readSnapshot(filename, func(name string, data []byte) error {
+		sum := sha256.Sum256(data)
+		sums[name] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Version > SnapshotVersion {
+		return nil, fmt.Errorf("%w: version %d, this server reads up to %d", ErrSnapshotVersion, manifest.Version, SnapshotVersion)
+	}
+	if len(sums) != len(manifest.Files) {
+		return nil, fmt.Errorf("%w: has %d files, the manifest lists %d", ErrSnapshotCorrupt, len(sums), len(manifest.Files))
+	}
+	for name, sum := range manifest.Files {
+		if sums[name] != sum {
+			return nil, fmt.Errorf("%w: checksum of '%s' does not match", ErrSnapshotCorrupt, name)
+		}
+	}
+	return manifest, nil
+}
+
+// Restore replaces the database in UsersPath with the snapshot at filename
+// The snapshot is verified and restored to a new database before anything is replaced.
+// The old database is kept next to the new one. The server must not be running
+func Restore(filename string) (*SnapshotManifest, error) {
+	manifest, err := VerifySnapshot(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Restore to a new database next to the live one, which is then swapped in
+	var (
+		db           Database
+		staged, live string
+	)
+	suffix := ".before-restore-" + time.Now().Format("20060102-150405")
+	switch DatabaseType {
+	case DatabaseBolt:
+		live = filepath.Join(UsersPath, BoltFilename)
+		staged = live + ".restore"
+		// Fails if the server has the database open
+		if _, err := os.Stat(live); err == nil {
+			current, err := NewBoltDatabase(live)
+			if err != nil {
+				return nil, fmt.Errorf("%w, is the server still running?", err)
+			}
+			current.Close()
+		}
+		os.Remove(staged)
+		if db, err = NewBoltDatabase(staged); err != nil {
+			return nil, err
+		}
+	default:
+		live = filepath.Join(UsersPath, PrefixUsers)
+		dir := filepath.Join(UsersPath, ".restore")
+		staged = filepath.Join(dir, PrefixUsers)
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+		db = NewLocalDatabase(dir)
+	}
+
+	_, err = readSnapshot(filename, db.RestoreFile)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(staged)
+		return nil, fmt.Errorf("restoring snapshot: %w", err)
+	}
+
+	live = strings.TrimRight(live, "/")
+	if err = os.Rename(live, live+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("moving old database aside: %w", err)
+	}
+	if err = os.Rename(staged, live); err != nil {
+		os.Rename(live+suffix, live)
+		return nil, fmt.Errorf("moving restored database into place: %w", err)
+	}
+	return manifest, nil
+}
+
+// readSnapshot calls fn with every file in the snapshot and returns its manifest
+func readSnapshot(filename string, fn func(name string, data []byte) error) (*SnapshotManifest, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotCorrupt, err)
+	}
+	tr := tar.NewReader(gz)
+	var manifest *SnapshotManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrSnapshotCorrupt, err)
+		}
+		if manifest != nil {
+			return nil, fmt.Errorf("%w: files after the manifest", ErrSnapshotCorrupt)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%w: '%s' is not a regular file", ErrSnapshotCorrupt, hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrSnapshotCorrupt, err)
+		}
+
+		if hdr.Name == snapshotManifest {
+			manifest = &SnapshotManifest{}
+			if err = json.Unmarshal(data, manifest); err != nil {
+				return nil, fmt.Errorf("%w: parsing manifest: %s", ErrSnapshotCorrupt, err)
+			}
+			continue
+		}
+		if _, _, err = splitSnapshotName(hdr.Name); err != nil {
+			return nil, err
+		}
+		if err = fn(hdr.Name, data); err != nil {
+			return nil, err
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: no manifest, the snapshot may be truncated", ErrSnapshotCorrupt)
+	}
+	return manifest, gz.Close()
+}
+
+// splitSnapshotName checks the name of a file in a snapshot, returning the user it belongs to and
+// its path within the user, eg: 'users/bob/jobs/weaning/output.hjson' is bob's 'jobs/weaning/output.hjson'
+// Jobs in the trash are kept the same way under 'trash/'
+func splitSnapshotName(name string) (string, []string, error) {
+	parts := strings.Split(name, "/")
+	if path.Clean(name) != name || len(parts) < 3 || parts[0]+"/" != PrefixUsers {
+		return "", nil, fmt.Errorf("%w: unexpected file '%s'", ErrSnapshotCorrupt, name)
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return "", nil, fmt.Errorf("%w: unexpected file '%s'", ErrSnapshotCorrupt, name)
+		}
+	}
+	rest := parts[2:]
+	switch {
+	case len(rest) == 1:
+	case len(rest) == 2 && rest[0]+"/" == PrefixBatches:
+	case len(rest) == 3 && (rest[0]+"/" == PrefixJobs || rest[0]+"/" == PrefixTrash):
+	default:
+		return "", nil, fmt.Errorf("%w: unexpected file '%s'", ErrSnapshotCorrupt, name)
+	}
+	return parts[1], rest, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// regularFiles returns the names of the regular files in dir, leaving out
+// the temporary files of writes in progress
+func regularFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !isTempFile(entry.Name()) {
+			files = append(files, entry.Name())
+		}
+	}
+	return files, nil
+}
+
+// isTempFile returns true for the temporary files made by writeFileAtomic
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp")
+}
@@ -0,0 +1,60 @@
+package users
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	path, typ := UsersPath, DatabaseType
+	t.Cleanup(func() { UsersPath, DatabaseType = path, typ })
+
+	newTestUser(t)
+	database.WriteJobFile("bob", "weaning", FileJobOutput, []byte("output"))
+	database.SetBatch("bob", &Batch{Name: "sweep", Base: "weaning"})
+
+	buf := &bytes.Buffer{}
+	manifest, err := Backup(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Users != 1 || len(manifest.Files) != 4 {
+		t.Errorf("got %d users and %d files, want 1 and 4", manifest.Users, len(manifest.Files))
+	}
+	snapshot := filepath.Join(t.TempDir(), "backup.tar.gz")
+	os.WriteFile(snapshot, buf.Bytes(), 0644)
+
+	// A flipped byte or a missing end is caught before anything is replaced
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	for name, data := range map[string][]byte{"flipped": corrupt, "truncated": buf.Bytes()[:buf.Len()/2]} {
+		bad := filepath.Join(t.TempDir(), name+".tar.gz")
+		os.WriteFile(bad, data, 0644)
+		if _, err := VerifySnapshot(bad); !errors.Is(err, ErrSnapshotCorrupt) {
+			t.Errorf("%s snapshot: got %v, want %v", name, err, ErrSnapshotCorrupt)
+		}
+	}
+
+	// Snapshots of a local database can be restored to bolt
+	UsersPath, DatabaseType = t.TempDir(), DatabaseBolt
+	if _, err = Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewBoltDatabase(filepath.Join(UsersPath, BoltFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Get("bob"); err != nil {
+		t.Errorf("getting restored user: %s", err)
+	}
+	if data, err := db.ReadJobFile("bob", "weaning", FileJobOutput); string(data) != "output" {
+		t.Errorf("restored output: got %q, %v", data, err)
+	}
+	if _, err = db.GetBatch("bob", "sweep"); err != nil {
+		t.Errorf("getting restored batch: %s", err)
+	}
+}
@@ -0,0 +1,313 @@
+package users
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/params"
+	"github.com/blgolden/igendec/schema"
+)
+
+// MaxBatchJobs is the most child jobs a single batch can create
+var MaxBatchJobs = 100
+
+// Batch errors
+var (
+	ErrBadSweep       = errors.New("bad sweep")
+	ErrBatchTooLarge  = errors.New("batch has too many jobs")
+	ErrBatchJobActive = errors.New("a job in the batch is already queued or running")
+	ErrBatchExists    = errors.New("a batch or job of the same name already exists")
+	ErrJobNotQueued   = errors.New("the job couldn't be queued, run it again from the create page")
+)
+
+// BatchKind is how the child jobs of a batch were made
+type BatchKind string
+
+// Kinds of batch
+const (
+	BatchSweep       BatchKind = "sweep"       // every combination of the sweep values
+	BatchSensitivity BatchKind = "sensitivity" // each sweep value on its own
+)
+
+// Sweep is one parameter that is varied across a batch
+// Path is a parameter path as understood by params.ApplyPath, Name is an optional label for it
+type Sweep struct {
+	Name   string `json:",omitempty"`
+	Path   string
+	Values []string
+}
+
+// BatchJob is a child job of a batch, and the value used for each sweep
+type BatchJob struct {
+	Name   string
+	Values []string
+}
+
+// Batch is a set of jobs made from a base job by varying some of its parameters
+type Batch struct {
+	user    *User
+	Kind    BatchKind
+	Name    string
+	Base    string
+	Sweeps  []Sweep
+	Jobs    []BatchJob
+	Created time.Time
+
+	SchemaVersion int
+}
+
+// Bytes returns the batch record as it is stored
+func (b *Batch) Bytes() ([]byte, error) {
+	b.SchemaVersion = schema.Current(schema.Batch)
+	return json.MarshalIndent(b, "", "    ")
+}
+
+// parseBatch parses a stored batch record, upgrading records from older versions
+func parseBatch(data []byte) (*Batch, error) {
+	b := &Batch{}
+	if err := schema.Decode(schema.Batch, data, b); err != nil {
+		return nil, fmt.Errorf("parsing batch: %w", err)
+	}
+	return b, nil
+}
+
+// CreateBatch creates the child jobs for a sweep and saves the batch
+// One child job is created for every combination of the sweep values. The jobs are returned
+// to be queued by the caller. An existing batch or job of the same name is only replaced if overwrite is set
+func (u *User) CreateBatch(name, base string, sweeps []Sweep, overwrite bool) (*Batch, []*Job, error) {
+	if len(sweeps) == 0 {
+		return nil, nil, fmt.Errorf("%w: no parameters to vary", ErrBadSweep)
+	}
+	total := 1
+	for _, s := range sweeps {
+		if len(s.Values) == 0 {
+			return nil, nil, fmt.Errorf("%w: no values for %s", ErrBadSweep, s.Path)
+		}
+		total *= len(s.Values)
+		if total > MaxBatchJobs {
+			return nil, nil, fmt.Errorf("%w: the most allowed is %d", ErrBatchTooLarge, MaxBatchJobs)
+		}
+	}
+
+	// Step through the combinations like an odometer, the last sweep changing fastest
+	combinations := make([][]string, total)
+	choice := make([]int, len(sweeps))
+	for n := range combinations {
+		combinations[n] = make([]string, len(sweeps))
+		for i, s := range sweeps {
+			combinations[n][i] = s.Values[choice[i]]
+		}
+		for i := len(choice) - 1; i >= 0; i-- {
+			if choice[i]++; choice[i] < len(sweeps[i].Values) {
+				break
+			}
+			choice[i] = 0
+		}
+	}
+
+	b := &Batch{user: u, Kind: BatchSweep, Name: name, Base: base, Sweeps: sweeps, Created: time.Now()}
+	jobs, err := u.createBatch(b, combinations, overwrite)
+	return b, jobs, err
+}
+
+// createBatch creates a child job of b for each combination of values, and saves the batch
+// An empty value leaves that parameter as it is in the base job. The parameters of every child
+// are worked out before anything is written, so a bad path or value leaves nothing behind.
+// Unless overwrite is set, an existing batch or job of the same name as any child is an ErrBatchExists
+func (u *User) createBatch(b *Batch, combinations [][]string, overwrite bool) ([]*Job, error) {
+	type child struct {
+		mp *params.MasterParams
+		ep *params.EcoParams
+	}
+	children := make([]child, len(combinations))
+
+	for n, values := range combinations {
+		mp, ep, err := u.GetJobParams(b.Base)
+		if err != nil {
+			return nil, fmt.Errorf("getting base job parameters: %w", err)
+		}
+
+		bj := BatchJob{Name: fmt.Sprintf("%s-%03d", b.Name, n+1), Values: values}
+		var desc []string
+		for i, s := range b.Sweeps {
+			if values[i] == "" {
+				continue
+			}
+			if err = params.ApplyPath(mp, ep, s.Path, values[i]); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrBadSweep, err)
+			}
+			desc = append(desc, s.Path+" = "+values[i])
+		}
+		mp.Comment = strings.TrimSpace(fmt.Sprintf("Batch %s from %s: %s\n%s", b.Name, b.Base, strings.Join(desc, ", "), mp.Comment))
+
+		if existing, err := u.GetJob(bj.Name); err == nil && existing.InProgress() {
+			return nil, fmt.Errorf("%w: %s", ErrBatchJobActive, bj.Name)
+		}
+		if _, err := database.ListJobFiles(u.Username, bj.Name); err == nil && !overwrite {
+			return nil, fmt.Errorf("%w: %s", ErrBatchExists, bj.Name)
+		}
+
+		b.Jobs = append(b.Jobs, bj)
+		children[n] = child{mp, ep}
+	}
+
+	if _, err := database.GetBatch(u.Username, b.Name); err == nil && !overwrite {
+		return nil, fmt.Errorf("%w: %s", ErrBatchExists, b.Name)
+	}
+
+	newJobs := 0
+	for _, bj := range b.Jobs {
+		if _, err := database.ListJobFiles(u.Username, bj.Name); err != nil {
+			newJobs++
+		}
+	}
+	if err := u.CheckQuota(newJobs, len(children)); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, len(children))
+	for n, c := range children {
+		job, err := u.CreateJob(b.Jobs[n].Name, c.mp, c.ep)
+		if err != nil {
+			return nil, fmt.Errorf("creating job '%s': %w", b.Jobs[n].Name, err)
+		}
+		jobs[n] = job
+	}
+
+	if err := database.SetBatch(u.Username, b); err != nil {
+		return nil, fmt.Errorf("saving batch: %w", err)
+	}
+	return jobs, nil
+}
+
+// SubmitJobs hands each job to submit in turn, and returns how many it took
+// At the first job submit refuses, that job and the rest are marked as failed with ErrJobNotQueued,
+// so the children of a batch aren't left without a state
+func SubmitJobs(jobs []*Job, submit func(*Job) error) (int, error) {
+	for n, job := range jobs {
+		err := submit(job)
+		if err == nil {
+			continue
+		}
+		reason := fmt.Errorf("%w: %s", ErrJobNotQueued, err)
+		for _, rest := range jobs[n:] {
+			if markErr := rest.MarkFailed(reason); markErr != nil {
+				logger.Warn("marking job '%s' for user '%s' as failed: %s", rest.Name, rest.user.Username, markErr)
+			}
+		}
+		return n, err
+	}
+	return len(jobs), nil
+}
+
+// GetBatch returns the batch with the given name
+func (u *User) GetBatch(name string) (*Batch, error) {
+	b, err := database.GetBatch(u.Username, name)
+	if err != nil {
+		return nil, err
+	}
+	b.user = u
+	return b, nil
+}
+
+// ListBatches returns the names of the users batches
+func (u *User) ListBatches() []string {
+	return database.ListBatches(u.Username)
+}
+
+// Paths returns the path of each sweep in the batch
+func (b *Batch) Paths() []string {
+	paths := make([]string, len(b.Sweeps))
+	for i, s := range b.Sweeps {
+		paths[i] = s.Path
+	}
+	return paths
+}
+
+// BatchTable is the merged MEVs of every job in a batch
+// Columns are the index elements, in the order they were first seen
+type BatchTable struct {
+	Paths   []string
+	Columns []string
+	Rows    []BatchRow
+}
+
+// BatchRow is the result of one child job in a batch
+// MEVs line up with the table columns, and are empty where the job has no value
+type BatchRow struct {
+	Job    string
+	Status JobStatus
+	Values []string
+	MEVs   []string
+}
+
+// Table merges the outputs of the child jobs into a single table
+// Jobs that are still running or have been deleted are included without MEVs
+func (b *Batch) Table() *BatchTable {
+	t := &BatchTable{Paths: b.Paths()}
+	columns := make(map[string]int)
+
+	type result struct {
+		status JobStatus
+		mevs   map[string]string
+	}
+	results := make([]result, len(b.Jobs))
+	for n, bj := range b.Jobs {
+		results[n] = result{status: Failed, mevs: make(map[string]string)}
+		job, err := b.user.GetJob(bj.Name)
+		if err != nil {
+			continue
+		}
+		results[n].status = job.Status
+		for _, el := range job.Output {
+			if _, ok := columns[el.Key()]; !ok {
+				columns[el.Key()] = len(t.Columns)
+				t.Columns = append(t.Columns, el.Trait.String()+" "+el.Component.String())
+			}
+			results[n].mevs[el.Key()] = el.DisplayMEV
+		}
+	}
+
+	for n, bj := range b.Jobs {
+		row := BatchRow{Job: bj.Name, Status: results[n].status, Values: bj.Values, MEVs: make([]string, len(t.Columns))}
+		for key, mev := range results[n].mevs {
+			row.MEVs[columns[key]] = mev
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t
+}
+
+// WriteCSV writes the table as CSV, one row per job
+func (t *BatchTable) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := append([]string{"Job", "Status"}, t.Paths...)
+	if err := cw.Write(append(header, t.Columns...)); err != nil {
+		return err
+	}
+	for _, row := range t.Rows {
+		record := append([]string{row.Job, string(row.Status)}, row.Values...)
+		if err := cw.Write(append(record, row.MEVs...)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Count returns how many jobs in the table have the given status
+func (t *BatchTable) Count(status JobStatus) int {
+	var n int
+	for _, row := range t.Rows {
+		if row.Status == status {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,69 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/blgolden/igendec/params"
+)
+
+// newTestJobs creates jobs of the given names for user from the default parameters
+func newTestJobs(t *testing.T, user *User, names ...string) []*Job {
+	t.Helper()
+	mp, err := params.MasterParamsFromFile("../defaultMaster.hjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := params.EcoParamsFromFile("../defaultEcoWeaning.hjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobs []*Job
+	for _, name := range names {
+		job, err := user.CreateJob(name, mp, ep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func TestSubmitJobs(t *testing.T) {
+	user := newTestUser(t)
+	jobs := newTestJobs(t, user, "a", "b", "c")
+
+	// The queue takes one job and is then full
+	full := errors.New("job queue is full")
+	taken := 0
+	submit := func(job *Job) error {
+		if taken == 1 {
+			return full
+		}
+		taken++
+		return job.MarkQueued()
+	}
+	n, err := SubmitJobs(jobs, submit)
+	if n != 1 || !errors.Is(err, full) {
+		t.Fatalf("got %d submitted, %v, want 1, %v", n, err, full)
+	}
+
+	if status := jobs[0].CurrentStatus(); status != Queued {
+		t.Errorf("got submitted job %s, want queued", status)
+	}
+	want := fmt.Errorf("%w: %s", ErrJobNotQueued, full).Error()
+	for _, job := range jobs[1:] {
+		state, err := job.ReadState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Status != Failed || state.Error != want || state.Finished.IsZero() {
+			t.Errorf("job %s: got state %+v, want failed with %q", job.Name, state, want)
+		}
+	}
+
+	if n, err = SubmitJobs(jobs[:0], submit); n != 0 || err != nil {
+		t.Errorf("no jobs: got %d submitted, %v", n, err)
+	}
+}
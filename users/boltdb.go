@@ -0,0 +1,666 @@
+package users
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blgolden/igendec/params"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltFilename is the name of the bolt database in UsersPath
+const BoltFilename = "igendec.db"
+
+// Buckets of the bolt database
+// Each user has a bucket in users holding their files, with nested buckets for their jobs, batches
+// and trash. Jobs in the trash are kept the same way as jobs. Sessions have a bucket of their own
+var (
+	bucketUsers    = []byte("users")
+	bucketJobs     = []byte("jobs")
+	bucketBatches  = []byte("batches")
+	bucketTrash    = []byte("trash")
+	bucketSessions = []byte("sessions")
+)
+
+// BoltDatabase is an implementation of Database that keeps everything in a single bolt file
+// Every change is a transaction, so readers never see half a write. Jobs are run in a
+// working directory that is copied in and out of the database
+type BoltDatabase struct {
+	db      *bolt.DB
+	workdir string // where jobs are checked out to run
+	dirperm os.FileMode
+}
+
+// NewBoltDatabase opens, or creates, the bolt database at filename
+// Only one process can have the database open, others wait a short time then fail
+func NewBoltDatabase(filename string) (*BoltDatabase, error) {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening '%s': %w", filename, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketUsers); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketSessions)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDatabase{db: db, workdir: filepath.Join(dir, "work"), dirperm: 0755}, nil
+}
+
+// Get returns a user
+func (db *BoltDatabase) Get(username string) (*User, error) {
+	data, err := db.readUserFile(username, FileProfileFilename)
+	if err != nil {
+		return nil, ErrUserDoesntExist
+	}
+	return NewUserFromBytes(data)
+}
+
+// Create makes a new user
+func (db *BoltDatabase) Create(user *User) error {
+	data, err := user.Bytes()
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		if users.Bucket([]byte(user.Username)) != nil {
+			return ErrUserExists
+		}
+		b, err := users.CreateBucket([]byte(user.Username))
+		if err != nil {
+			return err
+		}
+		if _, err = b.CreateBucket(bucketJobs); err != nil {
+			return err
+		}
+		return b.Put([]byte(FileProfileFilename), data)
+	})
+}
+
+// Update takes in the details of a user and overwrites the current profile entry
+func (db *BoltDatabase) Update(user *User) error {
+	data, err := user.Bytes()
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUsers).Bucket([]byte(user.Username))
+		if b == nil {
+			return ErrUserDoesntExist
+		}
+		return b.Put([]byte(FileProfileFilename), data)
+	})
+}
+
+// ListUsers returns the usernames of every user in the database
+func (db *BoltDatabase) ListUsers() []string {
+	var usernames []string
+	db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+			if v == nil {
+				usernames = append(usernames, string(k))
+			}
+			return nil
+		})
+	})
+	return usernames
+}
+
+// GetIndexParams returns the master params for the user
+func (db *BoltDatabase) GetIndexParams(user string) (*params.MasterParams, error) {
+	data, err := db.readUserFile(user, FileMasterFilename)
+	if err != nil {
+		return nil, err
+	}
+	return params.MasterParamsFromBytes(data)
+}
+
+// SetMasterParams writes the given index params to the database
+func (db *BoltDatabase) SetMasterParams(user string, ip *params.MasterParams) error {
+	data, err := ip.Bytes()
+	if err != nil {
+		return err
+	}
+	return db.writeUserFile(user, FileMasterFilename, data)
+}
+
+// GetEcoParams returns the eco params for the user
+func (db *BoltDatabase) GetEcoParams(user string) (*params.EcoParams, error) {
+	data, err := db.readUserFile(user, FileEcoFilename)
+	if err != nil {
+		return nil, err
+	}
+	return params.EcoParamsFromBytes(data)
+}
+
+// SetEcoParams writes the given eco params to the database
+func (db *BoltDatabase) SetEcoParams(user string, ep *params.EcoParams) error {
+	data, err := ep.Bytes()
+	if err != nil {
+		return err
+	}
+	return db.writeUserFile(user, FileEcoFilename, data)
+}
+
+// ListJobs returns a list of the jobs a user has
+func (db *BoltDatabase) ListJobs(user string) []string {
+	var jobs []string
+	db.db.View(func(tx *bolt.Tx) error {
+		b := userBucket(tx, user, bucketJobs)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				jobs = append(jobs, string(k))
+			}
+			return nil
+		})
+	})
+	return jobs
+}
+
+// DeleteJob will remove the given job if it exists
+func (db *BoltDatabase) DeleteJob(user, job string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		b := userBucket(tx, user, bucketJobs)
+		if b == nil || b.Bucket([]byte(job)) == nil {
+			return nil
+		}
+		return b.DeleteBucket([]byte(job))
+	})
+}
+
+// ReadJobFile returns the contents of a job file
+func (db *BoltDatabase) ReadJobFile(user, job, file string) ([]byte, error) {
+	var data []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		b := jobBucket(tx, user, job)
+		if b == nil {
+			return notExist(user, string(bucketJobs), job, file)
+		}
+		v := b.Get([]byte(file))
+		if v == nil {
+			return notExist(user, string(bucketJobs), job, file)
+		}
+		// Values are only valid for the life of the transaction
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+// WriteJobFile replaces a job file, creating the job if it doesn't exist
+func (db *BoltDatabase) WriteJobFile(user, job, file string, data []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		u := tx.Bucket(bucketUsers).Bucket([]byte(user))
+		if u == nil {
+			return ErrUserDoesntExist
+		}
+		jobs, err := u.CreateBucketIfNotExists(bucketJobs)
+		if err != nil {
+			return err
+		}
+		b, err := jobs.CreateBucketIfNotExists([]byte(job))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(file), data)
+	})
+}
+
+// RemoveJobFile removes a job file, it is not an error if it doesn't exist
+func (db *BoltDatabase) RemoveJobFile(user, job, file string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		if b := jobBucket(tx, user, job); b != nil {
+			return b.Delete([]byte(file))
+		}
+		return nil
+	})
+}
+
+// ListJobFiles returns the names of the files a job has
+func (db *BoltDatabase) ListJobFiles(user, job string) ([]string, error) {
+	var files []string
+	err := db.db.View(func(tx *bolt.Tx) error {
+		b := jobBucket(tx, user, job)
+		if b == nil {
+			return notExist(user, string(bucketJobs), job)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			files = append(files, string(k))
+			return nil
+		})
+	})
+	return files, err
+}
+
+// JobsSize returns the total size of the files of a users jobs, including those in the trash
+func (db *BoltDatabase) JobsSize(user string) (int64, error) {
+	var size int64
+	err := db.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketJobs, bucketTrash} {
+			jobs := userBucket(tx, user, name)
+			if jobs == nil {
+				continue
+			}
+			err := jobs.ForEach(func(job, v []byte) error {
+				if v != nil {
+					return nil
+				}
+				return jobs.Bucket(job).ForEach(func(k, v []byte) error {
+					size += int64(len(v))
+					return nil
+				})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return size, err
+}
+
+// CheckoutJob writes the job files to a new working directory
+func (db *BoltDatabase) CheckoutJob(user, job string) (string, error) {
+	if err := os.MkdirAll(db.workdir, db.dirperm); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(db.workdir, user+"-"+job+"-")
+	if err != nil {
+		return "", err
+	}
+	files, err := db.ListJobFiles(user, job)
+	if err == nil {
+		for _, file := range files {
+			var data []byte
+			if data, err = db.ReadJobFile(user, job, file); err != nil {
+				break
+			}
+			if err = os.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// CheckinJob stores the files in the working directory against the job in one transaction
+// and removes the directory
+func (db *BoltDatabase) CheckinJob(user, job, dir string) error {
+	defer os.RemoveAll(dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	files := make(map[string][]byte)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if files[entry.Name()], err = os.ReadFile(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		b := jobBucket(tx, user, job)
+		if b == nil {
+			// The job was deleted while it ran
+			return nil
+		}
+		for name, data := range files {
+			if err := b.Put([]byte(name), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TrashJob moves a job to the trash
+func (db *BoltDatabase) TrashJob(user, job, id string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		jobs := userBucket(tx, user, bucketJobs)
+		if jobs == nil || jobs.Bucket([]byte(job)) == nil {
+			return notExist(user, string(bucketJobs), job)
+		}
+		trash, err := tx.Bucket(bucketUsers).Bucket([]byte(user)).CreateBucketIfNotExists(bucketTrash)
+		if err != nil {
+			return err
+		}
+		return moveBucket(jobs, []byte(job), trash, []byte(id))
+	})
+}
+
+// RestoreJob moves a job out of the trash
+func (db *BoltDatabase) RestoreJob(user, id, job string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		trash := userBucket(tx, user, bucketTrash)
+		if trash == nil || trash.Bucket([]byte(id)) == nil {
+			return notExist(user, string(bucketTrash), id)
+		}
+		jobs, err := tx.Bucket(bucketUsers).Bucket([]byte(user)).CreateBucketIfNotExists(bucketJobs)
+		if err != nil {
+			return err
+		}
+		if jobs.Bucket([]byte(job)) != nil {
+			return ErrJobExists
+		}
+		return moveBucket(trash, []byte(id), jobs, []byte(job))
+	})
+}
+
+// PurgeJob removes a job from the trash for good
+func (db *BoltDatabase) PurgeJob(user, id string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		trash := userBucket(tx, user, bucketTrash)
+		if trash == nil || trash.Bucket([]byte(id)) == nil {
+			return nil
+		}
+		return trash.DeleteBucket([]byte(id))
+	})
+}
+
+// ListTrash returns the ids of the jobs in a users trash
+func (db *BoltDatabase) ListTrash(user string) []string {
+	var ids []string
+	db.db.View(func(tx *bolt.Tx) error {
+		b := userBucket(tx, user, bucketTrash)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+	})
+	return ids
+}
+
+// ReadTrashFile returns the contents of a file of a job in the trash
+func (db *BoltDatabase) ReadTrashFile(user, id, file string) ([]byte, error) {
+	var data []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var v []byte
+		if trash := userBucket(tx, user, bucketTrash); trash != nil {
+			if b := trash.Bucket([]byte(id)); b != nil {
+				v = b.Get([]byte(file))
+			}
+		}
+		if v == nil {
+			return notExist(user, string(bucketTrash), id, file)
+		}
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+// GetBatch reads a batch record
+func (db *BoltDatabase) GetBatch(user, name string) (*Batch, error) {
+	var data []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var v []byte
+		if b := userBucket(tx, user, bucketBatches); b != nil {
+			v = b.Get([]byte(name))
+		}
+		if v == nil {
+			return notExist(user, string(bucketBatches), name)
+		}
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseBatch(data)
+}
+
+// SetBatch writes a batch record, replacing any with the same name
+func (db *BoltDatabase) SetBatch(user string, b *Batch) error {
+	data, err := b.Bytes()
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		u := tx.Bucket(bucketUsers).Bucket([]byte(user))
+		if u == nil {
+			return ErrUserDoesntExist
+		}
+		batches, err := u.CreateBucketIfNotExists(bucketBatches)
+		if err != nil {
+			return err
+		}
+		return batches.Put([]byte(b.Name), data)
+	})
+}
+
+// ListBatches returns the names of a users batches
+func (db *BoltDatabase) ListBatches(user string) []string {
+	var batches []string
+	db.db.View(func(tx *bolt.Tx) error {
+		b := userBucket(tx, user, bucketBatches)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			batches = append(batches, string(k))
+			return nil
+		})
+	})
+	return batches
+}
+
+// GetSession reads a session record
+func (db *BoltDatabase) GetSession(key string) (*Session, error) {
+	var s *Session
+	err := db.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketSessions).Get([]byte(key))
+		if v == nil {
+			return notExist(string(bucketSessions), key)
+		}
+		var err error
+		s, err = parseSession(v)
+		return err
+	})
+	return s, err
+}
+
+// SetSession writes a session record
+func (db *BoltDatabase) SetSession(s *Session) error {
+	data, err := s.Bytes()
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).Put([]byte(s.Key), data)
+	})
+}
+
+// DeleteSession removes a session record, it is not an error if it doesn't exist
+func (db *BoltDatabase) DeleteSession(key string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).Delete([]byte(key))
+	})
+}
+
+// ListSessions returns every session record
+func (db *BoltDatabase) ListSessions() ([]*Session, error) {
+	var sessions []*Session
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).ForEach(func(k, v []byte) error {
+			s, err := parseSession(v)
+			if err != nil {
+				return fmt.Errorf("reading session '%s': %w", k, err)
+			}
+			sessions = append(sessions, s)
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+// Snapshot calls fn with every file in the database from a single read transaction
+func (db *BoltDatabase) Snapshot(fn func(name string, data []byte) error) error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUsers).ForEach(func(user, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			u := tx.Bucket(bucketUsers).Bucket(user)
+			prefix := PrefixUsers + string(user) + "/"
+			return u.ForEach(func(k, v []byte) error {
+				switch {
+				case v != nil:
+					return fn(prefix+string(k), v)
+				case string(k) == string(bucketBatches):
+					return u.Bucket(k).ForEach(func(name, data []byte) error {
+						return fn(prefix+PrefixBatches+string(name)+".hjson", data)
+					})
+				case string(k) == string(bucketJobs), string(k) == string(bucketTrash):
+					jobs := u.Bucket(k)
+					return jobs.ForEach(func(job, v []byte) error {
+						if v != nil {
+							return nil
+						}
+						return jobs.Bucket(job).ForEach(func(file, data []byte) error {
+							return fn(prefix+string(k)+"/"+string(job)+"/"+string(file), data)
+						})
+					})
+				}
+				return nil
+			})
+		})
+	})
+}
+
+// RestoreFile writes a file to the database
+func (db *BoltDatabase) RestoreFile(name string, data []byte) error {
+	user, rest, err := splitSnapshotName(name)
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		u, err := tx.Bucket(bucketUsers).CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+		jobs, err := u.CreateBucketIfNotExists(bucketJobs)
+		if err != nil {
+			return err
+		}
+		switch len(rest) {
+		case 1:
+			return u.Put([]byte(rest[0]), data)
+		case 2:
+			batches, err := u.CreateBucketIfNotExists(bucketBatches)
+			if err != nil {
+				return err
+			}
+			return batches.Put([]byte(strings.TrimSuffix(rest[1], ".hjson")), data)
+		}
+		if rest[0]+"/" == PrefixTrash {
+			if jobs, err = u.CreateBucketIfNotExists(bucketTrash); err != nil {
+				return err
+			}
+		}
+		job, err := jobs.CreateBucketIfNotExists([]byte(rest[1]))
+		if err != nil {
+			return err
+		}
+		return job.Put([]byte(rest[2]), data)
+	})
+}
+
+// Close closes the bolt file
+func (db *BoltDatabase) Close() error {
+	return db.db.Close()
+}
+
+// readUserFile returns one of the files kept directly against a user
+func (db *BoltDatabase) readUserFile(user, file string) ([]byte, error) {
+	var data []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var v []byte
+		if b := tx.Bucket(bucketUsers).Bucket([]byte(user)); b != nil {
+			v = b.Get([]byte(file))
+		}
+		if v == nil {
+			return notExist(user, file)
+		}
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+// writeUserFile replaces one of the files kept directly against a user
+func (db *BoltDatabase) writeUserFile(user, file string, data []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUsers).Bucket([]byte(user))
+		if b == nil {
+			return ErrUserDoesntExist
+		}
+		return b.Put([]byte(file), data)
+	})
+}
+
+// userBucket returns a nested bucket of a user, nil if either doesn't exist
+func userBucket(tx *bolt.Tx, user string, name []byte) *bolt.Bucket {
+	u := tx.Bucket(bucketUsers).Bucket([]byte(user))
+	if u == nil {
+		return nil
+	}
+	return u.Bucket(name)
+}
+
+// jobBucket returns the bucket of a job, nil if it doesn't exist
+func jobBucket(tx *bolt.Tx, user, job string) *bolt.Bucket {
+	jobs := userBucket(tx, user, bucketJobs)
+	if jobs == nil {
+		return nil
+	}
+	return jobs.Bucket([]byte(job))
+}
+
+// moveBucket moves the files of a job bucket to a new bucket, which mustn't exist, in another
+func moveBucket(from *bolt.Bucket, name []byte, to *bolt.Bucket, newName []byte) error {
+	dst, err := to.CreateBucket(newName)
+	if err != nil {
+		return err
+	}
+	err = from.Bucket(name).ForEach(func(k, v []byte) error {
+		return dst.Put(append([]byte(nil), k...), append([]byte(nil), v...))
+	})
+	if err != nil {
+		return err
+	}
+	return from.DeleteBucket(name)
+}
+
+// notExist is the error for something that isn't in the database, named by the buckets leading to it
+func notExist(names ...string) error {
+	return &os.PathError{Op: "read", Path: path.Join(names...), Err: os.ErrNotExist}
+}
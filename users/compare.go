@@ -0,0 +1,104 @@
+package users
+
+import (
+	"fmt"
+
+	"github.com/blgolden/igendec/params"
+)
+
+// Comparison lines up the results and parameters of several jobs
+// Differences are worked out against the first job
+type Comparison struct {
+	Jobs     []string            `json:"jobs"`
+	Statuses []JobStatus         `json:"statuses"`
+	Elements []ComparisonElement `json:"elements"`
+	Params   []params.Difference `json:"params"`
+}
+
+// ComparisonElement is an index element across every job, matched by IndexElement.Key
+type ComparisonElement struct {
+	Key    string            `json:"key"`
+	Label  string            `json:"label"`
+	Values []ComparisonValue `json:"values"`
+}
+
+// ComparisonValue is an index element of one job, and how it differs from the first job
+// Present is false if the job has no result for this element
+type ComparisonValue struct {
+	Present         bool    `json:"present"`
+	MEV             float64 `json:"mev"`
+	Emphasis        float64 `json:"emphasis"`
+	Correlation     float64 `json:"correlation"`
+	MEVDiff         float64 `json:"mevDiff"`
+	EmphasisDiff    float64 `json:"emphasisDiff"`
+	CorrelationDiff float64 `json:"correlationDiff"`
+}
+
+// CompareJobs compares the given jobs
+func (u *User) CompareJobs(names []string) (*Comparison, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no jobs to compare")
+	}
+
+	cmp := &Comparison{Jobs: names, Statuses: make([]JobStatus, len(names))}
+	masters := make([]interface{}, len(names))
+	ecos := make([]interface{}, len(names))
+	index := make(map[string]int)
+
+	for i, name := range names {
+		job, err := u.GetJob(name)
+		if err != nil {
+			return nil, fmt.Errorf("getting job '%s': %w", name, err)
+		}
+		cmp.Statuses[i] = job.Status
+
+		mp, ep, err := u.GetJobParams(name)
+		if err != nil {
+			return nil, fmt.Errorf("getting parameters of job '%s': %w", name, err)
+		}
+		masters[i], ecos[i] = mp, ep
+
+		for _, el := range job.Output {
+			idx, ok := index[el.Key()]
+			if !ok {
+				idx = len(cmp.Elements)
+				index[el.Key()] = idx
+				cmp.Elements = append(cmp.Elements, ComparisonElement{
+					Key:    el.Key(),
+					Label:  el.Trait.String() + " " + el.Component.String(),
+					Values: make([]ComparisonValue, len(names)),
+				})
+			}
+			cmp.Elements[idx].Values[i] = ComparisonValue{
+				Present:     true,
+				MEV:         el.MarginalEconomicValue,
+				Emphasis:    el.Emphasis,
+				Correlation: el.Correlation,
+			}
+		}
+	}
+
+	for _, el := range cmp.Elements {
+		first := el.Values[0]
+		for i := range el.Values {
+			v := &el.Values[i]
+			if !v.Present || !first.Present {
+				continue
+			}
+			v.MEVDiff = v.MEV - first.MEV
+			v.EmphasisDiff = v.Emphasis - first.Emphasis
+			v.CorrelationDiff = v.Correlation - first.Correlation
+		}
+	}
+
+	diffs, err := params.Diff(params.PathPrefixMaster, masters...)
+	if err != nil {
+		return nil, fmt.Errorf("comparing master params: %w", err)
+	}
+	cmp.Params = diffs
+	if diffs, err = params.Diff(params.PathPrefixEco, ecos...); err != nil {
+		return nil, fmt.Errorf("comparing eco params: %w", err)
+	}
+	cmp.Params = append(cmp.Params, diffs...)
+	return cmp, nil
+}
@@ -0,0 +1,98 @@
+package users
+
+import (
+	"math"
+	"testing"
+
+	"github.com/blgolden/igendec/params"
+)
+
+func TestCompareJobs(t *testing.T) {
+	user := newTestUser(t)
+	jobs := newTestJobs(t, user, "a", "c")
+	mp, ep, err := user.GetJobParams("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.Comment = "changed"
+	b, err := user.CreateJob("b", mp, ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a and b share WW, MW is only in a and STAY only in b, c is waiting to run
+	passJobOutput(t, jobs[0],
+		IndexElement{Trait: TraitWW, Component: ComponentDirect, MarginalEconomicValue: 2, Emphasis: 0.5, Correlation: 0.1},
+		IndexElement{Trait: TraitMW, Component: ComponentMaternal, MarginalEconomicValue: -1, Emphasis: 0.3, Correlation: 0.2},
+	)
+	passJobOutput(t, b,
+		IndexElement{Trait: TraitWW, Component: ComponentDirect, MarginalEconomicValue: 3, Emphasis: 0.4, Correlation: 0.3},
+		IndexElement{Trait: TraitSTAY, Component: ComponentDirect, MarginalEconomicValue: 0.5, Emphasis: 0.2, Correlation: 0.6},
+	)
+	if err = jobs[1].MarkQueued(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmp, err := user.CompareJobs([]string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []JobStatus{Passed, Passed, Queued}; len(cmp.Statuses) != 3 ||
+		cmp.Statuses[0] != want[0] || cmp.Statuses[1] != want[1] || cmp.Statuses[2] != want[2] {
+		t.Errorf("got statuses %v, want %v", cmp.Statuses, want)
+	}
+
+	absent := ComparisonValue{}
+	want := []ComparisonElement{
+		{Key: "WW,D", Label: "WW Direct", Values: []ComparisonValue{
+			{Present: true, MEV: 2, Emphasis: 0.5, Correlation: 0.1},
+			{Present: true, MEV: 3, Emphasis: 0.4, Correlation: 0.3, MEVDiff: 1, EmphasisDiff: -0.1, CorrelationDiff: 0.2},
+			absent,
+		}},
+		{Key: "MW,M", Label: "MW Maternal", Values: []ComparisonValue{
+			{Present: true, MEV: -1, Emphasis: 0.3, Correlation: 0.2},
+			absent,
+			absent,
+		}},
+		// Nothing to take a difference from when the first job has no result
+		{Key: "STAY,D", Label: "STAY Direct", Values: []ComparisonValue{
+			absent,
+			{Present: true, MEV: 0.5, Emphasis: 0.2, Correlation: 0.6},
+			absent,
+		}},
+	}
+	if len(cmp.Elements) != len(want) {
+		t.Fatalf("got %d elements, want %d", len(cmp.Elements), len(want))
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for i, w := range want {
+		g := cmp.Elements[i]
+		if g.Key != w.Key || g.Label != w.Label || len(g.Values) != len(w.Values) {
+			t.Errorf("element %d: got %s %q with %d values, want %s %q with %d", i, g.Key, g.Label, len(g.Values), w.Key, w.Label, len(w.Values))
+			continue
+		}
+		for j, wv := range w.Values {
+			gv := g.Values[j]
+			if gv.Present != wv.Present || !near(gv.MEV, wv.MEV) || !near(gv.Emphasis, wv.Emphasis) ||
+				!near(gv.Correlation, wv.Correlation) || !near(gv.MEVDiff, wv.MEVDiff) ||
+				!near(gv.EmphasisDiff, wv.EmphasisDiff) || !near(gv.CorrelationDiff, wv.CorrelationDiff) {
+				t.Errorf("%s job %s: got %+v, want %+v", w.Key, cmp.Jobs[j], gv, wv)
+			}
+		}
+	}
+
+	// Only the comment of b was changed
+	if len(cmp.Params) != 1 || cmp.Params[0].Path != params.PathPrefixMaster+"comment" {
+		t.Fatalf("got parameter differences %+v, want the comment", cmp.Params)
+	}
+	if got := cmp.Params[0].Values; len(got) != 3 || got[0] != got[2] || got[1] != "changed" {
+		t.Errorf("got comments %q", got)
+	}
+
+	if _, err = user.CompareJobs([]string{"a", "missing"}); err == nil {
+		t.Error("comparing a missing job: got no error")
+	}
+	if _, err = user.CompareJobs(nil); err == nil {
+		t.Error("comparing no jobs: got no error")
+	}
+}
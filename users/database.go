@@ -4,6 +4,8 @@ package users
 
 import (
 	"errors"
+	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -13,59 +15,130 @@ import (
 	"github.com/blgolden/igendec/params"
 )
 
-var UsersPath string
+// Settings for the database Init sets up
+var (
+	UsersPath    string
+	DatabaseType = DatabaseLocal
+)
+
+// Types of database
+const (
+	DatabaseLocal = "local" // flat files under UsersPath
+	DatabaseBolt  = "bolt"  // a single bolt file in UsersPath
+)
 
 // Init sets up the packages database
-// If you want to change the type
+// If you want to change the type set DatabaseType first
 func Init() {
-	database = NewLocalDatabase(UsersPath)
+	switch DatabaseType {
+	case DatabaseBolt:
+		db, err := NewBoltDatabase(filepath.Join(UsersPath, BoltFilename))
+		if err != nil {
+			logger.Fatal("opening bolt database: %s", err)
+		}
+		database = db
+	default:
+		database = NewLocalDatabase(UsersPath)
+	}
+}
+
+// Close closes the packages database
+func Close() error {
+	return database.Close()
 }
 
-var database *LocalDatabase
+var database Database
+
+// Database is where users, their parameters, jobs and the files jobs produce are kept
+// Job files are named by the File constants and are stored as is
+type Database interface {
+	Get(username string) (*User, error)
+	Create(user *User) error
+	Update(user *User) error
+	ListUsers() []string
+
+	GetIndexParams(user string) (*params.MasterParams, error)
+	SetMasterParams(user string, ip *params.MasterParams) error
+	GetEcoParams(user string) (*params.EcoParams, error)
+	SetEcoParams(user string, ep *params.EcoParams) error
+
+	ListJobs(user string) []string
+	DeleteJob(user, job string) error
+
+	// Reading a file the job doesn't have returns an error matching os.ErrNotExist
+	ReadJobFile(user, job, file string) ([]byte, error)
+	WriteJobFile(user, job, file string, data []byte) error
+	RemoveJobFile(user, job, file string) error
+	ListJobFiles(user, job string) ([]string, error)
+	// JobsSize returns the total size of the files of a users jobs, including those in the trash
+	JobsSize(user string) (int64, error)
+
+	// CheckoutJob returns a directory holding the job files for the model to run in
+	// CheckinJob stores the files left in the directory once the run is done
+	CheckoutJob(user, job string) (string, error)
+	CheckinJob(user, job, dir string) error
+
+	// Deleted jobs are kept in the trash under an id until they are restored or purged
+	// Restoring to a job that exists returns ErrJobExists
+	TrashJob(user, job, id string) error
+	RestoreJob(user, id, job string) error
+	PurgeJob(user, id string) error
+	ListTrash(user string) []string
+	ReadTrashFile(user, id, file string) ([]byte, error)
+
+	GetBatch(user, name string) (*Batch, error)
+	SetBatch(user string, b *Batch) error
+	ListBatches(user string) []string
+
+	// Sessions are kept apart from the users, and aren't part of a snapshot
+	// Getting a session that isn't there returns an error matching os.ErrNotExist
+	GetSession(key string) (*Session, error)
+	SetSession(s *Session) error
+	DeleteSession(key string) error
+	ListSessions() ([]*Session, error)
+
+	// Snapshot calls fn with every file in the database, named by its path in the local database
+	// The files of each user come from a consistent view. data is only valid until fn returns
+	Snapshot(fn func(name string, data []byte) error) error
+	// RestoreFile writes a file, named as in Snapshot, replacing any already there
+	RestoreFile(name string, data []byte) error
+
+	Close() error
+}
 
 // Prefixes for file structure of iGenDec
 const (
 	PrefixUsers         = "users/"
 	PrefixJobs          = "jobs/"
+	PrefixBatches       = "batches/"
+	PrefixTrash         = "trash/"
+	PrefixSessions      = "sessions/"
 	FileProfileFilename = "profile.hjson"
+	FileProfileLastGood = "profile.last-good.hjson"
 	FileMasterFilename  = "masterParams.hjson"
 	FileEcoFilename     = "ecoParams.hjson"
 
 	FileJobOutput         = "output.hjson"
 	//FileJobOutput         = "output.json"
-	FileJobProcessingFlag = ".processing"
+	FileJobProcessingFlag = ".processing" // only used by older versions, replaced by FileJobStatus
+	FileJobStatus         = "status.hjson"
+	FileJobRunLog         = "run.log"
 )
 
 // Database errors
 var (
 	ErrUserExists      = errors.New("user exists")
 	ErrUserDoesntExist = errors.New("user does not exist")
+	ErrUserCorrupt     = errors.New("user profile is corrupt")
+	ErrJobExists       = errors.New("job exists")
 )
 
-// PathToJobFile returns the path to a job file for a user
-// If you want the general path, pass in empty string for jobfile parameter
-func PathToJobFile(user, job, file string) string {
-	return filepath.Join(PathToJobsDir(user), job, file)
-}
-
-// PathToJobsDir returns the path to the directory where we keep all of the jobs
-func PathToJobsDir(user string) string {
-	return filepath.Join(PathToUserDir(user), PrefixJobs)
-}
-
-// PathToUserDir returns the path to a directory for a user
-func PathToUserDir(user string) string {
-	return filepath.Join(database.root, PrefixUsers, user)
-}
-
-// PathToUserFile returns the path to a general file for a user
-func PathToUserFile(user, file string) string {
-	return filepath.Join(PathToUserDir(user), file)
-}
-
 // Database implementation
 
 // LocalDatabase structure is an implementation of Database interface for keeping files in local tree
+// Files are replaced by renaming a complete copy over them, so a crash never leaves half a file.
+// Changes that take more than one write are made by the users package holding User.Lock, which
+// Snapshot and RestoreFile take as well
 type LocalDatabase struct {
 	root    string      // Should be absolute
 	perm    os.FileMode // permission to write files out with
@@ -83,16 +156,52 @@ func NewLocalDatabase(root string) *LocalDatabase {
 	}
 	root = strings.TrimRight(root, "/") + "/"
 	os.MkdirAll(root, 0755)
-	return &LocalDatabase{root, 0644, 0755}
+	return &LocalDatabase{root: root, perm: 0644, dirperm: 0755}
+}
+
+// jobFile returns the path to a job file for a user
+// If you want the general path, pass in empty string for file parameter
+func (db *LocalDatabase) jobFile(user, job, file string) string {
+	return filepath.Join(db.jobsDir(user), job, file)
+}
+
+// jobsDir returns the path to the directory where we keep all of the jobs
+func (db *LocalDatabase) jobsDir(user string) string {
+	return filepath.Join(db.userDir(user), PrefixJobs)
+}
+
+// trashFile returns the path to a file of a job in the trash
+func (db *LocalDatabase) trashFile(user, id, file string) string {
+	return filepath.Join(db.userDir(user), PrefixTrash, id, file)
+}
+
+// userDir returns the path to a directory for a user
+func (db *LocalDatabase) userDir(user string) string {
+	return filepath.Join(db.root, PrefixUsers, user)
+}
+
+// userFile returns the path to a general file for a user
+func (db *LocalDatabase) userFile(user, file string) string {
+	return filepath.Join(db.userDir(user), file)
+}
+
+// batchFile returns the path to the record of a users batch
+func (db *LocalDatabase) batchFile(user, batch string) string {
+	return filepath.Join(db.userDir(user), PrefixBatches, batch+".hjson")
 }
 
 // Get returns a user
+// A profile that can't be parsed is recovered from the last good copy
 func (db *LocalDatabase) Get(username string) (*User, error) {
-	data, err := ioutil.ReadFile(PathToUserFile(username, FileProfileFilename))
+	data, err := ioutil.ReadFile(db.userFile(username, FileProfileFilename))
 	if err != nil {
 		return nil, ErrUserDoesntExist
 	}
-	return NewUserFromBytes(data)
+	user, err := NewUserFromBytes(data)
+	if err != nil || user.Username != username {
+		return db.recoverProfile(username)
+	}
+	return user, nil
 }
 
 // Create makes a new user
@@ -106,18 +215,18 @@ func (db *LocalDatabase) Create(user *User) error {
 		return err
 	}
 	// Make directory structure for user
-	os.MkdirAll(PathToUserDir(user.Username), db.dirperm)
-	if err = os.Mkdir(PathToJobsDir(user.Username), db.dirperm); err != nil {
+	os.MkdirAll(db.userDir(user.Username), db.dirperm)
+	if err = os.Mkdir(db.jobsDir(user.Username), db.dirperm); err != nil {
 		return err
 	}
 	// return user
-	return ioutil.WriteFile(PathToUserFile(user.Username, FileProfileFilename), data, db.perm)
+	return db.writeProfile(user.Username, data)
 }
 
 // Update takes in the details of a user and overwrites the current profile entry
 func (db *LocalDatabase) Update(user *User) error {
 	if !db.exists(user.Username) {
-		return ErrUserExists
+		return ErrUserDoesntExist
 	}
 
 	data, err := user.Bytes()
@@ -125,12 +234,46 @@ func (db *LocalDatabase) Update(user *User) error {
 		return err
 	}
 
-	return ioutil.WriteFile(PathToUserFile(user.Username, FileProfileFilename), data, db.perm)
+	return db.writeProfile(user.Username, data)
+}
+
+// writeProfile replaces the profile of a user, then the last good copy of it
+func (db *LocalDatabase) writeProfile(user string, data []byte) error {
+	if err := writeFileAtomic(db.userFile(user, FileProfileFilename), data, db.perm); err != nil {
+		return err
+	}
+	return writeFileAtomic(db.userFile(user, FileProfileLastGood), data, db.perm)
+}
+
+// recoverProfile replaces a corrupt profile with the last good copy
+func (db *LocalDatabase) recoverProfile(username string) (*User, error) {
+	// Another request may have recovered it already
+	data, err := ioutil.ReadFile(db.userFile(username, FileProfileFilename))
+	if err != nil {
+		return nil, ErrUserDoesntExist
+	}
+	if user, err := NewUserFromBytes(data); err == nil && user.Username == username {
+		return user, nil
+	}
+
+	if data, err = ioutil.ReadFile(db.userFile(username, FileProfileLastGood)); err != nil {
+		return nil, fmt.Errorf("%w and there is no good copy: %s", ErrUserCorrupt, err)
+	}
+	user, err := NewUserFromBytes(data)
+	if err != nil || user.Username != username {
+		return nil, fmt.Errorf("%w and so is the last good copy", ErrUserCorrupt)
+	}
+
+	logger.Warn("profile of user '%s' is corrupt, restoring the last good copy", username)
+	if err = writeFileAtomic(db.userFile(username, FileProfileFilename), data, db.perm); err != nil {
+		return nil, fmt.Errorf("restoring profile: %w", err)
+	}
+	return user, nil
 }
 
 // GetIndexParams returns indexParams.hjson file for the user
 func (db *LocalDatabase) GetIndexParams(user string) (*params.MasterParams, error) {
-	return params.MasterParamsFromFile(PathToUserFile(user, FileMasterFilename))
+	return params.MasterParamsFromFile(db.userFile(user, FileMasterFilename))
 }
 
 // SetMasterParams writes the given index params to the database
@@ -139,12 +282,12 @@ func (db *LocalDatabase) SetMasterParams(user string, ip *params.MasterParams) e
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(PathToUserFile(user, FileMasterFilename), data, db.perm)
+	return writeFileAtomic(db.userFile(user, FileMasterFilename), data, db.perm)
 }
 
 // GetEcoParams returns ecoParams.hjson file for the user
 func (db *LocalDatabase) GetEcoParams(user string) (*params.EcoParams, error) {
-	return params.EcoParamsFromFile(PathToUserFile(user, FileEcoFilename))
+	return params.EcoParamsFromFile(db.userFile(user, FileEcoFilename))
 }
 
 // SetEcoParams writes the given eco params to the database
@@ -153,12 +296,27 @@ func (db *LocalDatabase) SetEcoParams(user string, ep *params.EcoParams) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(PathToUserFile(user, FileEcoFilename), data, db.perm)
+	return writeFileAtomic(db.userFile(user, FileEcoFilename), data, db.perm)
+}
+
+// ListUsers returns the usernames of every user in the database
+func (db *LocalDatabase) ListUsers() []string {
+	filelist, err := ioutil.ReadDir(filepath.Join(db.root, PrefixUsers))
+	if err != nil {
+		return nil
+	}
+	var usernames []string
+	for _, info := range filelist {
+		if info.IsDir() {
+			usernames = append(usernames, info.Name())
+		}
+	}
+	return usernames
 }
 
 // ListJobs returns a list of the jobs a user has
 func (db *LocalDatabase) ListJobs(user string) []string {
-	filelist, err := ioutil.ReadDir(PathToJobsDir(user))
+	filelist, err := ioutil.ReadDir(db.jobsDir(user))
 	if err != nil {
 		return nil
 	}
@@ -169,20 +327,303 @@ func (db *LocalDatabase) ListJobs(user string) []string {
 	return jobs
 }
 
-// GetJobFilename returns the path to the given job file
-func (db *LocalDatabase) GetJobFilename(user, job, file string) string {
-	p := PathToJobFile(user, job, file)
-	os.MkdirAll(filepath.Dir(p), database.dirperm)
-	return p
-}
-
 // DeleteJob will remove the given job if it exists
 func (db *LocalDatabase) DeleteJob(user, job string) error {
-	return os.RemoveAll(PathToJobFile(user, job, ""))
+	return os.RemoveAll(db.jobFile(user, job, ""))
+}
+
+// ReadJobFile returns the contents of a job file
+func (db *LocalDatabase) ReadJobFile(user, job, file string) ([]byte, error) {
+	return os.ReadFile(db.jobFile(user, job, file))
+}
+
+// WriteJobFile replaces a job file, creating the job if it doesn't exist
+func (db *LocalDatabase) WriteJobFile(user, job, file string, data []byte) error {
+	if err := os.MkdirAll(db.jobFile(user, job, ""), db.dirperm); err != nil {
+		return err
+	}
+	return writeFileAtomic(db.jobFile(user, job, file), data, db.perm)
+}
+
+// RemoveJobFile removes a job file, it is not an error if it doesn't exist
+func (db *LocalDatabase) RemoveJobFile(user, job, file string) error {
+	if err := os.Remove(db.jobFile(user, job, file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ListJobFiles returns the names of the files a job has
+func (db *LocalDatabase) ListJobFiles(user, job string) ([]string, error) {
+	return regularFiles(db.jobFile(user, job, ""))
+}
+
+// JobsSize returns the total size of the files of a users jobs, including those in the trash
+func (db *LocalDatabase) JobsSize(user string) (int64, error) {
+	var size int64
+	for _, dir := range []string{db.jobsDir(user), filepath.Join(db.userDir(user), PrefixTrash)} {
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				// Replaced while we were looking
+				return nil
+			} else if err != nil {
+				return err
+			}
+			size += info.Size()
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// CheckoutJob returns the job directory, the model is run in place
+func (db *LocalDatabase) CheckoutJob(user, job string) (string, error) {
+	return db.jobFile(user, job, ""), nil
+}
+
+// CheckinJob does nothing as the model was run in place
+func (db *LocalDatabase) CheckinJob(user, job, dir string) error {
+	return nil
+}
+
+// TrashJob moves a job to the trash
+func (db *LocalDatabase) TrashJob(user, job, id string) error {
+	if _, err := os.Stat(db.jobFile(user, job, "")); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(db.userDir(user), PrefixTrash), db.dirperm); err != nil {
+		return err
+	}
+	return os.Rename(db.jobFile(user, job, ""), db.trashFile(user, id, ""))
+}
+
+// RestoreJob moves a job out of the trash
+func (db *LocalDatabase) RestoreJob(user, id, job string) error {
+	if _, err := os.Stat(db.trashFile(user, id, "")); err != nil {
+		return err
+	}
+	if _, err := os.Stat(db.jobFile(user, job, "")); err == nil {
+		return ErrJobExists
+	}
+	return os.Rename(db.trashFile(user, id, ""), db.jobFile(user, job, ""))
+}
+
+// PurgeJob removes a job from the trash for good
+func (db *LocalDatabase) PurgeJob(user, id string) error {
+	return os.RemoveAll(db.trashFile(user, id, ""))
+}
+
+// ListTrash returns the ids of the jobs in a users trash
+func (db *LocalDatabase) ListTrash(user string) []string {
+	filelist, err := ioutil.ReadDir(filepath.Join(db.userDir(user), PrefixTrash))
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	for _, info := range filelist {
+		if info.IsDir() {
+			ids = append(ids, info.Name())
+		}
+	}
+	return ids
+}
+
+// ReadTrashFile returns the contents of a file of a job in the trash
+func (db *LocalDatabase) ReadTrashFile(user, id, file string) ([]byte, error) {
+	return os.ReadFile(db.trashFile(user, id, file))
+}
+
+// GetBatch reads a batch record
+func (db *LocalDatabase) GetBatch(user, name string) (*Batch, error) {
+	data, err := os.ReadFile(db.batchFile(user, name))
+	if err != nil {
+		return nil, err
+	}
+	return parseBatch(data)
+}
+
+// SetBatch writes a batch record, replacing any with the same name
+func (db *LocalDatabase) SetBatch(user string, b *Batch) error {
+	data, err := b.Bytes()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Join(db.userDir(user), PrefixBatches), db.dirperm); err != nil {
+		return err
+	}
+	return writeFileAtomic(db.batchFile(user, b.Name), data, db.perm)
+}
+
+// ListBatches returns the names of a users batches
+func (db *LocalDatabase) ListBatches(user string) []string {
+	filelist, err := ioutil.ReadDir(filepath.Join(db.userDir(user), PrefixBatches))
+	if err != nil {
+		return nil
+	}
+	var batches []string
+	for _, info := range filelist {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".hjson") {
+			batches = append(batches, strings.TrimSuffix(info.Name(), ".hjson"))
+		}
+	}
+	return batches
+}
+
+// sessionFile returns the path to the record of a session
+func (db *LocalDatabase) sessionFile(key string) string {
+	return filepath.Join(db.root, PrefixSessions, key+".json")
+}
+
+// GetSession reads a session record
+func (db *LocalDatabase) GetSession(key string) (*Session, error) {
+	if !validSessionKey(key) {
+		return nil, notExist(PrefixSessions, key)
+	}
+	data, err := os.ReadFile(db.sessionFile(key))
+	if err != nil {
+		return nil, err
+	}
+	return parseSession(data)
+}
+
+// SetSession writes a session record, readable only by the server as it holds the session values
+func (db *LocalDatabase) SetSession(s *Session) error {
+	if !validSessionKey(s.Key) {
+		return fmt.Errorf("bad session key '%s'", s.Key)
+	}
+	data, err := s.Bytes()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Join(db.root, PrefixSessions), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(db.sessionFile(s.Key), data, 0600)
+}
+
+// DeleteSession removes a session record, it is not an error if it doesn't exist
+func (db *LocalDatabase) DeleteSession(key string) error {
+	if !validSessionKey(key) {
+		return nil
+	}
+	if err := os.Remove(db.sessionFile(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ListSessions returns every session record
+// Records removed while they are being read are skipped
+func (db *LocalDatabase) ListSessions() ([]*Session, error) {
+	filelist, err := ioutil.ReadDir(filepath.Join(db.root, PrefixSessions))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sessions []*Session
+	for _, info := range filelist {
+		key := strings.TrimSuffix(info.Name(), ".json")
+		if info.IsDir() || !validSessionKey(key) {
+			continue
+		}
+		s, err := db.GetSession(key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("reading session '%s': %w", key, err)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// Snapshot calls fn with every file in the database
+// Each user is locked while their files are read, and unlocked before they are passed to fn
+// so a slow fn doesn't hold them up
+func (db *LocalDatabase) Snapshot(fn func(name string, data []byte) error) error {
+	for _, user := range db.ListUsers() {
+		if err := db.snapshotUser(user, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *LocalDatabase) snapshotUser(user string, fn func(name string, data []byte) error) error {
+	type file struct {
+		name string
+		data []byte
+	}
+	var files []file
+	unlock := lockUser(user)
+	err := filepath.WalkDir(db.userDir(user), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || isTempFile(d.Name()) {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(db.root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{filepath.ToSlash(name), data})
+		return nil
+	})
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err = fn(f.name, f.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreFile writes a file to the tree
+func (db *LocalDatabase) RestoreFile(name string, data []byte) error {
+	user, _, err := splitSnapshotName(name)
+	if err != nil {
+		return err
+	}
+	defer lockUser(user)()
+	filename := filepath.Join(db.root, filepath.FromSlash(name))
+	if err = os.MkdirAll(filepath.Dir(filename), db.dirperm); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(db.jobsDir(user), db.dirperm); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data, db.perm)
+}
+
+// Close does nothing as there is nothing held open
+func (db *LocalDatabase) Close() error {
+	return nil
 }
 
 // Returns true if user exists - or is reachable, false otherwise
 func (db *LocalDatabase) exists(username string) bool {
-	_, err := os.Stat(PathToUserFile(username, FileProfileFilename))
+	_, err := os.Stat(db.userFile(username, FileProfileFilename))
 	return err == nil
 }
@@ -0,0 +1,206 @@
+package users
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDatabases(t *testing.T) {
+	bolt, err := NewBoltDatabase(filepath.Join(t.TempDir(), BoltFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+
+	for name, db := range map[string]Database{
+		DatabaseLocal: NewLocalDatabase(t.TempDir()),
+		DatabaseBolt:  bolt,
+	} {
+		t.Run(name, func(t *testing.T) { testDatabase(t, db) })
+	}
+}
+
+func testDatabase(t *testing.T, db Database) {
+	user := NewUser("bob")
+	user.Email = "bob@example.com"
+	if err := db.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(user); err != ErrUserExists {
+		t.Errorf("creating user twice: got %v, want %v", err, ErrUserExists)
+	}
+	if err := db.Update(NewUser("alice")); err != ErrUserDoesntExist {
+		t.Errorf("updating missing user: got %v, want %v", err, ErrUserDoesntExist)
+	}
+	got, err := db.Get("bob")
+	if err != nil || got.Email != user.Email {
+		t.Fatalf("getting user: got %v, %v", got, err)
+	}
+	if users := db.ListUsers(); !reflect.DeepEqual(users, []string{"bob"}) {
+		t.Errorf("listing users: got %v", users)
+	}
+
+	if _, err := db.ReadJobFile("bob", "job", FileJobOutput); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("reading missing file: got %v, want os.ErrNotExist", err)
+	}
+	for _, job := range []string{"b-job", "a-job"} {
+		if err := db.WriteJobFile("bob", job, FileMasterFilename, []byte("master")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if jobs := db.ListJobs("bob"); !reflect.DeepEqual(jobs, []string{"a-job", "b-job"}) {
+		t.Errorf("listing jobs: got %v", jobs)
+	}
+
+	// A run writes its output to the checked out directory, which is kept on check in
+	dir, err := db.CheckoutJob("bob", "a-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, FileMasterFilename)); err != nil || string(data) != "master" {
+		t.Errorf("checked out master params: got %q, %v", data, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, FileJobOutput), []byte("output"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CheckinJob("bob", "a-job", dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.ReadJobFile("bob", "a-job", FileJobOutput); err != nil || string(data) != "output" {
+		t.Errorf("checked in output: got %q, %v", data, err)
+	}
+	if files, _ := db.ListJobFiles("bob", "a-job"); !reflect.DeepEqual(files, []string{FileMasterFilename, FileJobOutput}) {
+		t.Errorf("listing job files: got %v", files)
+	}
+
+	if err := db.RemoveJobFile("bob", "a-job", FileJobOutput); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RemoveJobFile("bob", "a-job", FileJobOutput); err != nil {
+		t.Errorf("removing missing file: %s", err)
+	}
+	if err := db.DeleteJob("bob", "a-job"); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := db.ListJobs("bob"); !reflect.DeepEqual(jobs, []string{"b-job"}) {
+		t.Errorf("listing jobs after delete: got %v", jobs)
+	}
+
+	// Trashed jobs keep their files and can be moved back
+	if err := db.TrashJob("bob", "b-job", "b-job.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TrashJob("bob", "b-job", "b-job.2"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("trashing missing job: got %v, want os.ErrNotExist", err)
+	}
+	if trash := db.ListTrash("bob"); !reflect.DeepEqual(trash, []string{"b-job.1"}) || len(db.ListJobs("bob")) != 0 {
+		t.Errorf("after trashing: got trash %v, jobs %v", trash, db.ListJobs("bob"))
+	}
+	if data, err := db.ReadTrashFile("bob", "b-job.1", FileMasterFilename); err != nil || string(data) != "master" {
+		t.Errorf("reading trashed file: got %q, %v", data, err)
+	}
+	db.WriteJobFile("bob", "b-job", FileMasterFilename, []byte("new"))
+	if err := db.RestoreJob("bob", "b-job.1", "b-job"); err != ErrJobExists {
+		t.Errorf("restoring over a job: got %v, want %v", err, ErrJobExists)
+	}
+	if err := db.RestoreJob("bob", "b-job.1", "c-job"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.ReadJobFile("bob", "c-job", FileMasterFilename); err != nil || string(data) != "master" {
+		t.Errorf("reading restored file: got %q, %v", data, err)
+	}
+	db.TrashJob("bob", "c-job", "c-job.1")
+	if err := db.PurgeJob("bob", "c-job.1"); err != nil || len(db.ListTrash("bob")) != 0 {
+		t.Errorf("purging: got %v, trash %v", err, db.ListTrash("bob"))
+	}
+
+	if err := db.SetBatch("bob", &Batch{Name: "sweep", Base: "b-job"}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := db.GetBatch("bob", "sweep"); err != nil || b.Base != "b-job" {
+		t.Errorf("getting batch: got %v, %v", b, err)
+	}
+	if batches := db.ListBatches("bob"); !reflect.DeepEqual(batches, []string{"sweep"}) {
+		t.Errorf("listing batches: got %v", batches)
+	}
+
+	// Sessions are kept apart from the users
+	key := SessionKey([]byte("id"))
+	if _, err := db.GetSession(key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("getting missing session: got %v, want os.ErrNotExist", err)
+	}
+	if _, err := db.GetSession("../users/bob/profile"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("getting session with a bad key: got %v, want os.ErrNotExist", err)
+	}
+	if err := db.SetSession(&Session{Key: key, Username: "bob", Data: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := db.GetSession(key); err != nil || s.Username != "bob" || string(s.Data) != "data" {
+		t.Errorf("getting session: got %v, %v", s, err)
+	}
+	if sessions, err := db.ListSessions(); err != nil || len(sessions) != 1 || sessions[0].Key != key {
+		t.Errorf("listing sessions: got %v, %v", sessions, err)
+	}
+	if users := db.ListUsers(); !reflect.DeepEqual(users, []string{"bob"}) {
+		t.Errorf("sessions listed as users: got %v", users)
+	}
+	if err := db.DeleteSession(key); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := db.ListSessions(); err != nil || len(sessions) != 0 {
+		t.Errorf("after deleting session: got %v, %v", sessions, err)
+	}
+}
+
+func TestLocalDatabaseRecoversProfile(t *testing.T) {
+	db := NewLocalDatabase(t.TempDir())
+	user := NewUser("bob")
+	user.Email = "bob@example.com"
+	if err := db.Create(user); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write cut short
+	profile := db.userFile("bob", FileProfileFilename)
+	if err := os.WriteFile(profile, []byte("{\n  Email: bob@"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Get("bob")
+	if err != nil || got.Email != user.Email {
+		t.Fatalf("recovering profile: got %v, %v", got, err)
+	}
+	if data, _ := os.ReadFile(profile); !bytes.Contains(data, []byte("bob@example.com")) {
+		t.Errorf("profile was not restored, have %q", data)
+	}
+
+	os.Remove(db.userFile("bob", FileProfileLastGood))
+	os.WriteFile(profile, nil, 0644)
+	if _, err = db.Get("bob"); !errors.Is(err, ErrUserCorrupt) {
+		t.Errorf("no good copy: got %v, want %v", err, ErrUserCorrupt)
+	}
+}
+
+func TestLocalDatabaseSnapshotWaitsForUserLock(t *testing.T) {
+	db := NewLocalDatabase(t.TempDir())
+	if err := db.Create(NewUser("bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := NewUser("bob").Lock()
+	done := make(chan error)
+	go func() { done <- db.Snapshot(func(string, []byte) error { return nil }) }()
+	select {
+	case <-done:
+		t.Fatal("snapshot read bob while he was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,22 @@
+package users
+
+import "testing"
+
+// useTestDatabase points the package at an empty local database until the test ends
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	db := database
+	database = NewLocalDatabase(t.TempDir())
+	t.Cleanup(func() { database = db })
+}
+
+// newTestUser uses an empty database, as useTestDatabase, and creates the user bob in it
+func newTestUser(t *testing.T) *User {
+	t.Helper()
+	useTestDatabase(t)
+	user := NewUser("bob")
+	if err := database.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -2,17 +2,20 @@ package users
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/blgolden/igendec/logger"
 	"github.com/blgolden/igendec/params"
-	"github.com/hjson/hjson-go"
+	"github.com/blgolden/igendec/schema"
 	"github.com/klauspost/compress/zip"
 )
 
@@ -57,6 +60,15 @@ const (
 	Passed     JobStatus = "passed"
 	Failed     JobStatus = "failed"
 	Processing JobStatus = "processing"
+	Queued     JobStatus = "queued"
+	Cancelled  JobStatus = "cancelled"
+	TimedOut   JobStatus = "timed-out"
+)
+
+// Job errors
+var (
+	ErrJobCancelled = errors.New("job was cancelled")
+	ErrJobTimedOut  = errors.New("job ran for too long")
 )
 
 // Job holds information on a job run through create page
@@ -68,6 +80,7 @@ type Job struct {
 	Output         []IndexElement `json:"indexElement"`
 	Comment        string
 	TargetDatabase string
+	State          *JobState `json:"-"`
 }
 
 // IndexElement holds the details of a trait thats output from iGenDec
@@ -92,15 +105,8 @@ func parseJob(r io.Reader) (*Job, error) {
 	if err != nil {
 		return nil, err
 	}
-	elements := make(map[string]interface{})
-	if err = hjson.Unmarshal(data, &elements); err != nil {
-		return nil, err
-	}
 	job := &Job{}
-	if data, err = json.Marshal(elements); err != nil {
-		return nil, err
-	}
-	if err = json.Unmarshal(data, job); err != nil {
+	if err = schema.Decode(schema.JobOutput, data, job); err != nil {
 		return nil, err
 	}
 	job.Status = Passed
@@ -112,66 +118,232 @@ func parseJob(r io.Reader) (*Job, error) {
 	return job, nil
 }
 
-// Run uses the exec package to run the iGenDec job with the starters binary
-// starters needs to be in the path
-func (job *Job) Run(databasePath string) error {
-	defer os.Remove(PathToJobFile(job.user.Username, job.Name, FileJobProcessingFlag))
-	os.Create(PathToJobFile(job.user.Username, job.Name, FileJobProcessingFlag))
-	cmd := exec.Command("starter", "-genParm", PathToJobFile(job.user.Username, job.Name, FileMasterFilename),
-		"-indexParm", PathToJobFile(job.user.Username, job.Name, FileEcoFilename),
-		"-outputFile", PathToJobFile(job.user.Username, job.Name, FileJobOutput),
-		"-database-path", databasePath,
-		"-outputMode", "none",
-	)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("running job: %w", err)
+// InProgress returns true if the job is waiting to run or running
+func (job *Job) InProgress() bool {
+	return job.Status == Queued || job.Status == Processing
+}
+
+// CurrentStatus reads the latest status of the job from the database
+func (job *Job) CurrentStatus() JobStatus {
+	current, err := job.user.GetJob(job.Name)
+	if err != nil {
+		return Failed
 	}
-	return nil
+	return current.Status
 }
 
-// Zip compresses all the job files and returns the zipped archive as bytes
-func (job *Job) Zip() ([]byte, error) {
-	buf := &bytes.Buffer{}
-	w := zip.NewWriter(buf)
+// Username returns the name of the user that owns this job
+func (job *Job) Username() string {
+	return job.user.Username
+}
 
-	err := filepath.Walk(PathToJobFile(job.user.Username, job.Name, ""), func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// Run runs the iGenDec job through JobRunner
+// By default this is the starter binary, which needs to be in the path
+// Cancelling ctx kills the run, if ctx hit its deadline the job is recorded as timed out,
+// otherwise as cancelled
+func (job *Job) Run(ctx context.Context, databasePath string) error {
+	// Older versions flagged running jobs with a file, the state record replaces it
+	database.RemoveJobFile(job.user.Username, job.Name, FileJobProcessingFlag)
+
+	now := time.Now()
+	state := &JobState{Status: Processing, ServerPID: os.Getpid(), Started: now, Heartbeat: now}
+	if prev, err := job.ReadState(); err == nil {
+		state.Queued = prev.Queued
+	}
+	if err := job.saveState(state); err != nil {
+		return fmt.Errorf("saving job state: %w", err)
+	}
+
+	// Remove the output of an earlier run so a failed rerun isn't shown as passed
+	database.RemoveJobFile(job.user.Username, job.Name, FileJobOutput)
+
+	// The model is given its own copy of the parameters, as it reads them
+	inputs, err := job.writeModelInputs()
+	if err != nil {
+		return job.failBeforeRun(now, fmt.Errorf("writing model inputs: %w", err))
+	}
+	defer os.RemoveAll(inputs)
+
+	// The model writes its output, so the job is checked out to a directory to run in
+	dir, err := database.CheckoutJob(job.user.Username, job.Name)
+	if err != nil {
+		return job.failBeforeRun(now, fmt.Errorf("checking out job: %w", err))
+	}
+	spec := job.runSpec(dir, inputs, databasePath)
+
+	l := &RunLog{CommandLine: JobRunner.CommandLine(spec), Started: now, Status: Passed}
+	spec.Stdout, spec.Stderr = &l.Stdout, &l.Stderr
+
+	// The state is shared with the heartbeat, so every write goes through the lock
+	var mu sync.Mutex
+	update := func(change func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		change()
+		if err := job.saveState(state); err != nil {
+			logger.Warn("saving state for job '%s' for user '%s': %s", job.Name, job.user.Username, err)
 		}
-		if info.IsDir() {
-			return nil
+	}
+	spec.Started = func(pid int) { update(func() { state.PID = pid }) }
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				update(func() { state.Heartbeat = time.Now() })
+			}
 		}
-		file, err := os.Open(path)
-		if err != nil {
-			return err
+	}()
+
+	err = JobRunner.Run(ctx, spec)
+	close(stop)
+	<-stopped
+
+	// Keep what the run wrote, if it can't be kept the run has failed
+	if checkinErr := database.CheckinJob(job.user.Username, job.Name, dir); checkinErr != nil && err == nil {
+		err = fmt.Errorf("checking in job: %w", checkinErr)
+	}
+	if err == nil {
+		if versionErr := job.versionOutput(); versionErr != nil {
+			logger.Warn("versioning output of job '%s' for user '%s': %s", job.Name, job.user.Username, versionErr)
 		}
-		defer file.Close()
+	}
 
-		f, err := w.Create(info.Name())
-		if err != nil {
-			return err
+	l.Finished = time.Now()
+	l.ExitCode = exitCode(err)
+	if err != nil {
+		l.Error = err.Error()
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			l.Status, err = TimedOut, ErrJobTimedOut
+		case context.Canceled:
+			l.Status, err = Cancelled, ErrJobCancelled
+		default:
+			l.Status, err = Failed, fmt.Errorf("running job: %w", err)
 		}
+	}
+	if logErr := job.writeRunLog(l); logErr != nil {
+		logger.Warn("writing run log for job '%s' for user '%s': %s", job.Name, job.user.Username, logErr)
+	}
 
-		_, err = io.Copy(f, file)
-		return err
+	// The state has the jobs error, as MarkCancelled and MarkFailed record, the run log has the runners
+	update(func() {
+		state.Status = l.Status
+		state.Finished = l.Finished
+		state.Heartbeat = time.Time{}
+		state.Error = ""
+		if err != nil {
+			state.Error = err.Error()
+		}
 	})
+	return err
+}
+
+// failBeforeRun records a run that failed before the model was started, in the run log
+// as well as the state, so the log of an earlier run isn't shown for it
+func (job *Job) failBeforeRun(started time.Time, err error) error {
+	l := &RunLog{Started: started, Finished: time.Now(), ExitCode: -1, Status: Failed, Error: err.Error()}
+	if logErr := job.writeRunLog(l); logErr != nil {
+		logger.Warn("writing run log for job '%s' for user '%s': %s", job.Name, job.user.Username, logErr)
+	}
+	job.MarkFailed(err)
+	return err
+}
+
+// runSpec returns the files this job is run with when checked out to dir, with the model inputs in inputs
+func (job *Job) runSpec(dir, inputs, databasePath string) RunSpec {
+	return RunSpec{
+		MasterFile:   filepath.Join(inputs, FileMasterFilename),
+		EcoFile:      filepath.Join(inputs, FileEcoFilename),
+		OutputFile:   filepath.Join(dir, FileJobOutput),
+		DatabasePath: databasePath,
+	}
+}
+
+// writeModelInputs writes the parameters of the job as the model reads them to a new temporary
+// directory, which the caller removes. Only iGenDec reads the schema version, so it is left out
+func (job *Job) writeModelInputs() (string, error) {
+	mp, ep, err := job.user.GetJobParams(job.Name)
+	if err != nil {
+		return "", err
+	}
+	master, err := mp.ModelBytes()
+	if err != nil {
+		return "", err
+	}
+	eco, err := ep.ModelBytes()
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp("", "igendec-inputs-")
+	if err != nil {
+		return "", err
+	}
+	if err = os.WriteFile(filepath.Join(dir, FileMasterFilename), master, 0644); err == nil {
+		err = os.WriteFile(filepath.Join(dir, FileEcoFilename), eco, 0644)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Zip compresses all the job files, including the run log, and returns the zipped archive as bytes
+func (job *Job) Zip() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
 
+	files, err := database.ListJobFiles(job.user.Username, job.Name)
 	if err != nil {
 		return nil, err
 	}
+	for _, name := range files {
+		data, err := database.ReadJobFile(job.user.Username, job.Name, name)
+		if err != nil {
+			return nil, err
+		}
+		f, err := w.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
 	if err = w.Close(); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
+// versionOutput records the schema version in the output the model wrote
+func (job *Job) versionOutput() error {
+	data, err := database.ReadJobFile(job.user.Username, job.Name, FileJobOutput)
+	if err != nil {
+		return err
+	}
+	if data, _, err = upgradeDocument(schema.JobOutput, data); err != nil || data == nil {
+		return err
+	}
+	return database.WriteJobFile(job.user.Username, job.Name, FileJobOutput, data)
+}
+
 // saves the parameter files for this job
 func (job *Job) saveParams(ip *params.MasterParams, ep *params.EcoParams) error {
 	data, err := ip.Bytes()
 	if err != nil {
 		return fmt.Errorf("encoding master params: %w", err)
 	}
-	if err := os.WriteFile(database.GetJobFilename(job.user.Username, job.Name, FileMasterFilename), data, 0755); err != nil {
+	if err := database.WriteJobFile(job.user.Username, job.Name, FileMasterFilename, data); err != nil {
 		return fmt.Errorf("writing master params: %w", err)
 	}
 
@@ -179,7 +351,7 @@ func (job *Job) saveParams(ip *params.MasterParams, ep *params.EcoParams) error
 	if err != nil {
 		return fmt.Errorf("encoding eco params: %w", err)
 	}
-	if err := os.WriteFile(database.GetJobFilename(job.user.Username, job.Name, FileEcoFilename), data, 0755); err != nil {
+	if err := database.WriteJobFile(job.user.Username, job.Name, FileEcoFilename, data); err != nil {
 		return fmt.Errorf("writing eco params: %w", err)
 	}
 	return nil
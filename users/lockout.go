@@ -0,0 +1,156 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Sign in throttling settings
+var (
+	// SignInBackoff is how long to wait after a failed sign in before trying again, it doubles
+	// with each failure in a row up to SignInBackoffMax
+	SignInBackoff    = time.Second
+	SignInBackoffMax = time.Minute
+	// LockoutAttempts is how many failed sign ins in a row lock an account, 0 never locks
+	LockoutAttempts = 10
+	// LockoutPeriod is how long an account stays locked, unless an administrator unlocks it
+	LockoutPeriod = 30 * time.Minute
+)
+
+// Sign in errors, the error says how long to wait
+var (
+	ErrSignInThrottled = errors.New("too many failed sign ins")
+	ErrSignInLocked    = errors.New("locked after too many failed sign ins")
+)
+
+// Lockout counts the failed sign ins in a row to an account, or from an address
+// The failures are forgotten once there haven't been any for LockoutPeriod
+type Lockout struct {
+	Failures    int
+	LastFailure time.Time
+	Until       time.Time // locked until, zero if it hasn't been locked
+}
+
+// Locked returns true if the lockout is in force
+func (l *Lockout) Locked(now time.Time) bool {
+	return l != nil && now.Before(l.Until)
+}
+
+// Expired returns true once the failures are forgotten
+func (l *Lockout) Expired(now time.Time) bool {
+	return l == nil || (!l.Locked(now) && now.Sub(l.LastFailure) > LockoutPeriod)
+}
+
+// Wait returns how long until another sign in can be tried, 0 if one can be tried now
+func (l *Lockout) Wait(now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	wait := l.LastFailure.Add(backoff(l.Failures)).Sub(now)
+	if locked := l.Until.Sub(now); locked > wait {
+		wait = locked
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Check returns an error matching ErrSignInLocked or ErrSignInThrottled if a sign in can't be tried now
+func (l *Lockout) Check(now time.Time) error {
+	wait := l.Wait(now)
+	switch {
+	case l.Locked(now):
+		return fmt.Errorf("%w, try again in %s", ErrSignInLocked, roundWait(wait))
+	case wait > 0:
+		return fmt.Errorf("%w, try again in %s", ErrSignInThrottled, roundWait(wait))
+	}
+	return nil
+}
+
+// Fail records a failed sign in, locking for LockoutPeriod after attempts in a row
+// Returns true if this failure locked it. attempts of 0 never locks
+func (l *Lockout) Fail(now time.Time, attempts int) bool {
+	if l.Expired(now) {
+		*l = Lockout{}
+	}
+	l.Failures++
+	l.LastFailure = now
+	if attempts > 0 && l.Failures >= attempts {
+		l.Until = now.Add(LockoutPeriod)
+		return true
+	}
+	return false
+}
+
+// backoff returns how long to wait after failures in a row
+func backoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	wait := SignInBackoff
+	for i := 1; i < failures && wait < SignInBackoffMax; i++ {
+		wait *= 2
+	}
+	if wait > SignInBackoffMax {
+		wait = SignInBackoffMax
+	}
+	return wait
+}
+
+// roundWait rounds a wait up to the second, so it is never shown as 0s
+func roundWait(wait time.Duration) time.Duration {
+	return (wait + time.Second - 1).Truncate(time.Second)
+}
+
+// CheckSignIn returns an error matching ErrSignInLocked or ErrSignInThrottled if the user
+// can't try to sign in yet
+func (u *User) CheckSignIn(now time.Time) error {
+	return u.Lockout.Check(now)
+}
+
+// FailedSignIn records a failed sign in to the users account, locking it after LockoutAttempts in
+// a row. Returns true if this failure locked the account
+func (u *User) FailedSignIn(now time.Time) (bool, error) {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return false, err
+	}
+	if u.Lockout == nil {
+		u.Lockout = &Lockout{}
+	}
+	locked := u.Lockout.Fail(now, LockoutAttempts)
+	return locked, u.Update()
+}
+
+// ClearLockout forgets the users failed sign ins, it is called when they sign in and by administrators
+func (u *User) ClearLockout() error {
+	if u.Lockout == nil {
+		return nil
+	}
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return err
+	}
+	if u.Lockout == nil {
+		return nil
+	}
+	u.Lockout = nil
+	return u.Update()
+}
+
+// ListLockouts returns the users with failed sign ins that haven't expired, locked or not
+func ListLockouts(now time.Time) (map[string]*Lockout, error) {
+	lockouts := make(map[string]*Lockout)
+	for _, username := range database.ListUsers() {
+		user, err := NewUser(username).Get()
+		if err != nil {
+			return nil, fmt.Errorf("reading user '%s': %w", username, err)
+		}
+		if !user.Lockout.Expired(now) {
+			lockouts[username] = user.Lockout
+		}
+	}
+	return lockouts, nil
+}
@@ -0,0 +1,52 @@
+package users
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	defer func(backoff, max, period time.Duration) {
+		SignInBackoff, SignInBackoffMax, LockoutPeriod = backoff, max, period
+	}(SignInBackoff, SignInBackoffMax, LockoutPeriod)
+	SignInBackoff, SignInBackoffMax = time.Second, 5*time.Second
+	LockoutPeriod = time.Hour
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := &Lockout{}
+	if err := l.Check(now); err != nil {
+		t.Fatalf("before any failures: got %v", err)
+	}
+
+	// Each failure doubles the wait, up to the most
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if l.Fail(now, 5) {
+			t.Fatalf("failure %d locked", i+1)
+		}
+		if wait := l.Wait(now); wait != want {
+			t.Errorf("after failure %d: got wait %s, want %s", i+1, wait, want)
+		}
+		if err := l.Check(now); !errors.Is(err, ErrSignInThrottled) {
+			t.Errorf("after failure %d: got %v, want ErrSignInThrottled", i+1, err)
+		}
+		now = now.Add(l.Wait(now))
+	}
+
+	if !l.Fail(now, 5) {
+		t.Fatal("5th failure didn't lock")
+	}
+	if err := l.Check(now.Add(30 * time.Minute)); !errors.Is(err, ErrSignInLocked) {
+		t.Errorf("while locked: got %v, want ErrSignInLocked", err)
+	}
+
+	// Once the lock is over the failures are forgotten
+	now = now.Add(LockoutPeriod + time.Second)
+	if err := l.Check(now); err != nil || !l.Expired(now) {
+		t.Errorf("after lock: got %v, expired %v", err, l.Expired(now))
+	}
+	l.Fail(now, 5)
+	if l.Failures != 1 || l.Wait(now) != time.Second {
+		t.Errorf("failing after lock: got %d failures, wait %s", l.Failures, l.Wait(now))
+	}
+}
@@ -0,0 +1,167 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/blgolden/igendec/schema"
+	"github.com/hjson/hjson-go"
+)
+
+// FileJobOutputLegacy is where older versions kept the output of a job
+const FileJobOutputLegacy = "output.json"
+
+// MigrateChange is a change Migrate made, or would make, to a file in the database
+// Files are named as they are in a snapshot
+type MigrateChange struct {
+	Name string
+	Kind schema.Kind
+	From int
+	To   int
+	Note string
+}
+
+func (c MigrateChange) String() string {
+	if c.Note != "" {
+		return fmt.Sprintf("%s: %s", c.Name, c.Note)
+	}
+	return fmt.Sprintf("%s: %s version %d to %d", c.Name, c.Kind, c.From, c.To)
+}
+
+// Migrate upgrades every document in the database to the current version
+// Jobs from older versions are also given a state record, and their output is moved to
+// where it is kept now. Nothing is written if dryRun is set. The server should be stopped first
+func Migrate(dryRun bool) ([]MigrateChange, error) {
+	var changes []MigrateChange
+	writes := make(map[string][]byte)
+	var removes []string
+	jobs := make(map[string]map[string][]byte) // job directory to the files that matter to the job
+
+	err := database.Snapshot(func(name string, data []byte) error {
+		_, rest, err := splitSnapshotName(name)
+		if err != nil {
+			return nil
+		}
+		if len(rest) == 3 && rest[0]+"/" == PrefixJobs {
+			dir := path.Dir(name)
+			if jobs[dir] == nil {
+				jobs[dir] = make(map[string][]byte)
+			}
+			if rest[2] == FileJobOutput {
+				jobs[dir][FileJobOutput] = nil
+			}
+			switch rest[2] {
+			case FileJobOutputLegacy, FileJobStatus, FileJobProcessingFlag:
+				jobs[dir][rest[2]] = append([]byte(nil), data...)
+			}
+		}
+
+		kind, ok := documentKind(rest)
+		if !ok {
+			return nil
+		}
+		upgraded, from, err := upgradeDocument(kind, data)
+		if err != nil {
+			changes = append(changes, MigrateChange{Name: name, Kind: kind, Note: "can't be upgraded: " + err.Error()})
+		} else if upgraded != nil {
+			changes = append(changes, MigrateChange{Name: name, Kind: kind, From: from, To: schema.Current(kind)})
+			writes[name] = upgraded
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading database: %w", err)
+	}
+
+	for dir, files := range jobs {
+		legacy, hasLegacy := files[FileJobOutputLegacy]
+		_, hasOutput := files[FileJobOutput]
+		if hasLegacy && !hasOutput {
+			data, _, err := upgradeDocument(schema.JobOutput, legacy)
+			if err != nil {
+				changes = append(changes, MigrateChange{Name: dir + "/" + FileJobOutputLegacy, Kind: schema.JobOutput, Note: "can't be upgraded: " + err.Error()})
+				continue
+			}
+			if data == nil {
+				data = legacy
+			}
+			writes[dir+"/"+FileJobOutput] = data
+			removes = append(removes, dir+"/"+FileJobOutputLegacy)
+			changes = append(changes, MigrateChange{Name: dir + "/" + FileJobOutputLegacy, Note: "moved to " + FileJobOutput})
+			hasOutput = true
+		}
+
+		if _, ok := files[FileJobStatus]; ok {
+			continue
+		}
+		state := &JobState{SchemaVersion: schema.Current(schema.JobState), Status: Failed}
+		if _, ok := files[FileJobProcessingFlag]; ok {
+			state.Status = Processing
+			removes = append(removes, dir+"/"+FileJobProcessingFlag)
+		} else if hasOutput {
+			state.Status = Passed
+		}
+		data, err := json.MarshalIndent(state, "", "    ")
+		if err != nil {
+			return nil, err
+		}
+		writes[dir+"/"+FileJobStatus] = data
+		changes = append(changes, MigrateChange{Name: dir + "/" + FileJobStatus, Note: fmt.Sprintf("recorded as %s, from before jobs had a state record", state.Status)})
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	if dryRun {
+		return changes, nil
+	}
+
+	for name, data := range writes {
+		if err = database.RestoreFile(name, data); err != nil {
+			return changes, fmt.Errorf("writing %s: %w", name, err)
+		}
+	}
+	for _, name := range removes {
+		user, rest, _ := splitSnapshotName(name)
+		if err = database.RemoveJobFile(user, rest[1], rest[2]); err != nil {
+			return changes, fmt.Errorf("removing %s: %w", name, err)
+		}
+	}
+	return changes, nil
+}
+
+// documentKind returns the kind of document a file in a user holds
+func documentKind(rest []string) (schema.Kind, bool) {
+	switch {
+	case len(rest) == 1 && (rest[0] == FileProfileFilename || rest[0] == FileProfileLastGood):
+		return schema.Profile, true
+	case len(rest) == 2:
+		return schema.Batch, strings.HasSuffix(rest[1], ".hjson")
+	}
+	switch rest[len(rest)-1] {
+	case FileMasterFilename:
+		return schema.MasterParams, true
+	case FileEcoFilename:
+		return schema.EcoParams, true
+	case FileJobOutput:
+		return schema.JobOutput, len(rest) == 3
+	case FileJobStatus:
+		return schema.JobState, len(rest) == 3
+	}
+	return "", false
+}
+
+// upgradeDocument returns the upgraded document and the version it was, or nil if it is current
+func upgradeDocument(kind schema.Kind, data []byte) ([]byte, int, error) {
+	doc := make(map[string]interface{})
+	if err := hjson.Unmarshal(data, &doc); err != nil {
+		return nil, 0, err
+	}
+	from, err := schema.Upgrade(kind, doc)
+	if err != nil || from == schema.Current(kind) {
+		return nil, from, err
+	}
+	data, err = json.MarshalIndent(doc, "", "    ")
+	return data, from, err
+}
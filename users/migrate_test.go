@@ -0,0 +1,44 @@
+package users
+
+import (
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	useTestDatabase(t)
+	database.RestoreFile("users/bob/profile.hjson", []byte(`{"Username": "bob", "Password": "eA=="}`))
+	database.RestoreFile("users/bob/batches/sweep.hjson", []byte(`{"Name": "sweep", "Base": "weaning"}`))
+	database.RestoreFile("users/bob/jobs/weaning/output.json", []byte(`{}`))
+
+	changes, err := Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 {
+		t.Errorf("dry run: got %d changes, want 4: %v", len(changes), changes)
+	}
+	if _, err = database.ReadJobFile("bob", "weaning", FileJobOutput); err == nil {
+		t.Errorf("dry run moved the output")
+	}
+
+	if _, err = Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	user, err := database.Get("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Access) != 1 || user.Access[0].Path != "*" {
+		t.Errorf("access: got %v, want everything", user.Access)
+	}
+	if batch, err := database.GetBatch("bob", "sweep"); err != nil || batch.Kind != "sweep" {
+		t.Errorf("batch: got %v, %v", batch, err)
+	}
+	if state, err := (&Job{Name: "weaning", user: user}).ReadState(); err != nil || state.Status != Passed {
+		t.Errorf("state: got %v, %v", state, err)
+	}
+
+	if changes, err = Migrate(true); err != nil || len(changes) != 0 {
+		t.Errorf("after migrating: got %v, %v, want no changes", changes, err)
+	}
+}
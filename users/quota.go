@@ -0,0 +1,98 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Quota limits what a user can keep and run, a limit of 0 is no limit
+type Quota struct {
+	Jobs  int   // jobs kept, not counting the trash
+	Bytes int64 // total size of the users jobs, including the trash
+	Runs  int   // jobs queued or running at the same time
+}
+
+// DefaultQuota applies to every user without a quota of their own
+var DefaultQuota Quota
+
+// Quota errors
+var (
+	ErrQuotaJobs  = errors.New("job quota reached")
+	ErrQuotaBytes = errors.New("storage quota reached")
+	ErrQuotaRuns  = errors.New("too many jobs queued or running")
+)
+
+// GetQuota returns the quota of the user, their own if they have one or the default
+func (u *User) GetQuota() Quota {
+	if u.Quota != nil {
+		return *u.Quota
+	}
+	return DefaultQuota
+}
+
+// Usage returns how much of each quota the user is using
+func (u *User) Usage() (Quota, error) {
+	var usage Quota
+	jobs := u.ListJobs()
+	usage.Jobs = len(jobs)
+	for _, name := range jobs {
+		state, err := (&Job{Name: name, user: u}).ReadState()
+		if err != nil {
+			return usage, fmt.Errorf("reading state of job '%s': %w", name, err)
+		}
+		if state.InFlight() {
+			usage.Runs++
+		}
+	}
+
+	var err error
+	if usage.Bytes, err = database.JobsSize(u.Username); err != nil {
+		return usage, fmt.Errorf("measuring jobs: %w", err)
+	}
+	return usage, nil
+}
+
+// CheckQuota returns an error matching one of the quota errors if the user can't create
+// newJobs more jobs and queue runs more. Storage is only checked against what is used now,
+// as the size of a job isn't known until it has run. Users who can't run jobs at all get
+// the error from CheckCanRun
+func (u *User) CheckQuota(newJobs, runs int) error {
+	if err := u.CheckCanRun(); err != nil {
+		return err
+	}
+	quota := u.GetQuota()
+	if quota == (Quota{}) {
+		return nil
+	}
+	usage, err := u.Usage()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case quota.Bytes > 0 && usage.Bytes >= quota.Bytes:
+		return fmt.Errorf("%w: your jobs use %s of the %s you have, delete some and empty the trash before running more",
+			ErrQuotaBytes, FormatBytes(usage.Bytes), FormatBytes(quota.Bytes))
+	case quota.Jobs > 0 && usage.Jobs+newJobs > quota.Jobs:
+		return fmt.Errorf("%w: you have %d of the %d jobs you can keep, delete some before creating more",
+			ErrQuotaJobs, usage.Jobs, quota.Jobs)
+	case quota.Runs > 0 && usage.Runs+runs > quota.Runs:
+		return fmt.Errorf("%w: you have %d of the %d jobs you can run at once, wait for some to finish",
+			ErrQuotaRuns, usage.Runs, quota.Runs)
+	}
+	return nil
+}
+
+// FormatBytes returns a size in bytes in the largest unit it has at least one of, eg: 1.5 MB
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,42 @@
+package users
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckQuota(t *testing.T) {
+	quota := DefaultQuota
+	t.Cleanup(func() { DefaultQuota = quota })
+
+	user := newTestUser(t)
+	for name, status := range map[string]JobStatus{"done": Passed, "running": Processing} {
+		if err := (&Job{Name: name, user: user}).saveState(&JobState{Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage, err := user.Usage()
+	if err != nil || usage.Jobs != 2 || usage.Runs != 1 || usage.Bytes == 0 {
+		t.Fatalf("usage: got %+v, %v", usage, err)
+	}
+
+	DefaultQuota = Quota{Jobs: 3, Runs: 2}
+	for _, tc := range []struct {
+		newJobs, runs int
+		want          error
+	}{
+		{1, 1, nil},
+		{2, 1, ErrQuotaJobs},
+		{0, 2, ErrQuotaRuns},
+	} {
+		if err := user.CheckQuota(tc.newJobs, tc.runs); !errors.Is(err, tc.want) {
+			t.Errorf("%d new jobs and %d runs: got %v, want %v", tc.newJobs, tc.runs, err, tc.want)
+		}
+	}
+
+	// A users own quota replaces the default
+	user.Quota = &Quota{Bytes: usage.Bytes}
+	if err := user.CheckQuota(5, 5); !errors.Is(err, ErrQuotaBytes) {
+		t.Errorf("own quota: got %v, want %v", err, ErrQuotaBytes)
+	}
+}
@@ -0,0 +1,70 @@
+package users
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/blgolden/igendec/logger"
+)
+
+// ErrJobOrphaned is recorded on jobs that were running when the server stopped
+var ErrJobOrphaned = errors.New("the server stopped while the job was running")
+
+// RecoverJobs finds the jobs of every user that were left waiting or running when the server last stopped
+// Waiting jobs are returned to be queued again. Running jobs are returned as well if requeue is true,
+// otherwise they are marked as failed
+func RecoverJobs(requeue bool) []*Job {
+	var jobs []*Job
+	for _, username := range database.ListUsers() {
+		user, err := NewUser(username).Get()
+		if err != nil {
+			logger.Warn("recovering jobs: reading user '%s': %s", username, err)
+			continue
+		}
+
+		for _, name := range user.ListJobs() {
+			job := &Job{Name: name, user: user}
+			state, err := job.ReadState()
+			if err != nil {
+				logger.Warn("recovering jobs: reading state of job '%s' for user '%s': %s", name, username, err)
+				continue
+			}
+			if !state.InFlight() {
+				continue
+			}
+
+			if state.Status == Processing {
+				// Another server sharing the database is still running it
+				recent := time.Since(state.Heartbeat) < 2*HeartbeatInterval
+				if state.ServerPID != os.Getpid() && processAlive(state.ServerPID) && recent {
+					continue
+				}
+
+				// The model can outlive the server, only kill it if the heartbeat is recent
+				// enough that the pid can't have been reused
+				if state.PID != state.ServerPID && processAlive(state.PID) {
+					if recent {
+						if process, err := os.FindProcess(state.PID); err == nil {
+							process.Kill()
+						}
+					} else {
+						logger.Warn("recovering jobs: job '%s' for user '%s' may still be running as pid %d", name, username, state.PID)
+					}
+				}
+
+				if !requeue {
+					logger.Info("recovering jobs: marking job '%s' for user '%s' as failed", name, username)
+					if err = job.MarkFailed(ErrJobOrphaned); err != nil {
+						logger.Warn("recovering jobs: marking job '%s' for user '%s' as failed: %s", name, username, err)
+					}
+					continue
+				}
+			}
+
+			logger.Info("recovering jobs: requeueing job '%s' for user '%s'", name, username)
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
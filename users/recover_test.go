@@ -0,0 +1,138 @@
+package users
+
+import (
+	"os/exec"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/blgolden/igendec/params"
+)
+
+// startProcess starts a process that runs until the test ends, unless it is killed first
+// The returned channel is closed when it exits
+func startProcess(t *testing.T) (int, <-chan struct{}) {
+	t.Helper()
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("starting a process: %s", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		<-exited
+	})
+	return cmd.Process.Pid, exited
+}
+
+// deadPID returns the pid of a process that has exited
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("running a process: %s", err)
+	}
+	return cmd.Process.Pid
+}
+
+// exited returns true if the process of the channel from startProcess exits within wait
+func exited(ch <-chan struct{}, wait time.Duration) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+func TestRecoverJobs(t *testing.T) {
+	for _, requeue := range []bool{true, false} {
+		user := newTestUser(t)
+		mp, err := params.MasterParamsFromFile("../defaultMaster.hjson")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ep, err := params.EcoParamsFromFile("../defaultEcoWeaning.hjson")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now()
+		stalePID, staleExited := startProcess(t)
+		orphanPID, orphanExited := startProcess(t)
+		serverPID, _ := startProcess(t)
+		modelPID, modelExited := startProcess(t)
+		states := map[string]*JobState{
+			"queued": {Status: Queued, Queued: now},
+			"passed": {Status: Passed, Finished: now},
+			// The server died long enough ago that the model's pid could have been reused
+			"stale": {Status: Processing, ServerPID: deadPID(t), PID: stalePID, Heartbeat: now.Add(-time.Hour)},
+			// The server died just now, leaving the model running
+			"orphan": {Status: Processing, ServerPID: deadPID(t), PID: orphanPID, Heartbeat: now},
+			// Another server sharing the database is running it
+			"elsewhere": {Status: Processing, ServerPID: serverPID, PID: modelPID, Heartbeat: now},
+		}
+		for name, state := range states {
+			job, err := user.CreateJob(name, mp, ep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = job.saveState(state); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var got []string
+		for _, job := range RecoverJobs(requeue) {
+			got = append(got, job.Name)
+		}
+		sort.Strings(got)
+		want := []string{"queued"}
+		if requeue {
+			want = []string{"orphan", "queued", "stale"}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("requeue %t: got jobs %v, want %v", requeue, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("requeue %t: got jobs %v, want %v", requeue, got, want)
+			}
+		}
+
+		wantStatus := map[string]JobStatus{"queued": Queued, "passed": Passed, "elsewhere": Processing}
+		for _, name := range []string{"stale", "orphan"} {
+			wantStatus[name] = Processing
+			if !requeue {
+				wantStatus[name] = Failed
+			}
+		}
+		for name, want := range wantStatus {
+			state, err := (&Job{Name: name, user: user}).ReadState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.Status != want {
+				t.Errorf("requeue %t: got job %s %s, want %s", requeue, name, state.Status, want)
+			}
+			if want == Failed && state.Error != ErrJobOrphaned.Error() {
+				t.Errorf("requeue %t: got job %s error %q, want %q", requeue, name, state.Error, ErrJobOrphaned)
+			}
+		}
+
+		// Only the model of the job that was running just now is killed
+		if !exited(orphanExited, 5*time.Second) {
+			t.Errorf("requeue %t: the orphaned model wasn't killed", requeue)
+		}
+		if exited(staleExited, 100*time.Millisecond) {
+			t.Errorf("requeue %t: a process with a stale pid was killed", requeue)
+		}
+		if exited(modelExited, 100*time.Millisecond) {
+			t.Errorf("requeue %t: the model run by another server was killed", requeue)
+		}
+	}
+}
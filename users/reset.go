@@ -0,0 +1,95 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Password reset settings
+var (
+	// ResetPeriod is how long a password reset token can be used for
+	ResetPeriod = time.Hour
+	// ResetInterval is the least time between password reset or email verification tokens for a
+	// user, so they can't be flooded with mail
+	ResetInterval = time.Minute
+)
+
+// Password reset errors
+var (
+	ErrResetInvalid = errors.New("password reset link is not valid, it may have expired or already been used")
+	ErrResetTooSoon = errors.New("a password reset was asked for moments ago")
+)
+
+// PasswordReset is an outstanding password reset for a user
+// Only a hash of the token is kept, the token itself is only in the mail sent to the user
+type PasswordReset struct {
+	Hash    string
+	Created time.Time
+	Expires time.Time
+}
+
+// NewPasswordReset returns a single use token the user can reset their password with until ResetPeriod
+// has passed. It replaces any token they already had. Returns ErrResetTooSoon if they were given one
+// less than ResetInterval ago
+func (u *User) NewPasswordReset(now time.Time) (string, error) {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return "", err
+	}
+	if u.Reset != nil && now.Sub(u.Reset.Created) < ResetInterval {
+		return "", ErrResetTooSoon
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	u.Reset = &PasswordReset{Hash: hash, Created: now, Expires: now.Add(ResetPeriod)}
+	return token, u.Update()
+}
+
+// ResetPassword replaces the users password if token is their outstanding reset token
+// The token can't be used again, and the users sessions and failed sign ins are cleared
+// Returns ErrResetInvalid for a bad or expired token, and ErrInvalidPassword for a bad password
+func (u *User) ResetPassword(token, password string, now time.Time) error {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return ErrResetInvalid
+	}
+	if u.Reset == nil || !now.Before(u.Reset.Expires) || !tokenMatches(token, u.Reset.Hash) {
+		return ErrResetInvalid
+	}
+	if err := u.ValidateAndHashPassword(password); err != nil {
+		return err
+	}
+	u.Reset = nil
+	u.Lockout = nil
+	if err := u.Update(); err != nil {
+		return err
+	}
+	return u.RevokeSessions()
+}
+
+// newToken returns a random token to mail to a user, and the hash of it to keep
+func newToken() (string, string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(data)
+	return token, tokenHash(token), nil
+}
+
+// tokenMatches returns true if token is the one hash was made from
+func tokenMatches(token, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(tokenHash(token)), []byte(hash)) == 1
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
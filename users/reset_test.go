@@ -0,0 +1,57 @@
+package users
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResetPassword(t *testing.T) {
+	user := newTestUser(t)
+	if err := user.ValidateAndHashPassword("password1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Update(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SetSession(&Session{Key: SessionKey([]byte("id")), Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	token, err := user.NewPasswordReset(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = user.NewPasswordReset(now.Add(time.Second)); !errors.Is(err, ErrResetTooSoon) {
+		t.Errorf("second reset straight away: got %v, want ErrResetTooSoon", err)
+	}
+
+	for name, tc := range map[string]struct {
+		token    string
+		password string
+		at       time.Time
+		want     error
+	}{
+		"wrong token":  {"bad", "password2", now, ErrResetInvalid},
+		"expired":      {token, "password2", now.Add(ResetPeriod), ErrResetInvalid},
+		"bad password": {token, "short", now, ErrInvalidPassword},
+	} {
+		if err := NewUser("bob").ResetPassword(tc.token, tc.password, tc.at); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", name, err, tc.want)
+		}
+	}
+
+	if err = NewUser("bob").ResetPassword(token, "password2", now); err != nil {
+		t.Fatal(err)
+	}
+	if err = NewUser("bob").ResetPassword(token, "password3", now); !errors.Is(err, ErrResetInvalid) {
+		t.Errorf("reusing token: got %v, want ErrResetInvalid", err)
+	}
+	if _, err = user.Get(); err != nil || user.ComparePassword("password2") != nil {
+		t.Errorf("new password not set: %v", err)
+	}
+	if sessions, _ := user.ListSessions(); len(sessions) != 0 {
+		t.Errorf("sessions after reset: got %d, want 0", len(sessions))
+	}
+}
@@ -0,0 +1,136 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Role is what a user can do on the server
+type Role string
+
+// Roles a user can have, users without one are RoleUser
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+// Roles lists every role
+var Roles = []Role{RoleUser, RoleAdmin}
+
+// Administration errors
+var (
+	ErrBadRole         = errors.New("no such role")
+	ErrBadAccess       = errors.New("access paths can't be empty or have spaces")
+	ErrAccountDisabled = errors.New("account is disabled")
+)
+
+// ParseRole returns the role named s, or ErrBadRole
+func ParseRole(s string) (Role, error) {
+	for _, role := range Roles {
+		if string(role) == s {
+			return role, nil
+		}
+	}
+	return "", fmt.Errorf("%w: '%s'", ErrBadRole, s)
+}
+
+// GetRole returns the users role, RoleUser if they don't have one
+func (u *User) GetRole() Role {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
+
+// IsAdmin returns true if the user is a server administrator
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// SetRole changes the users role
+func (u *User) SetRole(role Role) error {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return err
+	}
+	u.Role = role
+	if role == RoleUser {
+		u.Role = ""
+	}
+	return u.Update()
+}
+
+// SetAccess replaces the users Access
+func (u *User) SetAccess(access Access) error {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return err
+	}
+	u.Access = access
+	return u.Update()
+}
+
+// SetDisabled disables or enables the users account
+// Disabled users can't sign in, and are signed out of every session
+func (u *User) SetDisabled(disabled bool) error {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return err
+	}
+	u.Disabled = disabled
+	if err := u.Update(); err != nil || !disabled {
+		return err
+	}
+	return u.RevokeSessions()
+}
+
+// ParseAccess reads Access written by Access.Text, one path a line with denied paths
+// starting with '!'. Blank lines are ignored
+func ParseAccess(text string) (Access, error) {
+	access := Access{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		path := AccessPath{Path: strings.TrimPrefix(line, "!"), Deny: strings.HasPrefix(line, "!")}
+		if path.Path == "" || strings.ContainsAny(path.Path, " \t") {
+			return nil, fmt.Errorf("%w: '%s'", ErrBadAccess, line)
+		}
+		access = append(access, path)
+	}
+	return access, nil
+}
+
+// Text returns the access one path a line, with denied paths starting with '!'
+func (a Access) Text() string {
+	lines := make([]string, len(a))
+	for i, path := range a {
+		lines[i] = path.Path
+		if path.Deny {
+			lines[i] = "!" + path.Path
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// FindUsers returns the users whose username, name or email contains query, ignoring case,
+// sorted by username. An empty query returns every user
+func FindUsers(query string) ([]*User, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	var found []*User
+	for _, username := range database.ListUsers() {
+		user, err := NewUser(username).Get()
+		if err != nil {
+			return nil, fmt.Errorf("reading user '%s': %w", username, err)
+		}
+		fields := strings.ToLower(strings.Join([]string{user.Username, user.Firstname, user.Surname, user.Email}, "\n"))
+		if strings.Contains(fields, query) {
+			found = append(found, user)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Username < found[j].Username })
+	return found, nil
+}
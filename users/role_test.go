@@ -0,0 +1,94 @@
+package users
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseAccess(t *testing.T) {
+	access, err := ParseAccess("*\n\n  !angus/*\nangus/public \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Access{{Path: "*"}, {Path: "angus/*", Deny: true}, {Path: "angus/public"}}
+	if !reflect.DeepEqual(access, want) {
+		t.Errorf("got %v, want %v", access, want)
+	}
+	if again, err := ParseAccess(access.Text()); err != nil || !reflect.DeepEqual(again, want) {
+		t.Errorf("parsing Text again: got %v, %v, want %v", again, err, want)
+	}
+	for _, text := range []string{"!", "angus public"} {
+		if _, err = ParseAccess(text); !errors.Is(err, ErrBadAccess) {
+			t.Errorf("%q: got %v, want ErrBadAccess", text, err)
+		}
+	}
+}
+
+func TestGetDefaultsAccess(t *testing.T) {
+	user := newTestUser(t)
+	if err := user.SetAccess(Access{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := user.Get(); err != nil || !reflect.DeepEqual(user.Access, defaultAccess) {
+		t.Errorf("no access list: got %v, %v, want %v", user.Access, err, defaultAccess)
+	}
+
+	want := Access{{Path: "angus/*"}}
+	if err := user.SetAccess(want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := user.Get(); err != nil || !reflect.DeepEqual(user.Access, want) {
+		t.Errorf("got %v, %v, want %v", user.Access, err, want)
+	}
+}
+
+func TestAdministerUsers(t *testing.T) {
+	useTestDatabase(t)
+	for _, username := range []string{"carol", "alice", "bob"} {
+		user := NewUser(username)
+		user.Email = username + "@example.com"
+		if err := database.Create(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := database.SetSession(&Session{Key: SessionKey([]byte("id")), Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := FindUsers("")
+	if err != nil || len(found) != 3 || found[0].Username != "alice" {
+		t.Errorf("find every user: got %v, %v", found, err)
+	}
+	if found, err = FindUsers("BOB@"); err != nil || len(found) != 1 || found[0].Username != "bob" {
+		t.Errorf("find by email: got %v, %v", found, err)
+	}
+
+	bob := NewUser("bob")
+	if err = bob.SetRole(RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bob.Get(); err != nil || !bob.IsAdmin() {
+		t.Errorf("bob isn't an admin after SetRole")
+	}
+	if err = bob.SetRole(RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if bob.Role != "" || bob.GetRole() != RoleUser {
+		t.Errorf("role after SetRole(RoleUser): got %q", bob.Role)
+	}
+
+	if err = bob.SetDisabled(true); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := bob.ListSessions(); err != nil || len(sessions) != 0 {
+		t.Errorf("sessions after disabling: got %d, %v, want none", len(sessions), err)
+	}
+	if _, err = bob.Get(); err != nil || !bob.Disabled {
+		t.Error("bob isn't disabled after SetDisabled")
+	}
+
+	if err = NewUser("dave").SetRole(RoleAdmin); !errors.Is(err, ErrUserDoesntExist) {
+		t.Errorf("missing user: got %v, want ErrUserDoesntExist", err)
+	}
+}
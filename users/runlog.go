@@ -0,0 +1,94 @@
+package users
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// maxRunOutput is the most stdout or stderr we keep from a single run
+const maxRunOutput = 1 << 20
+
+// RunLog records what happened during a single run of a job
+type RunLog struct {
+	CommandLine string
+	Started     time.Time
+	Finished    time.Time
+	ExitCode    int
+	Status      JobStatus
+	Error       string
+
+	Stdout limitedBuffer
+	Stderr limitedBuffer
+}
+
+// Bytes returns the log in the plain text format it is stored in
+func (l *RunLog) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%-11s%s\n", "command:", l.CommandLine)
+	fmt.Fprintf(buf, "%-11s%s\n", "started:", l.Started.Format(time.RFC3339))
+	fmt.Fprintf(buf, "%-11s%s\n", "finished:", l.Finished.Format(time.RFC3339))
+	fmt.Fprintf(buf, "%-11s%s\n", "duration:", l.Finished.Sub(l.Started).Round(time.Millisecond))
+	fmt.Fprintf(buf, "%-11s%d\n", "exit code:", l.ExitCode)
+	fmt.Fprintf(buf, "%-11s%s\n", "status:", l.Status)
+	if l.Error != "" {
+		fmt.Fprintf(buf, "%-11s%s\n", "error:", l.Error)
+	}
+	writeSection(buf, "stdout", &l.Stdout)
+	writeSection(buf, "stderr", &l.Stderr)
+	return buf.Bytes()
+}
+
+func writeSection(buf *bytes.Buffer, name string, out *limitedBuffer) {
+	fmt.Fprintf(buf, "\n----- %s -----\n", name)
+	buf.Write(out.Bytes())
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	if out.truncated {
+		fmt.Fprintf(buf, "[%s truncated after %d bytes]\n", name, maxRunOutput)
+	}
+}
+
+// exitCode returns the exit code of a finished run
+// -1 is returned if the process didn't exit by itself, eg: it was killed
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// RunLog returns the run log from the last time this job was run
+func (job *Job) RunLog() ([]byte, error) {
+	return database.ReadJobFile(job.user.Username, job.Name, FileJobRunLog)
+}
+
+// writeRunLog saves the run log with the job
+func (job *Job) writeRunLog(l *RunLog) error {
+	return database.WriteJobFile(job.user.Username, job.Name, FileJobRunLog, l.Bytes())
+}
+
+// limitedBuffer is a buffer that stops growing at maxRunOutput
+// Writes never fail so the process being run isn't affected
+type limitedBuffer struct {
+	bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxRunOutput - b.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,113 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Runner runs the iGenDec model for a job
+// Job.Run goes through JobRunner so the model can be swapped out or simulated
+type Runner interface {
+	Run(ctx context.Context, spec RunSpec) error
+
+	// CommandLine describes what Run will do for the spec, it is recorded in the jobs run log
+	CommandLine(spec RunSpec) string
+}
+
+// RunSpec holds the files a single run of the model reads from and writes to
+// and where the output of the run should go
+type RunSpec struct {
+	MasterFile   string
+	EcoFile      string
+	OutputFile   string
+	DatabasePath string
+
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Started is called with the pid of the process doing the work once it has started
+	Started func(pid int)
+}
+
+// JobRunner is the runner used to run every job
+// Set this on startup to change how jobs are run
+var JobRunner Runner = NewExecRunner("starter", nil)
+
+// Placeholders that are replaced in the arguments of an ExecRunner
+const (
+	ArgMasterFile   = "{master}"
+	ArgEcoFile      = "{eco}"
+	ArgOutputFile   = "{output}"
+	ArgDatabasePath = "{database}"
+)
+
+// DefaultStarterArgs are the arguments the starter binary expects
+var DefaultStarterArgs = []string{
+	"-genParm", ArgMasterFile,
+	"-indexParm", ArgEcoFile,
+	"-outputFile", ArgOutputFile,
+	"-database-path", ArgDatabasePath,
+	"-outputMode", "none",
+}
+
+// ExecRunner runs the model as an external binary
+type ExecRunner struct {
+	Path string
+	Args []string
+}
+
+// NewExecRunner returns a runner for the binary at path
+// If no arguments are given DefaultStarterArgs are used
+func NewExecRunner(path string, args []string) *ExecRunner {
+	if len(args) == 0 {
+		args = DefaultStarterArgs
+	}
+	return &ExecRunner{Path: path, Args: args}
+}
+
+// Command returns the arguments the binary will be run with for the given spec
+func (r *ExecRunner) Command(spec RunSpec) []string {
+	replacer := strings.NewReplacer(
+		ArgMasterFile, spec.MasterFile,
+		ArgEcoFile, spec.EcoFile,
+		ArgOutputFile, spec.OutputFile,
+		ArgDatabasePath, spec.DatabasePath,
+	)
+	args := make([]string, len(r.Args))
+	for idx, arg := range r.Args {
+		args[idx] = replacer.Replace(arg)
+	}
+	return args
+}
+
+// CommandLine returns the binary and its arguments as they would be typed into a shell
+func (r *ExecRunner) CommandLine(spec RunSpec) string {
+	parts := append([]string{r.Path}, r.Command(spec)...)
+	for idx, part := range parts {
+		if part == "" || strings.ContainsAny(part, " \t\"'") {
+			parts[idx] = strconv.Quote(part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Run runs the binary and waits for it to exit
+func (r *ExecRunner) Run(ctx context.Context, spec RunSpec) error {
+	cmd := exec.CommandContext(ctx, r.Path, r.Command(spec)...)
+	cmd.Stdout = spec.Stdout
+	cmd.Stderr = spec.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting %s: %w", r.Path, err)
+	}
+	if spec.Started != nil {
+		spec.Started(cmd.Process.Pid)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("running %s: %w", r.Path, err)
+	}
+	return nil
+}
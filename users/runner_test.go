@@ -0,0 +1,183 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/blgolden/igendec/params"
+)
+
+func TestExecRunnerCommand(t *testing.T) {
+	r := NewExecRunner("starter", nil)
+	spec := RunSpec{MasterFile: "m.hjson", EcoFile: "e.hjson", OutputFile: "o.hjson", DatabasePath: "/db"}
+
+	want := []string{"-genParm", "m.hjson", "-indexParm", "e.hjson", "-outputFile", "o.hjson", "-database-path", "/db", "-outputMode", "none"}
+	if got := r.Command(spec); !reflect.DeepEqual(got, want) {
+		t.Errorf("default args: got %v, want %v", got, want)
+	}
+
+	r = NewExecRunner("starter-v2", []string{"--in={master},{eco}", "--out", "{output}"})
+	want = []string{"--in=m.hjson,e.hjson", "--out", "o.hjson"}
+	if got := r.Command(spec); !reflect.DeepEqual(got, want) {
+		t.Errorf("custom args: got %v, want %v", got, want)
+	}
+}
+
+func TestSimulatedRunner(t *testing.T) {
+	dir := t.TempDir()
+	spec := RunSpec{
+		MasterFile: filepath.Join(dir, FileMasterFilename),
+		EcoFile:    filepath.Join(dir, FileEcoFilename),
+		OutputFile: filepath.Join(dir, FileJobOutput),
+	}
+
+	mp, err := params.MasterParamsFromFile("../defaultMaster.hjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := params.EcoParamsFromFile("../defaultEcoWeaning.hjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeParams(t, spec, mp, ep)
+
+	r := &SimulatedRunner{}
+	if err := r.Run(context.Background(), spec); err != nil {
+		t.Fatal(err)
+	}
+	first, err := os.ReadFile(spec.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := parseJob(bytes.NewBuffer(first))
+	if err != nil {
+		t.Fatalf("parsing simulated output: %s", err)
+	}
+	if len(job.Output) != len(ep.IndexComponents) {
+		t.Fatalf("got %d index elements, want %d", len(job.Output), len(ep.IndexComponents))
+	}
+
+	// Same inputs give the same output
+	if err := r.Run(context.Background(), spec); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := os.ReadFile(spec.OutputFile)
+	if !bytes.Equal(first, second) {
+		t.Error("simulated output is not deterministic")
+	}
+
+	// Raising the AUM cost makes mature weight more expensive
+	for idx := range ep.AumCost {
+		ep.AumCost[idx] *= 2
+	}
+	writeParams(t, spec, mp, ep)
+	if err := r.Run(context.Background(), spec); err != nil {
+		t.Fatal(err)
+	}
+	third, _ := os.ReadFile(spec.OutputFile)
+	changed, _ := parseJob(bytes.NewBuffer(third))
+	for idx, el := range changed.Output {
+		if el.Trait == "MW" && el.MarginalEconomicValue >= job.Output[idx].MarginalEconomicValue {
+			t.Errorf("MW mev did not fall with AUM cost: %f -> %f", job.Output[idx].MarginalEconomicValue, el.MarginalEconomicValue)
+		}
+	}
+}
+
+func writeParams(t *testing.T, spec RunSpec, mp *params.MasterParams, ep *params.EcoParams) {
+	t.Helper()
+	data, _ := mp.Bytes()
+	if err := os.WriteFile(spec.MasterFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ep.Bytes()
+	if err := os.WriteFile(spec.EcoFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// inputsRunner records the model inputs it is given
+type inputsRunner struct {
+	master, eco []byte
+}
+
+func (r *inputsRunner) Run(ctx context.Context, spec RunSpec) (err error) {
+	if r.master, err = os.ReadFile(spec.MasterFile); err != nil {
+		return err
+	}
+	r.eco, err = os.ReadFile(spec.EcoFile)
+	return err
+}
+
+func (r *inputsRunner) CommandLine(spec RunSpec) string { return "inputs" }
+
+func TestRunLeavesOutSchemaVersion(t *testing.T) {
+	jobRunner := JobRunner
+	t.Cleanup(func() { JobRunner = jobRunner })
+
+	user := newTestUser(t)
+	mp, err := params.MasterParamsFromFile("../defaultMaster.hjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := params.EcoParamsFromFile("../defaultEcoWeaning.hjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := user.CreateJob("job", mp, ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner := &inputsRunner{}
+	JobRunner = runner
+	job.Run(context.Background(), "")
+	for name, data := range map[string][]byte{"master": runner.master, "eco": runner.eco} {
+		if len(data) == 0 || bytes.Contains(data, []byte("schemaVersion")) {
+			t.Errorf("%s params given to the model: %s", name, data)
+		}
+	}
+	if stored, _ := database.ReadJobFile("bob", "job", FileMasterFilename); !bytes.Contains(stored, []byte("schemaVersion")) {
+		t.Error("stored master params lost their schema version")
+	}
+}
+
+func TestRunLogsFailureBeforeRunning(t *testing.T) {
+	user := newTestUser(t)
+	mp, err := params.MasterParamsFromFile("../defaultMaster.hjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := params.EcoParamsFromFile("../defaultEcoWeaning.hjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := user.CreateJob("job", mp, ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The model inputs can't be written without a temporary directory
+	tmp := os.Getenv("TMPDIR")
+	t.Cleanup(func() { os.Setenv("TMPDIR", tmp) })
+	os.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+
+	if err = job.Run(context.Background(), ""); err == nil {
+		t.Fatal("got no error without a temporary directory")
+	}
+	log, err := job.RunLog()
+	if err != nil {
+		t.Fatalf("reading run log: %v", err)
+	}
+	for _, want := range []string{"status:    failed", "error:     writing model inputs"} {
+		if !bytes.Contains(log, []byte(want)) {
+			t.Errorf("run log doesn't have %q:\n%s", want, log)
+		}
+	}
+	if status := job.CurrentStatus(); status != Failed {
+		t.Errorf("got status %s, want failed", status)
+	}
+}
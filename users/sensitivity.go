@@ -0,0 +1,234 @@
+package users
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blgolden/igendec/params"
+)
+
+// SensitivitySuffix is added to the name of a job to name its sensitivity analysis
+const SensitivitySuffix = "-sensitivity"
+
+// ErrBaseNotPassed is returned when a job can't be analysed as it has no results
+var ErrBaseNotPassed = errors.New("the job needs to have passed before it can be analysed")
+
+// SensitivityInput is an economic input that can be changed in a sensitivity analysis
+type SensitivityInput struct {
+	Name string
+	Path string
+}
+
+// SensitivityInputs are the inputs offered for sensitivity analysis
+var SensitivityInputs = []SensitivityInput{
+	{"Sale price per cwt", "eco.traitSexPricePerCwt[*][4]"},
+	{"Cow AUM cost", "eco.aumCost[*]"},
+	{"Background AUM cost", "eco.backgroundAumCost[*]"},
+	{"Feedlot feed cost", "eco.feedlotFeedCost"},
+}
+
+// SensitivityInputsFor returns the inputs that make a difference to the given parameters
+// Inputs that are missing or zero for the jobs sale endpoint are left out
+func SensitivityInputsFor(mp *params.MasterParams, ep *params.EcoParams) []SensitivityInput {
+	base, err := ep.Bytes()
+	if err != nil {
+		return nil
+	}
+	var inputs []SensitivityInput
+	for _, in := range SensitivityInputs {
+		tmp := *ep
+		if err := params.ApplyPath(mp, &tmp, in.Path, "+10%"); err != nil {
+			continue
+		}
+		if changed, err := tmp.Bytes(); err == nil && !bytes.Equal(base, changed) {
+			inputs = append(inputs, in)
+		}
+	}
+	return inputs
+}
+
+// CreateSensitivity creates the jobs for a sensitivity analysis of a job, and saves the batch
+// Each input is moved down and then up by percent on its own, giving two jobs per input.
+// The jobs are returned to be queued by the caller. An earlier analysis, or jobs of the same names,
+// are only replaced if overwrite is set
+func (u *User) CreateSensitivity(base string, percent float64, inputs []SensitivityInput, overwrite bool) (*Batch, []*Job, error) {
+	if len(inputs) == 0 {
+		return nil, nil, fmt.Errorf("%w: no inputs to change", ErrBadSweep)
+	}
+	if percent <= 0 || percent >= 100 {
+		return nil, nil, fmt.Errorf("%w: the change must be between 0 and 100%%", ErrBadSweep)
+	}
+	if 2*len(inputs) > MaxBatchJobs {
+		return nil, nil, fmt.Errorf("%w: the most allowed is %d", ErrBatchTooLarge, MaxBatchJobs)
+	}
+	if job, err := u.GetJob(base); err != nil || job.Status != Passed {
+		return nil, nil, ErrBaseNotPassed
+	}
+
+	pct := strconv.FormatFloat(percent, 'f', -1, 64)
+	b := &Batch{user: u, Kind: BatchSensitivity, Name: base + SensitivitySuffix, Base: base, Created: time.Now()}
+	var combinations [][]string
+	for i, in := range inputs {
+		b.Sweeps = append(b.Sweeps, Sweep{Name: in.Name, Path: in.Path, Values: []string{"-" + pct + "%", "+" + pct + "%"}})
+		for _, v := range b.Sweeps[i].Values {
+			values := make([]string, len(inputs))
+			values[i] = v
+			combinations = append(combinations, values)
+		}
+	}
+
+	jobs, err := u.createBatch(b, combinations, overwrite)
+	return b, jobs, err
+}
+
+// GetSensitivity returns the sensitivity analysis of a job
+func (u *User) GetSensitivity(job string) (*Batch, error) {
+	return u.GetBatch(job + SensitivitySuffix)
+}
+
+// SensitivityReport is how much the MEVs of a job move when each input is changed
+// Percent is how far each input was moved, eg. 10%
+type SensitivityReport struct {
+	Percent  string
+	Pending  int
+	Elements []SensitivityElement
+}
+
+// SensitivityElement is the effect of every input on one index element
+// Effects are sorted with the largest swing first, to draw as a tornado
+type SensitivityElement struct {
+	Label   string
+	BaseMEV float64
+	Effects []SensitivityEffect
+}
+
+// SensitivityEffect is how an index elements MEV changed when one input was moved down and up
+// Complete is false until both jobs have passed
+type SensitivityEffect struct {
+	Input           string
+	Low, High       float64
+	LowChange       float64
+	HighChange      float64
+	LowPct, HighPct string // percentage change, empty when the base MEV is 0
+	Swing           float64
+	Complete        bool
+	hasLow, hasHigh bool
+}
+
+// Sensitivity builds the report of a sensitivity analysis from its jobs
+func (b *Batch) Sensitivity() (*SensitivityReport, error) {
+	if b.Kind != BatchSensitivity {
+		return nil, fmt.Errorf("batch %s is not a sensitivity analysis", b.Name)
+	}
+	base, err := b.user.GetJob(b.Base)
+	if err != nil {
+		return nil, fmt.Errorf("getting base job: %w", err)
+	}
+	if base.Status != Passed {
+		return nil, ErrBaseNotPassed
+	}
+
+	r := &SensitivityReport{}
+	if len(b.Sweeps) > 0 && len(b.Sweeps[0].Values) > 0 {
+		r.Percent = strings.TrimLeft(b.Sweeps[0].Values[0], "+-")
+	}
+
+	index := make(map[string]int)
+	for _, el := range base.Output {
+		index[el.Key()] = len(r.Elements)
+		e := SensitivityElement{Label: el.Trait.String() + " " + el.Component.String(), BaseMEV: el.MarginalEconomicValue}
+		for _, s := range b.Sweeps {
+			e.Effects = append(e.Effects, SensitivityEffect{Input: sweepLabel(s)})
+		}
+		r.Elements = append(r.Elements, e)
+	}
+
+	for _, bj := range b.Jobs {
+		input, low := -1, false
+		for i, v := range bj.Values {
+			if v != "" {
+				input, low = i, v[0] == '-'
+			}
+		}
+		job, err := b.user.GetJob(bj.Name)
+		if input < 0 || err != nil {
+			continue
+		}
+		if job.InProgress() {
+			r.Pending++
+		}
+		if job.Status != Passed {
+			continue
+		}
+		for _, el := range job.Output {
+			idx, ok := index[el.Key()]
+			if !ok {
+				continue
+			}
+			effect := &r.Elements[idx].Effects[input]
+			if low {
+				effect.Low, effect.hasLow = el.MarginalEconomicValue, true
+			} else {
+				effect.High, effect.hasHigh = el.MarginalEconomicValue, true
+			}
+		}
+	}
+
+	for i := range r.Elements {
+		e := &r.Elements[i]
+		for j := range e.Effects {
+			effect := &e.Effects[j]
+			effect.Complete = effect.hasLow && effect.hasHigh
+			if !effect.Complete {
+				continue
+			}
+			effect.LowChange = effect.Low - e.BaseMEV
+			effect.HighChange = effect.High - e.BaseMEV
+			effect.Swing = math.Abs(effect.High - effect.Low)
+			if e.BaseMEV != 0 {
+				effect.LowPct = strconv.FormatFloat(100*effect.LowChange/math.Abs(e.BaseMEV), 'f', 1, 64)
+				effect.HighPct = strconv.FormatFloat(100*effect.HighChange/math.Abs(e.BaseMEV), 'f', 1, 64)
+			}
+		}
+		sort.SliceStable(e.Effects, func(a, b int) bool { return e.Effects[a].Swing > e.Effects[b].Swing })
+	}
+	return r, nil
+}
+
+// WriteCSV writes the report as CSV, one row per index element and input
+func (r *SensitivityReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Index Element", "Input", "Base MEV", "MEV at -" + r.Percent, "MEV at +" + r.Percent, "Change Low", "Change High", "Swing"})
+	for _, e := range r.Elements {
+		for _, effect := range e.Effects {
+			record := []string{e.Label, effect.Input, formatMEV(e.BaseMEV), "", "", "", "", ""}
+			if effect.Complete {
+				record[3], record[4] = formatMEV(effect.Low), formatMEV(effect.High)
+				record[5], record[6] = formatMEV(effect.LowChange), formatMEV(effect.HighChange)
+				record[7] = formatMEV(effect.Swing)
+			}
+			cw.Write(record)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func sweepLabel(s Sweep) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Path
+}
+
+func formatMEV(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
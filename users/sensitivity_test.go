@@ -0,0 +1,131 @@
+package users
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+// passJob records the job as passed with the given marginal economic values, keyed by IndexElement.Key
+func passJob(t *testing.T, job *Job, mevs map[string]float64) {
+	t.Helper()
+	var elements []IndexElement
+	for key, mev := range mevs {
+		tc := strings.SplitN(key, ",", 2)
+		elements = append(elements, IndexElement{Trait: trait(tc[0]), Component: component(tc[1]), MarginalEconomicValue: mev})
+	}
+	passJobOutput(t, job, elements...)
+}
+
+// passJobOutput records the job as passed with the given output
+func passJobOutput(t *testing.T, job *Job, elements ...IndexElement) {
+	t.Helper()
+	data, err := json.Marshal(struct {
+		IndexElements []IndexElement `json:"indexElement"`
+	}{elements})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = database.WriteJobFile(job.user.Username, job.Name, FileJobOutput, data); err != nil {
+		t.Fatal(err)
+	}
+	if err = job.saveState(&JobState{Status: Passed}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSensitivity(t *testing.T) {
+	user := newTestUser(t)
+	base := newTestJobs(t, user, "base")[0]
+	passJob(t, base, map[string]float64{"WW,D": 2, "MW,M": -1, "STAY,D": 0})
+
+	b, jobs, err := user.CreateSensitivity("base", 10, SensitivityInputs[:2], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 4 {
+		t.Fatalf("got %d jobs, want 4", len(jobs))
+	}
+	// Each input is moved down then up, the Cow AUM cost run moved down has no STAY output
+	for i, mevs := range []map[string]float64{
+		{"WW,D": 1.6, "MW,M": -0.9, "STAY,D": 0.1},
+		{"WW,D": 2.5, "MW,M": -1.2, "STAY,D": 0.3},
+		{"WW,D": 2.1, "MW,M": -0.5},
+		{"WW,D": 1.9, "MW,M": -1.5, "STAY,D": 0.2},
+	} {
+		passJob(t, jobs[i], mevs)
+	}
+
+	r, err := b.Sensitivity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Percent != "10%" || r.Pending != 0 {
+		t.Errorf("got percent %q and %d pending, want 10%% and 0", r.Percent, r.Pending)
+	}
+
+	sale, aum := SensitivityInputs[0].Name, SensitivityInputs[1].Name
+	want := []SensitivityElement{
+		{Label: "WW Direct", BaseMEV: 2, Effects: []SensitivityEffect{
+			{Input: sale, Low: 1.6, High: 2.5, LowChange: -0.4, HighChange: 0.5, LowPct: "-20.0", HighPct: "25.0", Swing: 0.9, Complete: true},
+			{Input: aum, Low: 2.1, High: 1.9, LowChange: 0.1, HighChange: -0.1, LowPct: "5.0", HighPct: "-5.0", Swing: 0.2, Complete: true},
+		}},
+		// The percentage change is of the size of a negative base
+		{Label: "MW Maternal", BaseMEV: -1, Effects: []SensitivityEffect{
+			{Input: aum, Low: -0.5, High: -1.5, LowChange: 0.5, HighChange: -0.5, LowPct: "50.0", HighPct: "-50.0", Swing: 1, Complete: true},
+			{Input: sale, Low: -0.9, High: -1.2, LowChange: 0.1, HighChange: -0.2, LowPct: "10.0", HighPct: "-20.0", Swing: 0.3, Complete: true},
+		}},
+		// No percentage change from a base of 0, and an input missing a run isn't complete
+		{Label: "STAY Direct", BaseMEV: 0, Effects: []SensitivityEffect{
+			{Input: sale, Low: 0.1, High: 0.3, LowChange: 0.1, HighChange: 0.3, Swing: 0.2, Complete: true},
+			{Input: aum, High: 0.2},
+		}},
+	}
+
+	got := make(map[string]SensitivityElement)
+	for _, e := range r.Elements {
+		got[e.Label] = e
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d index elements, want %d", len(got), len(want))
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for _, w := range want {
+		g, ok := got[w.Label]
+		if !ok {
+			t.Errorf("no index element %s", w.Label)
+			continue
+		}
+		if !near(g.BaseMEV, w.BaseMEV) || len(g.Effects) != len(w.Effects) {
+			t.Errorf("%s: got base %v with %d effects, want %v with %d", w.Label, g.BaseMEV, len(g.Effects), w.BaseMEV, len(w.Effects))
+			continue
+		}
+		for i, we := range w.Effects {
+			ge := g.Effects[i]
+			if ge.Input != we.Input || ge.Complete != we.Complete || ge.LowPct != we.LowPct || ge.HighPct != we.HighPct ||
+				!near(ge.Low, we.Low) || !near(ge.High, we.High) || !near(ge.LowChange, we.LowChange) ||
+				!near(ge.HighChange, we.HighChange) || !near(ge.Swing, we.Swing) {
+				t.Errorf("%s effect %d: got %+v, want %+v", w.Label, i, ge, we)
+			}
+		}
+	}
+
+	// A run waiting to be redone counts as pending, and its input as incomplete
+	if err = jobs[0].MarkQueued(); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = b.Sensitivity(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Pending != 1 {
+		t.Errorf("got %d pending, want 1", r.Pending)
+	}
+	for _, e := range r.Elements {
+		for _, effect := range e.Effects {
+			if effect.Input == sale && effect.Complete {
+				t.Errorf("%s: got the sale price complete with a run pending", e.Label)
+			}
+		}
+	}
+}
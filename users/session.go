@@ -0,0 +1,114 @@
+package users
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Session is a signed in session, kept in the database so it survives restarts
+// Sessions are kept by a key derived from their id, so the ids themselves, which are as good as
+// a password, are only ever known to the browser
+type Session struct {
+	Key       string
+	Username  string `json:",omitempty"` // empty until the session is signed in
+	Data      []byte // the session values, as encoded by the session library
+	Created   time.Time
+	LastSeen  time.Time
+	IP        string `json:",omitempty"`
+	UserAgent string `json:",omitempty"`
+}
+
+// SessionKey returns the key a session is kept by
+func SessionKey(id []byte) string {
+	sum := sha256.Sum256(id)
+	return hex.EncodeToString(sum[:])
+}
+
+// validSessionKey returns true if key could have come from SessionKey, so it is safe to use in a path
+func validSessionKey(key string) bool {
+	if len(key) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// Bytes returns the session as it is stored
+func (s *Session) Bytes() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// parseSession reads a session as it is stored
+func parseSession(data []byte) (*Session, error) {
+	s := &Session{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetSession returns a session, errors match os.ErrNotExist if there is no such session
+func GetSession(key string) (*Session, error) {
+	return database.GetSession(key)
+}
+
+// SetSession stores a session, replacing any with the same key
+func SetSession(s *Session) error {
+	return database.SetSession(s)
+}
+
+// DeleteSession removes a session, it is not an error if it doesn't exist
+func DeleteSession(key string) error {
+	return database.DeleteSession(key)
+}
+
+// ListSessions returns every session in the database
+func ListSessions() ([]*Session, error) {
+	return database.ListSessions()
+}
+
+// ListSessions returns the sessions the user is signed in with, most recently seen first
+func (u *User) ListSessions() ([]*Session, error) {
+	all, err := database.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*Session
+	for _, s := range all {
+		if s.Username == u.Username {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+	return sessions, nil
+}
+
+// RevokeSession signs the user out of one of their sessions
+// Errors match os.ErrNotExist if the user has no such session
+func (u *User) RevokeSession(key string) error {
+	s, err := database.GetSession(key)
+	if err != nil {
+		return err
+	}
+	if s.Username != u.Username {
+		return notExist(PrefixSessions, key)
+	}
+	return database.DeleteSession(key)
+}
+
+// RevokeSessions signs the user out of every session
+func (u *User) RevokeSessions() error {
+	sessions, err := u.ListSessions()
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if err = database.DeleteSession(s.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blgolden/igendec/params"
+)
+
+// SimulatedRunner is a stand in for the starter binary
+// It writes a deterministic but plausible output file from the job parameters
+// so the app can be demoed and tested on machines without the model
+type SimulatedRunner struct {
+	// Delay is how long a run pretends to take
+	Delay time.Duration
+}
+
+// Run writes the simulated output for the spec
+func (r *SimulatedRunner) Run(ctx context.Context, spec RunSpec) error {
+	if spec.Started != nil {
+		spec.Started(os.Getpid())
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(r.Delay):
+	}
+
+	mp, err := params.MasterParamsFromFile(spec.MasterFile)
+	if err != nil {
+		return fmt.Errorf("reading master params: %w", err)
+	}
+	ep, err := params.EcoParamsFromFile(spec.EcoFile)
+	if err != nil {
+		return fmt.Errorf("reading eco params: %w", err)
+	}
+
+	elements := simulateIndex(mp, ep)
+	data, err := json.MarshalIndent(struct {
+		IndexElements []IndexElement `json:"indexElement"`
+	}{elements}, "", "    ")
+	if err != nil {
+		return fmt.Errorf("encoding output: %w", err)
+	}
+	if spec.Stdout != nil {
+		fmt.Fprintf(spec.Stdout, "simulated %d index elements\n", len(elements))
+	}
+	return os.WriteFile(spec.OutputFile, data, 0644)
+}
+
+// CommandLine notes that the run is simulated
+func (r *SimulatedRunner) CommandLine(spec RunSpec) string {
+	return fmt.Sprintf("simulated run of %s and %s (delay %s)", spec.MasterFile, spec.EcoFile, r.Delay)
+}
+
+// simulateIndex builds the index elements for the selected index components
+// Each trait gets a fixed base value that is scaled by the prices and costs in the parameters
+// so changing an input moves the output in a sensible direction
+func simulateIndex(mp *params.MasterParams, ep *params.EcoParams) []IndexElement {
+	var prices []float64
+	for _, row := range ep.TraitSexPricePerCwt {
+		tokens := strings.Split(row, ",")
+		if len(tokens) < 5 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(strings.TrimSpace(tokens[4]), 64); err == nil {
+			prices = append(prices, v)
+		}
+	}
+	priceScale := 1.0
+	if len(prices) > 0 {
+		priceScale = mean(prices) / 150
+	}
+	aumScale := mean(ep.AumCost[:]) / 24
+	feedCost, _ := strconv.ParseFloat(strings.TrimSpace(ep.FeedlotFeedCost), 64)
+	discountRate, _ := strconv.ParseFloat(strings.TrimSpace(ep.DiscountRate), 64)
+	discount := math.Pow(1+discountRate, -float64(mp.PlanningHorizon)/2)
+
+	// Position of each component in the genetic covariance matrix
+	components := make(map[string]int, len(mp.Components))
+	for idx, c := range mp.Components {
+		components[strings.ReplaceAll(c, " ", "")] = idx
+	}
+	size := int(math.Sqrt(float64(len(mp.Genetic))))
+
+	elements := make([]IndexElement, 0, len(ep.IndexComponents))
+	var totalEmphasis float64
+	for _, key := range ep.IndexComponents {
+		tokens := strings.SplitN(key, ",", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		el := IndexElement{Trait: trait(tokens[0]), Component: component(tokens[1])}
+
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		base := float64(h.Sum32()%4000)/1000 - 2
+
+		switch el.Trait {
+		case "MW":
+			el.MarginalEconomicValue = -math.Abs(base) * aumScale
+		case "FI":
+			el.MarginalEconomicValue = -math.Abs(base) * (1 + feedCost)
+		default:
+			el.MarginalEconomicValue = base * priceScale
+		}
+		el.MarginalEconomicValue *= discount
+
+		if idx, ok := components[key]; ok && idx < size {
+			el.GeneticStdDev = math.Sqrt(math.Abs(mp.Genetic[idx*size+idx]))
+		}
+		if mp.TargetDatabase != "" {
+			el.Correlation = math.Sin(base + priceScale)
+		}
+		el.Emphasis = math.Abs(el.MarginalEconomicValue * el.GeneticStdDev)
+		totalEmphasis += el.Emphasis
+		elements = append(elements, el)
+	}
+
+	for idx := range elements {
+		if totalEmphasis > 0 {
+			elements[idx].Emphasis /= totalEmphasis
+		}
+	}
+	return elements
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,152 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/blgolden/igendec/schema"
+)
+
+// HeartbeatInterval is how often a running job updates its heartbeat
+// A processing job whose heartbeat is older than a couple of intervals has been orphaned
+var HeartbeatInterval = 30 * time.Second
+
+// JobState is the durable record of where a job is up to
+// It is rewritten on every change so the state survives the server dying
+type JobState struct {
+	SchemaVersion int
+
+	Status JobStatus
+
+	// ServerPID is the server process running the job, PID is the process doing the work
+	ServerPID int `json:",omitempty"`
+	PID       int `json:",omitempty"`
+
+	// Heartbeat is updated while the job is running
+	Heartbeat time.Time `json:",omitempty"`
+
+	Queued   time.Time `json:",omitempty"`
+	Started  time.Time `json:",omitempty"`
+	Finished time.Time `json:",omitempty"`
+
+	Error string `json:",omitempty"`
+}
+
+// InFlight returns true if the job was waiting to run or running
+func (s *JobState) InFlight() bool {
+	return s.Status == Queued || s.Status == Processing
+}
+
+// ReadState reads the state record of the job
+// Jobs from before state records were kept have one built from their files
+func (job *Job) ReadState() (*JobState, error) {
+	data, err := database.ReadJobFile(job.user.Username, job.Name, FileJobStatus)
+	if errors.Is(err, os.ErrNotExist) {
+		return job.legacyState(), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := &JobState{}
+	if err = schema.Decode(schema.JobState, data, state); err != nil {
+		return nil, fmt.Errorf("parsing job state: %w", err)
+	}
+	return state, nil
+}
+
+// legacyState works out the state of a job that has no state record
+// from its output and the processing flag
+func (job *Job) legacyState() *JobState {
+	if _, err := database.ReadJobFile(job.user.Username, job.Name, FileJobProcessingFlag); err == nil {
+		return &JobState{Status: Processing}
+	}
+	if _, err := database.ReadJobFile(job.user.Username, job.Name, FileJobOutput); err == nil {
+		return &JobState{Status: Passed}
+	}
+	return &JobState{Status: Failed}
+}
+
+// saveState writes the state record
+// Databases replace job files in a single step, so a crash never leaves a half written record
+func (job *Job) saveState(state *JobState) error {
+	state.SchemaVersion = schema.Current(schema.JobState)
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	return database.WriteJobFile(job.user.Username, job.Name, FileJobStatus, data)
+}
+
+// MarkQueued records that the job is waiting to be run
+func (job *Job) MarkQueued() error {
+	return job.saveState(&JobState{Status: Queued, Queued: time.Now()})
+}
+
+// MarkCancelled records that the job was cancelled before it finished
+func (job *Job) MarkCancelled() error {
+	return job.finishState(Cancelled, ErrJobCancelled)
+}
+
+// MarkFailed records that the job failed with the given error
+func (job *Job) MarkFailed(reason error) error {
+	return job.finishState(Failed, reason)
+}
+
+// finishState records the final status of the job, keeping when it was queued and started
+func (job *Job) finishState(status JobStatus, reason error) error {
+	state, err := job.ReadState()
+	if err != nil {
+		state = &JobState{}
+	}
+	state.Status = status
+	state.Finished = time.Now()
+	state.Heartbeat = time.Time{}
+	state.Error = ""
+	if reason != nil {
+		state.Error = reason.Error()
+	}
+	database.RemoveJobFile(job.user.Username, job.Name, FileJobProcessingFlag)
+	return job.saveState(state)
+}
+
+// writeFileAtomic writes to a temporary file next to filename and renames it into place
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// processAlive returns true if a process with the pid is running
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
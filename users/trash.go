@@ -0,0 +1,275 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/blgolden/igendec/logger"
+)
+
+// FileJobTrashed records when and why a job in the trash was deleted
+const FileJobTrashed = "trashed.hjson"
+
+// Retention settings, applied to every user by SweepJobs
+var (
+	// TrashPeriod is how long deleted jobs are kept in the trash, 0 keeps them until they are purged by hand
+	TrashPeriod = 30 * 24 * time.Hour
+	// KeepJobs is the most finished jobs a user keeps, the oldest are moved to the trash. 0 for no limit
+	KeepJobs int
+	// ExpireFailed is how long failed, cancelled and timed out jobs are kept, 0 keeps them
+	ExpireFailed time.Duration
+	// ExpireJobs is how long any finished job is kept, 0 keeps them
+	ExpireJobs time.Duration
+)
+
+// ErrJobInFlight is returned when deleting a job that is waiting to run or running
+var ErrJobInFlight = errors.New("job is queued or running")
+
+// TrashedJob is a job in the trash
+type TrashedJob struct {
+	ID      string `json:"-"`
+	Job     string // name of the job when it was deleted
+	Deleted time.Time
+	Reason  string // deleted by the user, or the retention rule that removed it
+}
+
+// Purge returns when the job will be purged from the trash, zero if it is kept
+func (t *TrashedJob) Purge() time.Time {
+	if TrashPeriod <= 0 {
+		return time.Time{}
+	}
+	return t.Deleted.Add(TrashPeriod)
+}
+
+// DeleteJob moves a job to the trash, where it can be restored until it is purged
+func (u *User) DeleteJob(name string) error {
+	defer u.Lock()()
+	return u.trashJob(name, "deleted", time.Now())
+}
+
+// trashJob moves a finished job to the trash, recording why
+// The caller holds the users lock
+func (u *User) trashJob(name, reason string, now time.Time) error {
+	if _, err := database.ListJobFiles(u.Username, name); err != nil {
+		return err
+	}
+	job := &Job{Name: name, user: u}
+	state, err := job.ReadState()
+	if err != nil {
+		return err
+	}
+	if state.InFlight() {
+		return ErrJobInFlight
+	}
+
+	// Job names can't have a '.', so ids never clash
+	trashed := &TrashedJob{ID: fmt.Sprintf("%s.%d", name, now.UnixNano()), Job: name, Deleted: now.UTC(), Reason: reason}
+	data, err := json.MarshalIndent(trashed, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err = database.WriteJobFile(u.Username, name, FileJobTrashed, data); err != nil {
+		return err
+	}
+	if err = database.TrashJob(u.Username, name, trashed.ID); err != nil {
+		database.RemoveJobFile(u.Username, name, FileJobTrashed)
+		return err
+	}
+	return nil
+}
+
+// ListTrash returns the jobs in the users trash, most recently deleted first
+func (u *User) ListTrash() ([]*TrashedJob, error) {
+	var trash []*TrashedJob
+	for _, id := range database.ListTrash(u.Username) {
+		trashed, err := u.readTrashed(id)
+		if err != nil {
+			return nil, fmt.Errorf("reading trashed job '%s': %w", id, err)
+		}
+		trash = append(trash, trashed)
+	}
+	sort.Slice(trash, func(i, j int) bool { return trash[i].Deleted.After(trash[j].Deleted) })
+	return trash, nil
+}
+
+// GetTrashed returns a job in the users trash
+// Errors match os.ErrNotExist if there is no such job
+func (u *User) GetTrashed(id string) (*TrashedJob, error) {
+	// Only ids from the trash are used, so they are safe to use as paths
+	for _, known := range database.ListTrash(u.Username) {
+		if known == id {
+			return u.readTrashed(id)
+		}
+	}
+	return nil, notExist(u.Username, PrefixTrash+id)
+}
+
+func (u *User) readTrashed(id string) (*TrashedJob, error) {
+	data, err := database.ReadTrashFile(u.Username, id, FileJobTrashed)
+	if err != nil {
+		return nil, err
+	}
+	trashed := &TrashedJob{}
+	if err = json.Unmarshal(data, trashed); err != nil {
+		return nil, err
+	}
+	trashed.ID = id
+	return trashed, nil
+}
+
+// RestoreJob moves a job out of the trash, back to the name it had
+// Returns ErrJobExists if a job has since been created with that name
+func (u *User) RestoreJob(id string) (*TrashedJob, error) {
+	defer u.Lock()()
+	trashed, err := u.GetTrashed(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = database.RestoreJob(u.Username, id, trashed.Job); err != nil {
+		return nil, err
+	}
+	return trashed, database.RemoveJobFile(u.Username, trashed.Job, FileJobTrashed)
+}
+
+// PurgeJob removes a job from the trash for good
+func (u *User) PurgeJob(id string) error {
+	defer u.Lock()()
+	if _, err := u.GetTrashed(id); err != nil {
+		return err
+	}
+	return database.PurgeJob(u.Username, id)
+}
+
+// SweepResult counts what SweepJobs did
+type SweepResult struct {
+	Trashed int // jobs moved to the trash by a retention rule
+	Purged  int // jobs purged from the trash
+}
+
+// SweepJobs applies the retention settings to every user
+// Finished jobs that a rule no longer keeps are moved to the trash, and jobs that have been in the
+// trash for longer than TrashPeriod are purged. Jobs from before their times were recorded are
+// only removed by KeepJobs, as the oldest
+func SweepJobs(now time.Time) SweepResult {
+	var result SweepResult
+	for _, username := range database.ListUsers() {
+		user, err := NewUser(username).Get()
+		if err != nil {
+			logger.Warn("sweeping: reading user '%s': %s", username, err)
+			continue
+		}
+		swept := user.sweep(now)
+		result.Trashed += swept.Trashed
+		result.Purged += swept.Purged
+	}
+	return result
+}
+
+// sweep applies the retention settings to the user, holding their lock so jobs
+// aren't created, submitted or restored while they are being moved
+func (u *User) sweep(now time.Time) SweepResult {
+	defer u.Lock()()
+	return SweepResult{Trashed: u.applyRetention(now), Purged: u.purgeTrash(now)}
+}
+
+// applyRetention moves the jobs the retention settings don't keep to the trash
+// The caller holds the users lock
+func (u *User) applyRetention(now time.Time) int {
+	if KeepJobs <= 0 && ExpireFailed <= 0 && ExpireJobs <= 0 {
+		return 0
+	}
+
+	type finishedJob struct {
+		name     string
+		status   JobStatus
+		finished time.Time
+	}
+	var jobs []finishedJob
+	for _, name := range u.ListJobs() {
+		state, err := (&Job{Name: name, user: u}).ReadState()
+		if err != nil {
+			logger.Warn("sweeping: reading state of job '%s' for user '%s': %s", name, u.Username, err)
+			continue
+		}
+		if state.InFlight() {
+			continue
+		}
+		finished := state.Finished
+		if finished.IsZero() {
+			finished = state.Queued
+		}
+		jobs = append(jobs, finishedJob{name: name, status: state.Status, finished: finished})
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].finished.After(jobs[j].finished) })
+
+	trashed := 0
+	kept := 0
+	for _, job := range jobs {
+		age := now.Sub(job.finished)
+		var reason string
+		switch {
+		case !job.finished.IsZero() && ExpireFailed > 0 && job.status != Passed && age > ExpireFailed:
+			reason = fmt.Sprintf("%s for more than %s", job.status, ExpireFailed)
+		case !job.finished.IsZero() && ExpireJobs > 0 && age > ExpireJobs:
+			reason = fmt.Sprintf("finished more than %s ago", ExpireJobs)
+		case KeepJobs > 0 && kept >= KeepJobs:
+			reason = fmt.Sprintf("more than the last %d jobs", KeepJobs)
+		default:
+			kept++
+			continue
+		}
+
+		if err := u.trashJob(job.name, reason, now); err != nil {
+			logger.Warn("sweeping: moving job '%s' for user '%s' to the trash: %s", job.name, u.Username, err)
+			continue
+		}
+		logger.Info("sweeping: moved job '%s' for user '%s' to the trash, %s", job.name, u.Username, reason)
+		trashed++
+	}
+	return trashed
+}
+
+// purgeTrash purges the jobs that have been in the trash for longer than TrashPeriod
+// The caller holds the users lock
+func (u *User) purgeTrash(now time.Time) int {
+	if TrashPeriod <= 0 {
+		return 0
+	}
+	trash, err := u.ListTrash()
+	if err != nil {
+		logger.Warn("sweeping: reading trash of user '%s': %s", u.Username, err)
+		return 0
+	}
+	purged := 0
+	for _, trashed := range trash {
+		if now.Before(trashed.Purge()) {
+			continue
+		}
+		if err := database.PurgeJob(u.Username, trashed.ID); err != nil {
+			logger.Warn("sweeping: purging job '%s' for user '%s': %s", trashed.ID, u.Username, err)
+			continue
+		}
+		purged++
+	}
+	return purged
+}
+
+// RunSweeper sweeps straight away, then every interval until ctx is done
+func RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if result := SweepJobs(time.Now()); result.Trashed > 0 || result.Purged > 0 {
+			logger.Info("sweeping: moved %d jobs to the trash and purged %d", result.Trashed, result.Purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
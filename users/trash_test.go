@@ -0,0 +1,95 @@
+package users
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSweepJobs(t *testing.T) {
+	period, failed, keep := TrashPeriod, ExpireFailed, KeepJobs
+	t.Cleanup(func() { TrashPeriod, ExpireFailed, KeepJobs = period, failed, keep })
+
+	user := newTestUser(t)
+	now := time.Now()
+	for name, state := range map[string]JobState{
+		"old":     {Status: Passed, Finished: now.Add(-72 * time.Hour)},
+		"failed":  {Status: Failed, Finished: now.Add(-48 * time.Hour)},
+		"recent":  {Status: Passed, Finished: now.Add(-time.Hour)},
+		"running": {Status: Processing, Queued: now.Add(-96 * time.Hour)},
+	} {
+		job := &Job{Name: name, user: user}
+		if err := job.saveState(&state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := user.DeleteJob("running"); !errors.Is(err, ErrJobInFlight) {
+		t.Errorf("deleting running job: got %v, want %v", err, ErrJobInFlight)
+	}
+
+	// The failed job has expired, and only the newest of the rest is kept
+	TrashPeriod, ExpireFailed, KeepJobs = 24*time.Hour, 24*time.Hour, 1
+	if result := SweepJobs(now); result.Trashed != 2 || result.Purged != 0 {
+		t.Errorf("first sweep: got %+v", result)
+	}
+	jobs := user.ListJobs()
+	sort.Strings(jobs)
+	if !reflect.DeepEqual(jobs, []string{"recent", "running"}) {
+		t.Errorf("jobs after sweeping: got %v", jobs)
+	}
+
+	trash, err := user.ListTrash()
+	if err != nil || len(trash) != 2 {
+		t.Fatalf("listing trash: got %v, %v", trash, err)
+	}
+	restored, err := user.RestoreJob(trash[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = database.ReadJobFile("bob", restored.Job, FileJobTrashed); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("restored job '%s' still has its trash record: %v", restored.Job, err)
+	}
+	if state, err := (&Job{Name: restored.Job, user: user}).ReadState(); err != nil || state.Finished.IsZero() {
+		t.Errorf("restored job state: got %v, %v", state, err)
+	}
+
+	// What is left in the trash is purged once it has been there for the trash period
+	KeepJobs, ExpireFailed = 0, 0
+	if result := SweepJobs(now.Add(25 * time.Hour)); result.Purged != 1 {
+		t.Errorf("second sweep: got %+v, want 1 purged", result)
+	}
+	if _, err = user.RestoreJob(trash[1].ID); err == nil {
+		t.Errorf("restored a purged job")
+	}
+}
+
+func TestSweepWaitsForUserLock(t *testing.T) {
+	keep := KeepJobs
+	t.Cleanup(func() { KeepJobs = keep })
+
+	user := newTestUser(t)
+	KeepJobs = 1
+	now := time.Now()
+	for _, name := range []string{"first", "second"} {
+		if err := (&Job{Name: name, user: user}).saveState(&JobState{Status: Passed, Finished: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unlock := user.Lock()
+	done := make(chan SweepResult)
+	go func() { done <- SweepJobs(now) }()
+	select {
+	case <-done:
+		t.Fatal("swept bob's jobs while he was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if result := <-done; result.Trashed != 1 {
+		t.Errorf("sweep: got %+v, want 1 trashed", result)
+	}
+}
@@ -0,0 +1,244 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TwoFactorPaths are database paths, as in Access. Users whose Access lets them see any of them,
+// or anything under them, must use two-factor authentication
+var TwoFactorPaths []string
+
+// TOTP settings, the ones authenticator apps expect
+const (
+	totpPeriod    = 30 // seconds each code is for
+	totpDigits    = 6
+	totpSkew      = 1 // codes this many periods either side of now are accepted, for clock drift
+	recoveryCount = 10
+)
+
+// Two-factor errors
+var (
+	ErrTwoFactorInvalid    = errors.New("two-factor code is not valid")
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already on")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication isn't on")
+	ErrTwoFactorNotStarted = errors.New("two-factor authentication hasn't been set up, start again")
+	ErrTwoFactorRequired   = errors.New("two-factor authentication is required for the databases you can use")
+)
+
+// base32NoPadding encodes secrets the way authenticator apps expect them
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactor is a users TOTP (RFC 6238) authenticator, and their recovery codes for when they don't have it
+type TwoFactor struct {
+	// Secret is the base32 key shared with the authenticator app
+	Secret string
+	// Enabled is set once the user has shown their app makes the right codes, until then it isn't asked for
+	Enabled bool
+	// LastStep is the time step of the last code used, so a code can't be used twice
+	LastStep int64
+	// RecoveryCodes are hashes of the unused recovery codes, each can be used once instead of a code
+	RecoveryCodes []string
+}
+
+// URI returns the otpauth URI authenticator apps are set up with
+func (t *TwoFactor) URI(username string) string {
+	v := url.Values{}
+	v.Set("secret", t.Secret)
+	v.Set("issuer", "iGenDec")
+	return "otpauth://totp/" + url.PathEscape("iGenDec:"+username) + "?" + v.Encode()
+}
+
+// TwoFactorEnabled returns true if the user must give a code to sign in
+func (u *User) TwoFactorEnabled() bool {
+	return u.TwoFactor != nil && u.TwoFactor.Enabled
+}
+
+// NeedsTwoFactor returns true if the users Access lets them see any of TwoFactorPaths,
+// or a path under one of them
+func (u *User) NeedsTwoFactor() bool {
+	for _, path := range TwoFactorPaths {
+		if u.Access.allowsUnder(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartTwoFactor gives the user a new secret for their authenticator app
+// It isn't asked for until EnableTwoFactor is given a code made from it
+func (u *User) StartTwoFactor() (*TwoFactor, error) {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return nil, err
+	}
+	if u.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	u.TwoFactor = &TwoFactor{Secret: base32NoPadding.EncodeToString(key)}
+	return u.TwoFactor, u.Update()
+}
+
+// EnableTwoFactor turns two-factor authentication on if code is from the secret given by StartTwoFactor
+// Returns the recovery codes, which are only kept hashed so can't be shown again
+func (u *User) EnableTwoFactor(code string, now time.Time) ([]string, error) {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return nil, err
+	}
+	switch {
+	case u.TwoFactorEnabled():
+		return nil, ErrTwoFactorEnabled
+	case u.TwoFactor == nil:
+		return nil, ErrTwoFactorNotStarted
+	case !u.TwoFactor.checkCode(code, now):
+		return nil, ErrTwoFactorInvalid
+	}
+
+	codes, err := u.TwoFactor.newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	u.TwoFactor.Enabled = true
+	return codes, u.Update()
+}
+
+// CheckTwoFactor returns nil if code is from the users authenticator app, or one of their recovery codes
+// Recovery codes and time steps can only be used once. Returns true if a recovery code was used
+func (u *User) CheckTwoFactor(code string, now time.Time) (bool, error) {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return false, err
+	}
+	if !u.TwoFactorEnabled() {
+		return false, ErrTwoFactorNotEnabled
+	}
+	if u.TwoFactor.checkCode(code, now) {
+		return false, u.Update()
+	}
+	if u.TwoFactor.useRecoveryCode(code) {
+		return true, u.Update()
+	}
+	return false, ErrTwoFactorInvalid
+}
+
+// NewRecoveryCodes replaces the users recovery codes, if code is from their authenticator app
+func (u *User) NewRecoveryCodes(code string, now time.Time) ([]string, error) {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return nil, err
+	}
+	if !u.TwoFactorEnabled() {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	if !u.TwoFactor.checkCode(code, now) {
+		return nil, ErrTwoFactorInvalid
+	}
+	codes, err := u.TwoFactor.newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	return codes, u.Update()
+}
+
+// DisableTwoFactor turns two-factor authentication off, if code is from the users authenticator app
+// or a recovery code. Returns ErrTwoFactorRequired if the user must use it
+func (u *User) DisableTwoFactor(code string, now time.Time) error {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return err
+	}
+	if !u.TwoFactorEnabled() {
+		return ErrTwoFactorNotEnabled
+	}
+	if u.NeedsTwoFactor() {
+		return ErrTwoFactorRequired
+	}
+	if !u.TwoFactor.checkCode(code, now) && !u.TwoFactor.useRecoveryCode(code) {
+		return ErrTwoFactorInvalid
+	}
+	u.TwoFactor = nil
+	return u.Update()
+}
+
+// checkCode returns true if code is the authenticators code for a time step near now that
+// hasn't been used, and records the step as used
+func (t *TwoFactor) checkCode(code string, now time.Time) bool {
+	key, err := base32NoPadding.DecodeString(t.Secret)
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+	step := now.Unix() / totpPeriod
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s <= t.LastStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, uint64(s), totpDigits)), []byte(code)) {
+			t.LastStep = s
+			return true
+		}
+	}
+	return false
+}
+
+// newRecoveryCodes replaces the recovery codes, returning the new ones
+func (t *TwoFactor) newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCount)
+	t.RecoveryCodes = make([]string, recoveryCount)
+	for i := range codes {
+		data := make([]byte, 5)
+		if _, err := rand.Read(data); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(data))
+		codes[i] = code[:4] + "-" + code[4:]
+		t.RecoveryCodes[i] = tokenHash(code)
+	}
+	return codes, nil
+}
+
+// useRecoveryCode returns true if code is an unused recovery code, and removes it
+// Dashes, spaces and case are ignored
+func (t *TwoFactor) useRecoveryCode(code string) bool {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if code == "" {
+		return false
+	}
+	for i, hash := range t.RecoveryCodes {
+		if tokenMatches(code, hash) {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// hotp returns the RFC 4226 code for the counter, TOTP uses the time step as the counter
+func hotp(key []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
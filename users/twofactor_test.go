@@ -0,0 +1,131 @@
+package users
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHOTP checks codes against the SHA-1 test vectors in RFC 6238 appendix B
+func TestHOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		if got := hotp(key, uint64(tc.unix/totpPeriod), 8); got != tc.want {
+			t.Errorf("time %d: got %s, want %s", tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	paths := TwoFactorPaths
+	t.Cleanup(func() { TwoFactorPaths = paths })
+
+	user := newTestUser(t)
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := user.EnableTwoFactor("000000", now); !errors.Is(err, ErrTwoFactorNotStarted) {
+		t.Errorf("enable before start: got %v, want ErrTwoFactorNotStarted", err)
+	}
+	tf, err := user.StartTwoFactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := base32NoPadding.DecodeString(tf.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := func(at time.Time) string { return hotp(key, uint64(at.Unix()/totpPeriod), totpDigits) }
+
+	if _, err = user.CheckTwoFactor(code(now), now); !errors.Is(err, ErrTwoFactorNotEnabled) {
+		t.Errorf("check before enabled: got %v, want ErrTwoFactorNotEnabled", err)
+	}
+	if _, err = user.EnableTwoFactor(code(now.Add(-time.Hour)), now); !errors.Is(err, ErrTwoFactorInvalid) {
+		t.Errorf("enable with old code: got %v, want ErrTwoFactorInvalid", err)
+	}
+	recovery, err := user.EnableTwoFactor(code(now), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery) != recoveryCount {
+		t.Errorf("got %d recovery codes, want %d", len(recovery), recoveryCount)
+	}
+
+	// Codes can't be replayed, but the next step's code works, and a drifted clock is allowed for
+	later := now.Add(totpPeriod * time.Second)
+	for _, tc := range []struct {
+		name     string
+		code     string
+		at       time.Time
+		recovery bool
+		want     error
+	}{
+		{"replayed", code(now), now, false, ErrTwoFactorInvalid},
+		{"next step", code(later), now, false, nil},
+		{"wrong code", "123456", later, false, ErrTwoFactorInvalid},
+		{"recovery", recovery[0], later, true, nil},
+		{"reused recovery", recovery[0], later, false, ErrTwoFactorInvalid},
+		{"recovery typed loosely", " " + strings.ToUpper(strings.Replace(recovery[1], "-", " ", 1)), later, true, nil},
+	} {
+		used, err := user.CheckTwoFactor(tc.code, tc.at)
+		if !errors.Is(err, tc.want) || used != tc.recovery {
+			t.Errorf("%s: got %t, %v, want %t, %v", tc.name, used, err, tc.recovery, tc.want)
+		}
+	}
+
+	// Users who can see a required path can't turn it off
+	TwoFactorPaths = []string{"angus/private"}
+	if !user.NeedsTwoFactor() {
+		t.Error("user with access to everything doesn't need two-factor")
+	}
+	if err = user.DisableTwoFactor(recovery[2], later); !errors.Is(err, ErrTwoFactorRequired) {
+		t.Errorf("disable when required: got %v, want ErrTwoFactorRequired", err)
+	}
+	user.Access = Access{{Path: "*"}, {Path: "angus/*", Deny: true}}
+	if err = user.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if user.NeedsTwoFactor() {
+		t.Error("user denied the path needs two-factor")
+	}
+	if err = user.DisableTwoFactor(recovery[2], later); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	if user.TwoFactorEnabled() {
+		t.Error("two-factor is still on after disabling")
+	}
+}
+
+func TestNeedsTwoFactor(t *testing.T) {
+	paths := TwoFactorPaths
+	t.Cleanup(func() { TwoFactorPaths = paths })
+	TwoFactorPaths = []string{"angus/private"}
+
+	for _, tc := range []struct {
+		access Access
+		want   bool
+	}{
+		{Access{{Path: "*"}}, true},
+		{Access{{Path: "angus/private"}}, true},
+		{Access{{Path: "angus/private/herd1"}}, true},
+		{Access{{Path: "*/private/herd1"}}, true},
+		{Access{{Path: "angus/public"}}, false},
+		{Access{{Path: "angus"}}, false},
+		{Access{{Path: "*"}, {Path: "angus/private/*", Deny: true}, {Path: "angus/private", Deny: true}}, false},
+		{Access{{Path: "angus/private/herd1"}, {Path: "angus/private/herd1", Deny: true}}, false},
+	} {
+		if got := (&User{Access: tc.access}).NeedsTwoFactor(); got != tc.want {
+			t.Errorf("%v: got %t, want %t", tc.access, got, tc.want)
+		}
+	}
+}
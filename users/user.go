@@ -2,13 +2,13 @@ package users
 
 import (
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
+	"sync"
 
 	"github.com/blgolden/igendec/params"
+	"github.com/blgolden/igendec/schema"
 	"github.com/hjson/hjson-go"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -71,6 +71,43 @@ func (a Access) BestMatch(path string) (AccessPath, bool) {
 	return best, bestLen != -1
 }
 
+// Allows returns true if the best match for the path doesn't deny it
+func (a Access) Allows(path string) bool {
+	best, found := a.BestMatch(path)
+	return found && !best.Deny
+}
+
+// allowsUnder returns true if the path, or any path under it, is allowed
+func (a Access) allowsUnder(path string) bool {
+	if a.Allows(path) {
+		return true
+	}
+	pathParts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	for _, access := range a {
+		if access.Deny || !access.under(pathParts) {
+			continue
+		}
+		if a.Allows(access.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// under returns true if the access path is the path or one below it, a * matches any part
+func (a AccessPath) under(pathParts []string) bool {
+	accessParts := strings.Split(a.Path, "/")
+	if len(accessParts) < len(pathParts) {
+		return false
+	}
+	for i := range pathParts {
+		if accessParts[i] != "*" && accessParts[i] != pathParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (a AccessPath) Match(path string) (matches bool, matchLen int, wildcardMatch bool) {
 	if !strings.Contains(a.Path, "*") {
 		if path == a.Path {
@@ -120,6 +157,30 @@ type User struct {
 	// Each path should directly correlate with the
 	// structure of the epds directory
 	Access Access
+
+	// Role is what the user can do on the server, empty for RoleUser
+	Role Role `json:",omitempty"`
+
+	// Disabled accounts can't sign in
+	Disabled bool `json:",omitempty"`
+
+	// Quota replaces the servers default quota for this user when set
+	Quota *Quota `json:",omitempty"`
+
+	// Lockout counts failed sign ins since the last good one, nil if there haven't been any
+	Lockout *Lockout `json:",omitempty"`
+
+	// Reset is the outstanding password reset, nil if there isn't one
+	Reset *PasswordReset `json:",omitempty"`
+
+	// Unverified is the email address waiting to be verified, nil once it has been
+	Unverified *EmailVerification `json:",omitempty"`
+
+	// TwoFactor is the users authenticator, nil if they haven't set one up
+	TwoFactor *TwoFactor `json:",omitempty"`
+
+	// SchemaVersion is the version of the profile, it is set when the profile is written
+	SchemaVersion int
 }
 
 // NewUser returns a new user with only the Username field filled in
@@ -132,16 +193,13 @@ func NewUser(username string) *User {
 }
 
 // NewUserFromBytes returns a new user by parsing the bytes with JSON
+// Profiles from older versions are upgraded
 func NewUserFromBytes(data []byte) (*User, error) {
-	var tmp map[string]interface{}
-	err := hjson.Unmarshal(data, &tmp)
-	if err != nil {
+	user := &User{}
+	if err := schema.Decode(schema.Profile, data, user); err != nil {
 		return nil, err
 	}
-	data, _ = json.Marshal(tmp)
-	user := &User{}
-	err = json.Unmarshal(data, user)
-	return user, err
+	return user, nil
 }
 
 // ToMap returns the values we need from the struct in a fiber compatible map
@@ -161,6 +219,7 @@ func (u *User) Get() (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Older profiles get this when upgraded, current ones can still be saved with an empty list
 	if len(new.Access) == 0 {
 		new.Access = defaultAccess
 	}
@@ -168,9 +227,31 @@ func (u *User) Get() (*User, error) {
 	return u, nil
 }
 
+// Lock stops anyone else holding the lock for this user until unlock is called
+// Hold it while reading, changing and saving the users profile or parameters so
+// concurrent requests can't interleave and undo each others changes, and while
+// checking quotas and creating, trashing or restoring jobs so concurrent requests
+// can't both fit under one or act on a job halfway through being moved.
+// It isn't reentrant, so nothing called while holding it may take it again
+func (u *User) Lock() (unlock func()) {
+	return lockUser(u.Username)
+}
+
+// userLocks holds the mutex of each user that has been locked
+// It is the only per user lock, the database takes it too for whole user operations
+var userLocks sync.Map
+
+// lockUser locks the user with the given username, see User.Lock
+func lockUser(username string) (unlock func()) {
+	mu, _ := userLocks.LoadOrStore(username, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
 // Save the user to the database
 // This is a create operation, to update use user.Update()
 func (u *User) Save() error {
+	defer u.Lock()()
 	return database.Create(u)
 }
 
@@ -251,20 +332,27 @@ func (u *User) GetJob(name string) (*Job, error) {
 		return nil, fmt.Errorf("getting parameter files: %s", err)
 	}
 
+	state, err := (&Job{Name: name, user: u}).ReadState()
+	if err != nil {
+		return nil, fmt.Errorf("reading job state: %w", err)
+	}
+
 	// We don't mind if this can't be parsed - as we expect a failed job not to have this
 	// file, or for it to be empty
-	data, err := os.ReadFile(database.GetJobFilename(u.Username, name, FileJobOutput))
+	data, err := database.ReadJobFile(u.Username, name, FileJobOutput)
 	if err == nil {
 		j, err = parseJob(bytes.NewBuffer(data))
 		if err != nil {
 			return nil, fmt.Errorf("parsing job output: %w", err)
 		}
-	} else {
-		if _, err = os.Stat(PathToJobFile(u.Username, name, FileJobProcessingFlag)); err == nil {
-			j.Status = Processing
-		}
 	}
 
+	// Only trust a passed state if the output is there to back it up
+	if state.Status != Passed || j.Status == Passed {
+		j.Status = state.Status
+	}
+
+	j.State = state
 	j.Comment = ip.Comment
 	j.TargetDatabase = ip.TargetDatabase
 	j.Endpoint = ep.SaleEndpoint
@@ -297,19 +385,21 @@ func (u *User) CreateJob(name string, ip *params.MasterParams, ep *params.EcoPar
 	return j, nil
 }
 
-// DeleteJob will permantly remove a job
-func (u *User) DeleteJob(name string) error {
-	return database.DeleteJob(u.Username, name)
-}
-
 // GetJobParams will return the parameters used in the given job
 // Will return error if the job doesn't exist or parameter files can't be loaded
 func (u *User) GetJobParams(name string) (*params.MasterParams, *params.EcoParams, error) {
-	mp, err := params.MasterParamsFromFile(database.GetJobFilename(u.Username, name, FileMasterFilename))
+	data, err := database.ReadJobFile(u.Username, name, FileMasterFilename)
 	if err != nil {
 		return nil, nil, fmt.Errorf("reading master params: %w", err)
 	}
-	ep, err := params.EcoParamsFromFile(database.GetJobFilename(u.Username, name, FileEcoFilename))
+	mp, err := params.MasterParamsFromBytes(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading master params: %w", err)
+	}
+	if data, err = database.ReadJobFile(u.Username, name, FileEcoFilename); err != nil {
+		return nil, nil, fmt.Errorf("reading eco params: %w", err)
+	}
+	ep, err := params.EcoParamsFromBytes(data)
 	if err != nil {
 		return nil, nil, fmt.Errorf("reading eco params: %w", err)
 	}
@@ -339,5 +429,7 @@ func (u *User) String() string {
 
 // Bytes returns JSON marshalled bytes
 func (u *User) Bytes() ([]byte, error) {
-	return hjson.Marshal(u)
+	user := *u
+	user.SchemaVersion = schema.Current(schema.Profile)
+	return hjson.Marshal(&user)
 }
@@ -0,0 +1,93 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+)
+
+// Email verification settings
+var (
+	// UnverifiedCanRun lets users run jobs before their email address is verified, otherwise they can only browse
+	UnverifiedCanRun bool
+	// VerifyPeriod is how long an email verification token can be used for
+	VerifyPeriod = 7 * 24 * time.Hour
+)
+
+// Email verification errors
+var (
+	ErrBadEmail        = errors.New("email address is not valid")
+	ErrUnverified      = errors.New("your email address hasn't been verified, use the link mailed to you or send another from your profile")
+	ErrVerifyInvalid   = errors.New("email verification link is not valid, it may have expired, already been used, or be for an old address")
+	ErrVerifyTooSoon   = errors.New("a verification email was sent moments ago")
+	ErrAlreadyVerified = errors.New("email address is already verified")
+)
+
+// EmailVerification is an email address waiting to be verified
+// Only a hash of the token is kept, the token itself is only in the mail sent to the address
+type EmailVerification struct {
+	Email   string
+	Hash    string
+	Created time.Time
+	Expires time.Time
+}
+
+// ValidateEmail returns ErrBadEmail if the address isn't a plain address, such as bob@example.com
+func ValidateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("%w: '%s'", ErrBadEmail, email)
+	}
+	return nil
+}
+
+// Verified returns true if the users email address has been verified
+// Users from before addresses were verified count as verified
+func (u *User) Verified() bool {
+	return u.Unverified == nil
+}
+
+// StartVerification marks the users email address as unverified, and returns the token to mail
+// to it. The user isn't saved. Returns ErrVerifyTooSoon if a token was made less than
+// ResetInterval ago for the same address
+func (u *User) StartVerification(now time.Time) (string, error) {
+	if err := ValidateEmail(u.Email); err != nil {
+		return "", err
+	}
+	if u.Unverified != nil && u.Unverified.Email == u.Email && now.Sub(u.Unverified.Created) < ResetInterval {
+		return "", ErrVerifyTooSoon
+	}
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	u.Unverified = &EmailVerification{Email: u.Email, Hash: hash, Created: now, Expires: now.Add(VerifyPeriod)}
+	return token, nil
+}
+
+// Verify marks the users email address as verified if token is the one mailed to it
+// Returns ErrVerifyInvalid for a bad or expired token, or one for an address the user no longer has,
+// and ErrAlreadyVerified if there is nothing to verify
+func (u *User) Verify(token string, now time.Time) error {
+	defer u.Lock()()
+	if _, err := u.Get(); err != nil {
+		return ErrVerifyInvalid
+	}
+	if u.Unverified == nil {
+		return ErrAlreadyVerified
+	}
+	if u.Unverified.Email != u.Email || !now.Before(u.Unverified.Expires) || !tokenMatches(token, u.Unverified.Hash) {
+		return ErrVerifyInvalid
+	}
+	u.Unverified = nil
+	return u.Update()
+}
+
+// CheckCanRun returns ErrUnverified if the user can't run jobs until their email address is verified
+func (u *User) CheckCanRun() error {
+	if !u.Verified() && !UnverifiedCanRun {
+		return ErrUnverified
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package users
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	canRun := UnverifiedCanRun
+	t.Cleanup(func() { UnverifiedCanRun = canRun })
+
+	useTestDatabase(t)
+	user := NewUser("bob")
+	user.Email = "Bob <bob@example.com>"
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := user.StartVerification(now); !errors.Is(err, ErrBadEmail) {
+		t.Errorf("named address: got %v, want ErrBadEmail", err)
+	}
+
+	user.Email = "bob@example.com"
+	token, err := user.StartVerification(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = database.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = user.StartVerification(now.Add(time.Second)); !errors.Is(err, ErrVerifyTooSoon) {
+		t.Errorf("second link straight away: got %v, want ErrVerifyTooSoon", err)
+	}
+
+	UnverifiedCanRun = false
+	if err = user.CheckCanRun(); !errors.Is(err, ErrUnverified) {
+		t.Errorf("unverified user running: got %v, want ErrUnverified", err)
+	}
+	UnverifiedCanRun = true
+	if err = user.CheckCanRun(); err != nil {
+		t.Errorf("unverified user running when allowed: got %v, want nil", err)
+	}
+	UnverifiedCanRun = false
+
+	for name, tc := range map[string]struct {
+		token string
+		at    time.Time
+	}{
+		"wrong token": {"bad", now},
+		"expired":     {token, now.Add(VerifyPeriod)},
+	} {
+		if err = user.Verify(tc.token, tc.at); !errors.Is(err, ErrVerifyInvalid) {
+			t.Errorf("%s: got %v, want ErrVerifyInvalid", name, err)
+		}
+	}
+
+	// A link for an address the user has since changed from doesn't verify the new one
+	user.Email = "robert@example.com"
+	if err = user.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if err = user.Verify(token, now); !errors.Is(err, ErrVerifyInvalid) {
+		t.Errorf("old address: got %v, want ErrVerifyInvalid", err)
+	}
+
+	if token, err = user.StartVerification(now.Add(time.Second)); err != nil {
+		t.Fatalf("link for new address: %v", err)
+	}
+	if err = user.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if err = user.Verify(token, now.Add(time.Minute)); err != nil {
+		t.Fatalf("good token: %v", err)
+	}
+	if user, err = NewUser("bob").Get(); err != nil {
+		t.Fatal(err)
+	}
+	if !user.Verified() {
+		t.Error("user isn't verified after using the link")
+	}
+	if err = user.CheckCanRun(); err != nil {
+		t.Errorf("verified user running: got %v, want nil", err)
+	}
+	if err = user.Verify(token, now.Add(time.Minute)); !errors.Is(err, ErrAlreadyVerified) {
+		t.Errorf("reused token: got %v, want ErrAlreadyVerified", err)
+	}
+}
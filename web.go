@@ -4,18 +4,23 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 
+	"github.com/blgolden/igendec/audit"
+	"github.com/blgolden/igendec/blacklist"
 	"github.com/blgolden/igendec/epds"
 
 	"github.com/blgolden/igendec/params"
 
 	"github.com/blgolden/igendec/controllers"
+	"github.com/blgolden/igendec/controllers/session"
 	"github.com/blgolden/igendec/logger"
+	"github.com/blgolden/igendec/mail"
+	"github.com/blgolden/igendec/queue"
 	"github.com/blgolden/igendec/routes"
 	"github.com/blgolden/igendec/users"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -48,9 +53,72 @@ var (
 
 	databaseDirectory = kingpin.Flag("bull-database", "Path to the directory containing all of the epds for running jobs against").Short('d').Default("./").String()
 //	databaseDirectory = kingpin.Flag("bull-database", "Path to the directory containing all of the epds for running jobs against").Short('d').Default("./epds").String()
-	userBlacklist     = kingpin.Flag("user-blacklist", "Path to file containing a list of names. These users will not be authenticated on login").Short('b').Default("./user-blacklist.txt").String()
+	userBlacklist     = kingpin.Flag("user-blacklist", "Path to file containing a list of names, one a line as 'username | expires | reason'. These users can't sign in, and are signed out").Short('b').Default("./user-blacklist.txt").String()
 
-	usersPath = kingpin.Flag("users-path", "Path to location where users' accounts are stored").Short('u').Default("/tmp/igendecDB").String()
+	blacklistReload = kingpin.Flag("blacklist-reload", "How often to check the blacklist for changes, 0 to only read it at start up").Default("10s").Duration()
+
+	admins = kingpin.Flag("admin", "Username of a user to make a server administrator when the server starts, repeat for each. Administrators can change the role of others from /admin/users").Strings()
+
+	usersPath    = kingpin.Flag("users-path", "Path to location where users' accounts are stored").Short('u').Default("/tmp/igendecDB").String()
+	databaseType = kingpin.Flag("database-type", "How users' accounts are stored: 'local' keeps them as files under the users path, 'bolt' in a single bolt database file there").Default(users.DatabaseLocal).Enum(users.DatabaseLocal, users.DatabaseBolt)
+
+	sessionIdle   = kingpin.Flag("session-idle", "How long a sign in lasts without being used, 0 for no limit").Default("2h").Duration()
+	sessionMaxAge = kingpin.Flag("session-max-age", "How long a sign in lasts however much it is used, users must then sign in again").Default("168h").Duration()
+
+	signInBackoff     = kingpin.Flag("signin-backoff", "How long to wait after a failed sign in before another is allowed, doubling with each failure in a row").Default("1s").Duration()
+	signInBackoffMax  = kingpin.Flag("signin-backoff-max", "Longest wait between failed sign ins").Default("1m").Duration()
+	lockoutAttempts   = kingpin.Flag("lockout-attempts", "Failed sign ins in a row that lock an account, 0 never locks. Administrators can unlock accounts from /admin/lockouts").Default("10").Int()
+	lockoutIPAttempts = kingpin.Flag("lockout-ip-attempts", "Failed sign ins in a row from one address, to any accounts, that lock the address out. 0 never locks").Default("50").Int()
+	lockoutPeriod     = kingpin.Flag("lockout-period", "How long an account or address stays locked, failed sign ins are also forgotten after this long without one").Default("30m").Duration()
+
+	corsOrigins = kingpin.Flag("cors-origin", "Origin, eg. https://example.org, that browsers may make requests to the server from. Repeat for each origin, none allows only the server's own pages").Strings()
+
+	baseURL      = kingpin.Flag("base-url", "Address users reach the server at, for links in mail, eg. https://igendec.example.org. Defaults to the address and port listened on").String()
+	mailer       = kingpin.Flag("mailer", "How mail is sent: 'smtp' through --smtp-addr, 'file' appends it to --mail-file, or logs it if that isn't set, for development").Default("file").Enum("smtp", "file")
+	mailFrom     = kingpin.Flag("mail-from", "Address mail is sent from").Default("igendec@localhost").String()
+	mailFile     = kingpin.Flag("mail-file", "File the file mailer appends mail to").String()
+	smtpAddr     = kingpin.Flag("smtp-addr", "host:port of the SMTP server").Default("localhost:25").String()
+	smtpUser     = kingpin.Flag("smtp-user", "Username to sign in to the SMTP server with, none to not sign in").String()
+	smtpPassword = kingpin.Flag("smtp-password", "Password to sign in to the SMTP server with").Envar("IGENDEC_SMTP_PASSWORD").String()
+	resetPeriod  = kingpin.Flag("reset-period", "How long a password reset link works for").Default("1h").Duration()
+
+	verifyPeriod     = kingpin.Flag("verify-period", "How long a link to verify an email address works for").Default("168h").Duration()
+	unverifiedCanRun = kingpin.Flag("unverified-can-run", "Let users whose email address isn't verified run jobs, otherwise they can only browse").Bool()
+
+	twoFactorPaths = kingpin.Flag("require-2fa-path", "Database path, as in a users Access, that users must use two-factor authentication to see. Repeat for each path").Strings()
+
+	auditLog = kingpin.Flag("audit-log", "File to append the audit log of sign ins, job changes and downloads to. Defaults to audit.jsonl in the users path").String()
+
+	runner        = kingpin.Flag("runner", "How jobs are run: 'exec' runs the starter binary, 'simulate' writes a simulated output for demos and testing").Default("exec").Enum("exec", "simulate")
+	starterPath   = kingpin.Flag("starter-path", "Path to the starter binary used to run jobs").Default("starter").String()
+	starterArgs   = kingpin.Flag("starter-arg", "Argument to run the starter binary with, repeat for each argument. {master}, {eco}, {output} and {database} are replaced with the job's files").Strings()
+	simulateDelay = kingpin.Flag("simulate-delay", "How long a simulated job takes to run").Default("2s").Duration()
+
+	workers    = kingpin.Flag("workers", "Number of jobs that can run at the same time").Short('w').Default("2").Int()
+	queueSize  = kingpin.Flag("queue-size", "Number of jobs that can be waiting to run before new jobs are refused, at least 1").Default("100").Int()
+	jobTimeout = kingpin.Flag("job-timeout", "Longest a job can run before it is killed, 0 for no limit").Default("2h").Duration()
+
+	maxBatchJobs = kingpin.Flag("max-batch-jobs", "Most jobs a single parameter sweep can create").Default("100").Int()
+
+	trashPeriod   = kingpin.Flag("trash-period", "How long deleted jobs are kept in the trash before they are purged, 0 keeps them until users purge them").Default("720h").Duration()
+	keepJobs      = kingpin.Flag("keep-jobs", "Most finished jobs each user keeps, older jobs are moved to the trash. 0 for no limit").Default("0").Int()
+	expireFailed  = kingpin.Flag("expire-failed", "How long failed, cancelled and timed out jobs are kept before they are moved to the trash, 0 keeps them").Default("0").Duration()
+	expireJobs    = kingpin.Flag("expire-jobs", "How long finished jobs are kept before they are moved to the trash, 0 keeps them").Default("0").Duration()
+	sweepInterval = kingpin.Flag("sweep-interval", "How often the trash is purged and the job retention settings are applied").Default("1h").Duration()
+
+	quotaJobs  = kingpin.Flag("quota-jobs", "Most jobs each user can keep, 0 for no limit. Can be changed for a user from /admin/quota").Default("0").Int()
+	quotaBytes = kingpin.Flag("quota-bytes", "Most space the jobs of each user can take up, including their trash, eg. 500MB. 0 for no limit").Default("0").Bytes()
+	quotaRuns  = kingpin.Flag("quota-runs", "Most jobs each user can have queued or running at the same time, 0 for no limit").Default("0").Int()
+
+	recoverJobs = kingpin.Flag("recover", "What to do on start up with jobs that were running when the server last stopped: 'requeue' runs them again, 'fail' marks them as failed").Default("requeue").Enum("requeue", "fail")
+
+	serveCommand   = kingpin.Command("serve", "Run the web server").Default()
+	backupCommand  = kingpin.Command("backup", "Write a snapshot of the users database. This can be done while the server is running, except with a bolt database where /admin/backup should be used instead")
+	backupFile     = backupCommand.Arg("file", "File to write the gzipped tar snapshot to").Required().String()
+	restoreCommand = kingpin.Command("restore", "Check a snapshot and replace the users database with it. The server must be stopped, the old database is kept alongside")
+	restoreFile    = restoreCommand.Arg("file", "Snapshot to restore").Required().ExistingFile()
+	migrateCommand = kingpin.Command("migrate", "Upgrade every profile, parameter file and job in the users database to the current version. The server must be stopped")
+	migrateDryRun  = migrateCommand.Flag("dry-run", "List what would be upgraded without changing anything").Bool()
 )
 
 // Initilises objects and environment
@@ -59,10 +127,48 @@ func setup(ctx context.Context) {
 	logger.Init()
 
 	users.UsersPath = *usersPath
+	users.DatabaseType = *databaseType
 	users.Init()
 
+	if *auditLog == "" {
+		*auditLog = filepath.Join(*usersPath, "audit.jsonl")
+	}
+	if err := audit.Init(*auditLog); err != nil {
+		logger.Fatal("opening audit log: %s", err)
+	}
+
+	// Sessions are kept in the users database
+	if *sessionMaxAge <= 0 {
+		logger.Fatal("--session-max-age must be more than 0")
+	}
+	session.IdleTimeout = *sessionIdle
+	session.MaxAge = *sessionMaxAge
+
 	h := controllers.NewHandler()
 
+	// Slow down and lock out repeated failed sign ins
+	users.SignInBackoff = *signInBackoff
+	users.SignInBackoffMax = *signInBackoffMax
+	users.LockoutAttempts = *lockoutAttempts
+	users.LockoutPeriod = *lockoutPeriod
+	h.Addresses.Attempts = *lockoutIPAttempts
+
+	// Set how mail is sent, for password resets
+	switch *mailer {
+	case "smtp":
+		h.Mailer = &mail.SMTPMailer{Addr: *smtpAddr, Username: *smtpUser, Password: *smtpPassword, From: *mailFrom}
+	default:
+		h.Mailer = &mail.FileMailer{Path: *mailFile, From: *mailFrom}
+	}
+	h.BaseURL = strings.TrimRight(*baseURL, "/")
+	if h.BaseURL == "" {
+		h.BaseURL = fmt.Sprintf("http://%s:%d", *addr, *port)
+	}
+	users.ResetPeriod = *resetPeriod
+	users.VerifyPeriod = *verifyPeriod
+	users.UnverifiedCanRun = *unverifiedCanRun
+	users.TwoFactorPaths = *twoFactorPaths
+
 	// Set the default paths
 	params.DefaultMasterPath = *defaultMasterPath
 
@@ -80,18 +186,58 @@ func setup(ctx context.Context) {
 
 	epds.DatabasePath = *databaseDirectory
 
-	// Check if there is a blacklist - if so load in
-	if info, err := os.Stat(*userBlacklist); err == nil && !info.IsDir() {
-		data, err := ioutil.ReadFile(*userBlacklist)
-		if err != nil {
-			logger.Fatal("trying to read in blacklist: %s", err)
+	// Set how the jobs are run
+	switch *runner {
+	case "simulate":
+		logger.Warn("jobs will be simulated, outputs are not from the iGenDec model")
+		users.JobRunner = &users.SimulatedRunner{Delay: *simulateDelay}
+	default:
+		users.JobRunner = users.NewExecRunner(*starterPath, *starterArgs)
+	}
+
+	users.MaxBatchJobs = *maxBatchJobs
+	users.DefaultQuota = users.Quota{Jobs: *quotaJobs, Bytes: int64(*quotaBytes), Runs: *quotaRuns}
+
+	// Start the workers that run the jobs
+	h.Queue = queue.New(queue.Config{
+		Workers:      *workers,
+		Size:         *queueSize,
+		Timeout:      *jobTimeout,
+		DatabasePath: epds.DatabasePath,
+		Requeue:      *recoverJobs == "requeue",
+	})
+
+	// Pick up the jobs that were left waiting or running when the server last stopped
+	for _, job := range users.RecoverJobs(*recoverJobs == "requeue") {
+		if err := h.Queue.Submit(job); err != nil {
+			logger.Warn("requeueing job '%s' for user '%s': %s", job.Name, job.Username(), err)
+			job.MarkFailed(users.ErrJobOrphaned)
 		}
-		lines := strings.Split(string(data), "\n")
-		for _, line := range lines {
-			h.UserBlacklist[strings.TrimSpace(line)] = struct{}{}
+	}
+
+	// Purge the trash and apply the retention settings in the background
+	users.TrashPeriod = *trashPeriod
+	users.KeepJobs = *keepJobs
+	users.ExpireFailed = *expireFailed
+	users.ExpireJobs = *expireJobs
+	go users.RunSweeper(ctx, *sweepInterval)
+
+	// Make the administrators given on the command line, they can make others from /admin/users
+	for _, admin := range *admins {
+		if err := users.NewUser(admin).SetRole(users.RoleAdmin); err != nil {
+			logger.Warn("making user '%s' an administrator: %s", admin, err)
 		}
 	}
 
+	// Read the blacklist, and again whenever it changes
+	h.UserBlacklist = blacklist.New(*userBlacklist)
+	if _, err := h.UserBlacklist.Reload(); err != nil {
+		logger.Fatal("trying to read in blacklist: %s", err)
+	}
+	if *blacklistReload > 0 {
+		go h.UserBlacklist.Watch(ctx, *blacklistReload)
+	}
+
 	// Set templating engine to html templates
 	// Keeping templates in folder 'views'
 	engine := html.New("./views", ".html")
@@ -99,10 +245,13 @@ func setup(ctx context.Context) {
 		data, _ := json.Marshal(i)
 		return string(data)
 	})
+	engine.AddFunc("bytes", users.FormatBytes)
 
 	// Create app
+	// Immutable as jobs keep values from the request after the handler has returned
 	app := fiber.New(fiber.Config{
-		Views: engine,
+		Views:     engine,
+		Immutable: true,
 	})
 
 	// Set static files folder to folder 'public'
@@ -113,8 +262,15 @@ func setup(ctx context.Context) {
 		File: "./public/favicon.ico",
 	})) // handles favicons requests nicely
 	app.Use(fiberlogger.New())
-	app.Use(cors.New()) // For enabling CORS
+	if len(*corsOrigins) > 0 {
+		app.Use(cors.New(cors.Config{
+			AllowOrigins:     strings.Join(*corsOrigins, ","),
+			AllowHeaders:     controllers.CSRFHeader,
+			AllowCredentials: true,
+		}))
+	}
 	app.Use(h.Authorise)
+	app.Use(h.CheckCSRF)
 
 	routes.RegisterRoutes(app, h)
 
@@ -129,6 +285,13 @@ func setup(ctx context.Context) {
 
 	// Handle closing down systems, backing up data
 	fmt.Println("Handle closing down systems here")
+	h.Queue.Close()
+	if err := audit.Close(); err != nil {
+		logger.Warn("closing audit log: %s", err)
+	}
+	if err := users.Close(); err != nil {
+		logger.Warn("closing users database: %s", err)
+	}
 }
 
 // We create a context here to run the web server in
@@ -136,7 +299,17 @@ func setup(ctx context.Context) {
 func main() {
 	// Parse args
 	kingpin.Version(version)
-	kingpin.Parse()
+	switch kingpin.Parse() {
+	case backupCommand.FullCommand():
+		backup(*backupFile)
+		return
+	case restoreCommand.FullCommand():
+		restore(*restoreFile)
+		return
+	case migrateCommand.FullCommand():
+		migrate(*migrateDryRun)
+		return
+	}
 
 	// Create channel to listen for os signals
 	c := make(chan os.Signal, 1)